@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/shanki200801/qshare/internal/config"
+	"github.com/shanki200801/qshare/internal/relay"
+	"github.com/shanki200801/qshare/internal/transfer"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const (
+	defaultRelay = "localhost:4000"
+	// profileEnv selects a profile when --profile is not given
+	profileEnv = "QSHARE_PROFILE"
+)
+
+// loadProfile reads the config file and returns the profile named by --profile, QSHARE_PROFILE
+// or the file's default, in that order
+func loadProfile(flagProfile string) (*config.File, config.Profile, error) {
+	path, err := config.DefaultPath()
+	if err != nil {
+		return nil, config.Profile{}, err
+	}
+	f, err := config.Load(path)
+	if err != nil {
+		return nil, config.Profile{}, err
+	}
+	name := flagProfile
+	if name == "" {
+		name = os.Getenv(profileEnv)
+	}
+	if name == "" {
+		name = f.Default()
+	}
+	p, err := f.Profile(name)
+	return f, p, err
+}
+
+// useTLSSettings makes tls:// and quic:// relays trust the profile's CA file, or nothing at all with tls_insecure
+func useTLSSettings(p config.Profile) error {
+	if p.TLSCA == "" && !p.TLSInsecure {
+		return nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: p.TLSInsecure}
+	if p.TLSCA != "" {
+		pem, err := os.ReadFile(p.TLSCA)
+		if err != nil {
+			return fmt.Errorf("error reading tls_ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in tls_ca %s", p.TLSCA)
+		}
+	}
+	relay.RegisterTransport("tls", relay.TLSTransport{Config: cfg})
+	relay.RegisterTransport("quic", relay.QUICTransport{TLS: cfg})
+	return nil
+}
+
+// resolveEkey applies the profile's ekey policy when no --ekey was given
+func resolveEkey(ekey, policy string) (string, error) {
+	if ekey != "" {
+		return ekey, nil
+	}
+	switch policy {
+	case config.EkeyRequire:
+		return "", errors.New("this profile requires an extra encryption key, pass --ekey")
+	case config.EkeyPrompt:
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return "", errors.New("this profile asks for an extra encryption key but there is no terminal, pass --ekey")
+		}
+		fmt.Print("Extra encryption key (empty for none): ")
+		key, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("error reading encryption key: %w", err)
+		}
+		return string(key), nil
+	}
+	return "", nil
+}
+
+// setting is the value a key ends up with and where it came from
+type setting struct {
+	value  string
+	source string
+}
+
+// effectiveSettings returns every setting as a command would see it, following the precedence
+// flags > environment > config file > defaults
+func effectiveSettings(cmd *cobra.Command, f *config.File, p config.Profile) map[string]setting {
+	fromFile := func(key string) setting {
+		if p.Name != "" {
+			if v, ok := f.Get(p.Name, key); ok {
+				return setting{fmt.Sprint(v), "profile " + p.Name}
+			}
+		}
+		if v, ok := f.Get("", key); ok {
+			return setting{fmt.Sprint(v), "config file"}
+		}
+		return setting{source: "default"}
+	}
+	out := map[string]setting{}
+	for _, k := range config.Keys {
+		out[k.Name] = fromFile(k.Name)
+	}
+	if s := out["relay"]; s.source == "default" {
+		out["relay"] = setting{defaultRelay, "default"}
+	}
+	if s := out["ekey"]; s.source == "default" {
+		out["ekey"] = setting{config.EkeyNone, "default"}
+	}
+	if s := out["tls_insecure"]; s.source == "default" {
+		out["tls_insecure"] = setting{"false", "default"}
+	}
+	if v := os.Getenv("RELAY_SERVER"); v != "" {
+		out["relay"] = setting{v, "RELAY_SERVER"}
+	}
+	if v := os.Getenv("RELAY_TOKEN"); v != "" {
+		out["token"] = setting{v, "RELAY_TOKEN"}
+	}
+	if v, _ := cmd.Flags().GetString("relay"); v != "" {
+		out["relay"] = setting{v, "--relay"}
+	}
+	if v, _ := cmd.Flags().GetString("limit"); cmd.Flags().Changed("limit") {
+		out["limit"] = setting{v, "--limit"}
+	}
+	// receive saves to --output as given, wherever output_dir points
+	if v, _ := cmd.Flags().GetString("output"); cmd.Flags().Changed("output") {
+		out["output_dir"] = setting{filepath.Dir(v), "--output"}
+	}
+	return out
+}
+
+// configCommand returns "qshare config", which shows and edits ~/.config/qshare/config.toml
+func configCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Show the settings in effect and where each comes from",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profile, _ := cmd.Flags().GetString("profile")
+			f, p, err := loadProfile(profile)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Config file:", f.Path)
+			if p.Name != "" {
+				fmt.Println("Profile:", p.Name)
+			}
+			if names := f.Profiles(); len(names) > 0 {
+				fmt.Println("Profiles:", names)
+			}
+			settings := effectiveSettings(cmd, f, p)
+			for _, k := range config.Keys {
+				s := settings[k.Name]
+				if k.Name == "token" && s.value != "" {
+					s.value = "(set)"
+				}
+				fmt.Printf("%-13s %-40s %s\n", k.Name, strconv.Quote(s.value), s.source)
+			}
+			return nil
+		},
+	}
+
+	getCmd := &cobra.Command{
+		Use:   "get <key>",
+		Short: "Print the value of a setting in effect",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profile, _ := cmd.Flags().GetString("profile")
+			f, p, err := loadProfile(profile)
+			if err != nil {
+				return err
+			}
+			s, ok := effectiveSettings(cmd, f, p)[args[0]]
+			if !ok {
+				return fmt.Errorf("unknown setting %q", args[0])
+			}
+			fmt.Println(s.value)
+			return nil
+		},
+	}
+
+	setHelp := "Write a setting to the config file, into the --profile table if one is given.\n" +
+		"\"set profile <name>\" picks the profile used when none is asked for.\n\nSettings:\n"
+	for _, k := range config.Keys {
+		setHelp += fmt.Sprintf("  %-13s %s\n", k.Name, k.Help)
+	}
+	setCmd := &cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Write a setting to the config file",
+		Long:  setHelp,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, value := args[0], args[1]
+			switch key {
+			case "limit":
+				if _, err := transfer.ParseRate(value); err != nil {
+					return err
+				}
+			case "relay":
+				if _, err := relay.ParseRelayList(value); err != nil {
+					return err
+				}
+			}
+			path, err := config.DefaultPath()
+			if err != nil {
+				return err
+			}
+			profile, _ := cmd.Flags().GetString("profile")
+			if err := config.Set(path, profile, key, value); err != nil {
+				return err
+			}
+			fmt.Printf("Set %s in %s\n", key, path)
+			return nil
+		},
+	}
+	// The flags of send and receive that override settings, to see what they would do
+	cmd.PersistentFlags().String("limit", "", "Show settings as with send or receive --limit")
+	cmd.PersistentFlags().StringP("output", "o", "", "Show settings as with receive --output")
+	cmd.AddCommand(getCmd, setCmd)
+	return cmd
+}
@@ -0,0 +1,270 @@
+// Package config reads and edits the client's config file, ~/.config/qshare/config.toml.
+// Top-level settings apply whichever profile is used, and a [profiles.<name>] table overrides
+// them while that profile is selected. A top-level profile key names the profile used when
+// none is asked for.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Ekey policies, deciding what happens when no extra encryption key is given
+const (
+	EkeyNone    = "none"
+	EkeyPrompt  = "prompt"
+	EkeyRequire = "require"
+)
+
+// ProfileKey is the top-level key naming the default profile
+const ProfileKey = "profile"
+
+// Key describes a setting a profile can hold
+type Key struct {
+	Name string
+	Help string
+	Bool bool
+}
+
+// Keys lists every setting, in the order they are shown
+var Keys = []Key{
+	{Name: "relay", Help: "Relay address, or a comma separated list to fail over between"},
+	{Name: "token", Help: "Token for relays that only serve clients their operator issued one to"},
+	{Name: "tls_ca", Help: "PEM file of CAs to trust for tls:// relays instead of the system ones"},
+	{Name: "tls_insecure", Help: "Skip certificate verification for tls:// relays", Bool: true},
+	{Name: "output_dir", Help: "Directory received files are saved in"},
+	{Name: "ekey", Help: "Extra encryption key policy: none, prompt (ask when --ekey is not given) or require"},
+	{Name: "limit", Help: "Bandwidth limit, e.g. 5MB/s"},
+}
+
+// Profile is the settings in effect for one profile, "" where unset
+type Profile struct {
+	Name        string
+	Relay       string
+	Token       string
+	TLSCA       string
+	TLSInsecure bool
+	OutputDir   string
+	Ekey        string
+	Limit       string
+}
+
+// File is a parsed config file
+type File struct {
+	Path   string
+	tables tables
+}
+
+// DefaultPath returns $XDG_CONFIG_HOME/qshare/config.toml, falling back to ~/.config
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error finding the config directory: %w", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "qshare", "config.toml"), nil
+}
+
+// Load reads the config file at path. A missing file is the same as an empty one.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	t, err := parseTOML(path, data)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Path: path, tables: t}
+	for table, keys := range t {
+		if table != "" && profileOf(table) == "" {
+			return nil, fmt.Errorf("%s: unknown table [%s], profiles are [profiles.<name>]", path, table)
+		}
+		for k, v := range keys {
+			if table == "" && k == ProfileKey {
+				if _, ok := v.(string); !ok {
+					return nil, fmt.Errorf("%s: %s must be a string", path, ProfileKey)
+				}
+				continue
+			}
+			if err := check(k, v); err != nil && table == "" {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: [%s] %w", path, table, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Default returns the profile named by the top-level profile key, "" if there is none
+func (f *File) Default() string {
+	name, _ := f.tables[""][ProfileKey].(string)
+	return name
+}
+
+// Profiles returns the names of the profiles defined in the file
+func (f *File) Profiles() []string {
+	var names []string
+	for table := range f.tables {
+		if name := profileOf(table); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the settings of the named profile on top of the top-level ones. "" gives the
+// top-level settings alone.
+func (f *File) Profile(name string) (Profile, error) {
+	p := Profile{Name: name}
+	p.apply(f.tables[""])
+	if name != "" {
+		keys, ok := f.tables[profileTable(name)]
+		if !ok {
+			return Profile{}, fmt.Errorf("no profile %q in %s", name, f.Path)
+		}
+		p.apply(keys)
+	}
+	return p, nil
+}
+
+// Get returns the value of key as written in the named profile, or at the top level for ""
+func (f *File) Get(profile, key string) (any, bool) {
+	table := ""
+	if profile != "" {
+		table = profileTable(profile)
+	}
+	v, ok := f.tables[table][key]
+	return v, ok
+}
+
+// Set writes key = value into the named profile, or at the top level for "", creating the file
+// if needed. The rest of the file is kept as it was.
+func Set(path, profile, key, value string) error {
+	table := ""
+	if profile != "" {
+		if !isBareKey(profile) {
+			return fmt.Errorf("invalid profile name %q, use letters, digits, - and _", profile)
+		}
+		table = profileTable(profile)
+	}
+	encoded := quote(value)
+	switch k, ok := lookup(key); {
+	case key == ProfileKey && profile == "":
+	case !ok:
+		return fmt.Errorf("unknown setting %q", key)
+	case k.Bool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		encoded = value
+	default:
+		if err := check(key, value); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	if _, err := parseTOML(path, data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+	// The file can hold relay tokens
+	if err := os.WriteFile(path, setKey(data, table, key, encoded), 0o600); err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	return nil
+}
+
+func (p *Profile) apply(keys map[string]any) {
+	for k, v := range keys {
+		s, _ := v.(string)
+		switch k {
+		case "relay":
+			p.Relay = s
+		case "token":
+			p.Token = s
+		case "tls_ca":
+			p.TLSCA = ExpandHome(s)
+		case "tls_insecure":
+			p.TLSInsecure, _ = v.(bool)
+		case "output_dir":
+			p.OutputDir = ExpandHome(s)
+		case "ekey":
+			p.Ekey = s
+		case "limit":
+			p.Limit = s
+		}
+	}
+}
+
+// ExpandHome replaces a leading ~ in path with the user's home directory
+func ExpandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~")
+	if !ok || rest != "" && rest[0] != '/' && rest[0] != filepath.Separator {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
+
+// check reports whether v is a valid value for key
+func check(key string, v any) error {
+	k, ok := lookup(key)
+	if !ok {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if k.Bool {
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%s must be a string", key)
+	}
+	if key == "ekey" && !slices.Contains([]string{"", EkeyNone, EkeyPrompt, EkeyRequire}, s) {
+		return fmt.Errorf("ekey must be %s, %s or %s", EkeyNone, EkeyPrompt, EkeyRequire)
+	}
+	return nil
+}
+
+func lookup(name string) (Key, bool) {
+	for _, k := range Keys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+func profileTable(name string) string {
+	return "profiles." + name
+}
+
+// profileOf returns the profile a table belongs to, "" if it is not a profile table
+func profileOf(table string) string {
+	name, ok := strings.CutPrefix(table, "profiles.")
+	if !ok || strings.Contains(name, ".") {
+		return ""
+	}
+	return name
+}
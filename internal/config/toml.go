@@ -0,0 +1,291 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The config file is read with a small TOML subset, enough for flat tables of settings:
+// [table.headers], key = value pairs, # comments, basic and literal strings, booleans and
+// integers. Arrays, inline tables and multi-line strings are rejected.
+
+// tables maps a dotted table name ("" for the top level) to its keys
+type tables map[string]map[string]any
+
+// parseTOML parses data, naming the file name in errors
+func parseTOML(name string, data []byte) (tables, error) {
+	t := tables{"": {}}
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...))
+		}
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fail("invalid table header %q", line)
+			}
+			parts, err := parseKeyPath(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			table = strings.Join(parts, ".")
+			if _, ok := t[table]; ok && table != "" {
+				return nil, fail("table [%s] defined twice", table)
+			}
+			t[table] = map[string]any{}
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fail("expected key = value, got %q", line)
+		}
+		parts, err := parseKeyPath(k)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		if len(parts) != 1 {
+			return nil, fail("dotted key %q is not supported, use a [table]", strings.TrimSpace(k))
+		}
+		value, err := parseValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		if _, ok := t[table][parts[0]]; ok {
+			return nil, fail("key %q defined twice", parts[0])
+		}
+		t[table][parts[0]] = value
+	}
+	return t, nil
+}
+
+// stripComment cuts a # comment off line, leaving # inside strings alone
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+// parseKeyPath splits a dotted key like profiles."my laptop" into its parts
+func parseKeyPath(s string) ([]string, error) {
+	var parts []string
+	rest := strings.TrimSpace(s)
+	for {
+		var part string
+		if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'") {
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted key in %q", s)
+			}
+			v, err := parseValue(rest[:end+2])
+			if err != nil {
+				return nil, err
+			}
+			part, rest = v.(string), strings.TrimSpace(rest[end+2:])
+		} else {
+			end := strings.IndexByte(rest, '.')
+			if end < 0 {
+				end = len(rest)
+			}
+			part, rest = strings.TrimSpace(rest[:end]), rest[end:]
+			if !isBareKey(part) {
+				return nil, fmt.Errorf("invalid key %q", strings.TrimSpace(s))
+			}
+		}
+		parts = append(parts, part)
+		if rest == "" {
+			return parts, nil
+		}
+		if rest[0] != '.' {
+			return nil, fmt.Errorf("invalid key %q", strings.TrimSpace(s))
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+// isBareKey reports whether s can be written as a key without quotes
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseValue(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return nil, fmt.Errorf("multi-line strings are not supported")
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(s[1:len(s)-1], "'") {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '"':
+		return unquote(s)
+	case s[0] == '[' || s[0] == '{':
+		return nil, fmt.Errorf("arrays and inline tables are not supported")
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s, strings need quotes", s)
+	}
+	return n, nil
+}
+
+// unquote decodes a TOML basic string, including its quotes
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != '"' {
+		return "", fmt.Errorf("invalid string %s", s)
+	}
+	var b strings.Builder
+	in := s[1 : len(s)-1]
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if c == '"' {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i++; i == len(in) {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		switch in[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\':
+			b.WriteByte(in[i])
+		case 'u', 'U':
+			size := 4
+			if in[i] == 'U' {
+				size = 8
+			}
+			if i+size >= len(in) {
+				return "", fmt.Errorf("invalid escape in string %s", s)
+			}
+			r, err := strconv.ParseUint(in[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid escape in string %s", s)
+			}
+			b.WriteRune(rune(r))
+			i += size
+		default:
+			return "", fmt.Errorf("invalid escape \\%c in string %s", in[i], s)
+		}
+	}
+	return b.String(), nil
+}
+
+// quote encodes s as a TOML basic string
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// setKey returns data with key in table set to the encoded value, editing the file in place so
+// comments and the order of everything else survive. A missing key is added at the end of its
+// table, a missing table at the end of the file.
+func setKey(data []byte, table, key, value string) []byte {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	entry := key + " = " + value
+	current := ""
+	found := table == ""
+	insert := -1 // line after the last key of table
+	if found {
+		insert = 0
+	}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(stripComment(line))
+		if strings.HasPrefix(trimmed, "[") {
+			if parts, err := parseKeyPath(strings.Trim(trimmed, "[]")); err == nil {
+				current = strings.Join(parts, ".")
+			}
+			if current == table {
+				found, insert = true, i+1
+			}
+			continue
+		}
+		if current != table || trimmed == "" {
+			continue
+		}
+		insert = i + 1
+		k, _, _ := strings.Cut(trimmed, "=")
+		if parts, err := parseKeyPath(k); err == nil && len(parts) == 1 && parts[0] == key {
+			lines[i] = entry
+			return []byte(strings.Join(lines, "\n") + "\n")
+		}
+	}
+	if !found {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+tableName(table)+"]", entry)
+		return []byte(strings.Join(lines, "\n") + "\n")
+	}
+	lines = append(lines[:insert], append([]string{entry}, lines[insert:]...)...)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// tableName writes a dotted table name back out, quoting parts that are not bare keys
+func tableName(table string) string {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		if !isBareKey(p) {
+			parts[i] = quote(p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
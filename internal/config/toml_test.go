@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want tables
+		err  string
+	}{
+		{
+			name: "top level and profile",
+			in:   "relay = \"a:1\"\ntls_insecure = true\n\n[profiles.work]\nlimit = '5MB/s'\n",
+			want: tables{"": {"relay": "a:1", "tls_insecure": true}, "profiles.work": {"limit": "5MB/s"}},
+		},
+		{
+			name: "quoted keys",
+			in:   "\"odd key\" = 1\n[profiles.\"my laptop\"]\n'lit.key' = \"x\"\n",
+			want: tables{"": {"odd key": int64(1)}, "profiles.my laptop": {"lit.key": "x"}},
+		},
+		{
+			name: "comments inside strings",
+			in:   "# a comment\nrelay = \"host#1:4000\" # trailing\ntoken = 'a#b'\nekey = \"say \\\"#\\\"\"\n",
+			want: tables{"": {"relay": "host#1:4000", "token": "a#b", "ekey": `say "#"`}},
+		},
+		{
+			name: "escapes and integers",
+			in:   "a = \"tab\\there \\u00e9\"\nb = 1_000\nc = 0x10\n",
+			want: tables{"": {"a": "tab\there é", "b": int64(1000), "c": int64(16)}},
+		},
+		{name: "duplicate table", in: "[profiles.a]\nx = \"1\"\n[profiles.a]\ny = \"2\"\n", err: "table [profiles.a] defined twice"},
+		{name: "duplicate quoted table", in: "[profiles.a]\n[profiles.\"a\"]\n", err: "defined twice"},
+		{name: "duplicate key", in: "relay = \"a\"\nrelay = \"b\"\n", err: `key "relay" defined twice`},
+		{name: "dotted key", in: "profiles.a.relay = \"x\"\n", err: "dotted key"},
+		{name: "array of tables", in: "[[profiles]]\n", err: "invalid table header"},
+		{name: "array", in: "relay = [\"a\"]\n", err: "arrays and inline tables"},
+		{name: "multi-line string", in: "relay = \"\"\"a\n", err: "multi-line strings"},
+		{name: "bare string", in: "relay = host\n", err: "strings need quotes"},
+		{name: "unterminated string", in: "relay = \"host # not a comment\n", err: "invalid string"},
+		{name: "missing value", in: "relay =\n", err: "missing value"},
+		{name: "no equals", in: "relay\n", err: "expected key = value"},
+		{name: "bad escape", in: "relay = \"a\\qb\"\n", err: "invalid escape"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML("config.toml", []byte(tt.in))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parsed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLReportsLine(t *testing.T) {
+	_, err := parseTOML("config.toml", []byte("relay = \"a\"\n\nlimit = 5MB\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "config.toml:3:") {
+		t.Fatalf("error = %v, want it on config.toml:3", err)
+	}
+}
+
+func TestSetRoundTrips(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		initial string
+		profile string
+		key     string
+		value   string
+		want    string
+	}{
+		{
+			name:  "new file",
+			key:   "relay",
+			value: "relay.example.com:4000",
+			want:  "relay = \"relay.example.com:4000\"\n",
+		},
+		{
+			name:    "replace keeps comments and order",
+			initial: "# my relays\nrelay = \"old:1\" # the old one\nlimit = \"1MB/s\"\n",
+			key:     "relay",
+			value:   "new:2",
+			want:    "# my relays\nrelay = \"new:2\"\nlimit = \"1MB/s\"\n",
+		},
+		{
+			name:    "top level key goes before the first table",
+			initial: "relay = \"a:1\"\n\n[profiles.work]\nrelay = \"b:2\"\n",
+			key:     "limit",
+			value:   "5MB/s",
+			want:    "relay = \"a:1\"\nlimit = \"5MB/s\"\n\n[profiles.work]\nrelay = \"b:2\"\n",
+		},
+		{
+			name:    "new key at the end of its profile",
+			initial: "[profiles.work]\nrelay = \"b:2\"\n\n[profiles.home]\nrelay = \"c:3\"\n",
+			profile: "work",
+			key:     "ekey",
+			value:   "prompt",
+			want:    "[profiles.work]\nrelay = \"b:2\"\nekey = \"prompt\"\n\n[profiles.home]\nrelay = \"c:3\"\n",
+		},
+		{
+			name:    "new profile",
+			initial: "relay = \"a:1\"\n",
+			profile: "work",
+			key:     "tls_insecure",
+			value:   "true",
+			want:    "relay = \"a:1\"\n\n[profiles.work]\ntls_insecure = true\n",
+		},
+		{
+			name:    "quoted key in a quoted table",
+			initial: "[profiles.\"work\"]\n\"relay\" = \"b:2\"\n",
+			profile: "work",
+			key:     "relay",
+			value:   "d:4",
+			want:    "[profiles.\"work\"]\nrelay = \"d:4\"\n",
+		},
+		{
+			name:  "value that needs escaping",
+			key:   "token",
+			value: "a\"b#c\\d",
+			want:  "token = \"a\\\"b#c\\\\d\"\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if tt.initial != "" {
+				if err := os.WriteFile(path, []byte(tt.initial), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Set(path, tt.profile, tt.key, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("file is\n%s\nwant\n%s", data, tt.want)
+			}
+			// What was written reads back as the value set
+			f, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want any = tt.value
+			if k, _ := lookup(tt.key); k.Bool {
+				want = tt.value == "true"
+			}
+			if got, ok := f.Get(tt.profile, tt.key); !ok || got != want {
+				t.Fatalf("%s reads back as %v, want %v", tt.key, got, want)
+			}
+		})
+	}
+}
+
+func TestSetRejectsBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	broken := "[profiles.a]\n[profiles.a]\n"
+	if err := os.WriteFile(path, []byte(broken), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(path, "", "relay", "a:1"); err == nil {
+		t.Fatal("Set edited a file that does not parse")
+	}
+	if data, _ := os.ReadFile(path); string(data) != broken {
+		t.Fatalf("broken file changed to %q", data)
+	}
+}
@@ -0,0 +1,193 @@
+package direct
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// pktPunch is the type of the packets peers punch through their NATs with. Its top two bits
+// are clear, so the QUIC transport that shares the socket passes punches on as non-QUIC packets.
+const pktPunch byte = 1
+
+const (
+	// directALPN is the application protocol peers agree on during the TLS handshake
+	directALPN = "qshare-direct"
+	keepalive  = 5 * time.Second
+	// idleTimeout ends a connection the peer has stopped answering
+	idleTimeout = 30 * time.Second
+	// lingerTimeout is how long a closed connection waits for the peer to read its last writes
+	// before it is torn down
+	lingerTimeout = 5 * time.Second
+)
+
+// packetConn is the part of a UDP socket Endpoint and Conn use, so tests can run them over a
+// simulated network that loses packets and rewrites addresses like a NAT
+type packetConn interface {
+	net.PacketConn
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// Conn is a QUIC stream to the peer over the socket Endpoint punched through the NATs. QUIC
+// makes it reliable, ordered and congestion controlled, and its TLS handshake, with
+// certificates both peers derive from the session key, keeps it confidential and lets only the
+// peer in. Closing it closes the QUIC connection and the socket.
+type Conn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	tr        *quic.Transport
+	pc        packetConn
+	closeOnce sync.Once
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// CloseWrite tells the peer no more data follows, its reads return io.EOF once it has read everything
+func (c *Conn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close ends the stream and, once the peer closes too or after lingerTimeout, the connection
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		c.Stream.Close()
+		go func() {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(lingerTimeout):
+			}
+			c.conn.CloseWithError(0, "")
+			// Closing the socket first wakes the transport's read
+			c.pc.Close()
+			c.tr.Close()
+		}()
+	})
+	return nil
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: PunchTimeout,
+		MaxIdleTimeout:       idleTimeout,
+		// Keeps the NAT mappings on both sides open while the stream is idle
+		KeepAlivePeriod:    keepalive,
+		MaxIncomingStreams: 1,
+	}
+}
+
+// certKey is the certificate key of the peer in role ('i' initiator or 'r' responder). Only
+// someone holding the session key can derive it.
+func (e *Endpoint) certKey(role byte) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write([]byte("qshare-direct-cert"))
+	mac.Write([]byte{role})
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// tlsConfig presents the certificate of our role and accepts only the certificate of the
+// peer's. Neither side has a name a CA could vouch for, the keys prove who they are instead.
+func (e *Endpoint) tlsConfig(initiator bool) (*tls.Config, error) {
+	me, them := byte('r'), byte('i')
+	if initiator {
+		me, them = 'i', 'r'
+	}
+	key := e.certKey(me)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "qshare direct"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate: %w", err)
+	}
+	peerKey := e.certKey(them).Public().(ed25519.PublicKey)
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("peer sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			if pub, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !pub.Equal(peerKey) {
+				return errors.New("peer does not hold the session key")
+			}
+			return nil
+		},
+		NextProtos: []string{directALPN},
+		MinVersion: tls.VersionTLS13,
+	}, nil
+}
+
+// dial connects to the first address the responder's punches arrive from
+func (e *Endpoint) dial(ctx context.Context, tr *quic.Transport, found <-chan net.Addr, tlsConf *tls.Config) (*Conn, error) {
+	var peer net.Addr
+	select {
+	case peer = <-found:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	conn, err := tr.Dial(ctx, peer, tlsConf, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer: %w", err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err == nil {
+		// QUIC only tells the peer about a stream once something is sent on it
+		_, err = stream.Write([]byte{0})
+	}
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("error opening stream to peer: %w", err)
+	}
+	return &Conn{Stream: stream, conn: conn, tr: tr, pc: e.pc}, nil
+}
+
+// accept waits for the initiator to connect and open its stream
+func (e *Endpoint) accept(ctx context.Context, tr *quic.Transport, tlsConf *tls.Config) (*Conn, error) {
+	ln, err := tr.Listen(tlsConf, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error listening for peer: %w", err)
+	}
+	// Stops further handshakes, the accepted connection carries on
+	defer ln.Close()
+	conn, err := ln.Accept(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error accepting peer: %w", err)
+	}
+	stream, err := conn.AcceptStream(ctx)
+	if err == nil {
+		deadline, _ := ctx.Deadline()
+		stream.SetReadDeadline(deadline)
+		_, err = io.ReadFull(stream, make([]byte, 1))
+		stream.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("error accepting stream from peer: %w", err)
+	}
+	return &Conn{Stream: stream, conn: conn, tr: tr, pc: e.pc}, nil
+}
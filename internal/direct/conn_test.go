@@ -0,0 +1,186 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// testEndpoint opens a socket at local on n for a peer holding key, skipping the rendezvous
+func testEndpoint(t *testing.T, n *fakeNet, local string, key []byte) *Endpoint {
+	t.Helper()
+	// The fake sockets cannot have their buffers resized
+	t.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
+	pc := n.listen(local, "")
+	e := &Endpoint{pc: pc, key: punchKey(key)}
+	e.addCandidate(local)
+	return e
+}
+
+// connectPair connects a to b, a as initiator
+func connectPair(t *testing.T, a, b *Endpoint) (*Conn, *Conn) {
+	t.Helper()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	responder := make(chan result, 1)
+	go func() {
+		conn, err := b.Connect(a.Candidates(), false)
+		responder <- result{conn, err}
+	}()
+	ca, err := a.Connect(b.Candidates(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := <-responder
+	if rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	return ca, rb.conn
+}
+
+// connPair connects two Conns directly over n, with nothing in between to punch through
+func connPair(t *testing.T, n *fakeNet) (*Conn, *Conn) {
+	t.Helper()
+	return connectPair(t, testEndpoint(t, n, "10.0.0.1:1000", testKey), testEndpoint(t, n, "10.0.0.2:2000", testKey))
+}
+
+// closePair shuts both ends down gracefully. Each waits for the other's end of stream before
+// closing, so neither cuts off data the other is still reading.
+func closePair(a, b *Conn) {
+	var wg sync.WaitGroup
+	for _, c := range []*Conn{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.CloseWrite()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.Copy(io.Discard, c)
+		}()
+	}
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func TestConnDeliversInOrderOverLossyPath(t *testing.T) {
+	n := newFakeNet(0.05, 2*time.Millisecond)
+	a, b := connPair(t, n)
+	defer closePair(a, b)
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data)
+		if err == nil {
+			err = a.CloseWrite()
+		}
+		sent <- err
+	}()
+	b.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnEncrypts(t *testing.T) {
+	n := newFakeNet(0, 0)
+	secret := []byte("nobody on the path may read this")
+	var mu sync.Mutex
+	leaked := false
+	n.tap = func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		leaked = leaked || bytes.Contains(b, secret)
+	}
+	a, b := connPair(t, n)
+	defer closePair(a, b)
+	if _, err := a.Write(secret); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(secret))
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if leaked {
+		t.Fatal("data crossed the network in the clear")
+	}
+}
+
+func TestConnRejectsStranger(t *testing.T) {
+	n := newFakeNet(0, 0)
+	a := testEndpoint(t, n, "10.0.0.1:1000", testKey)
+	b := testEndpoint(t, n, "10.0.0.2:2000", testKey)
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	responder := make(chan result, 1)
+	go func() {
+		conn, err := b.Connect(a.Candidates(), false)
+		responder <- result{conn, err}
+	}()
+	// Someone who learned b's address, but not the session key, dials it straight away
+	stranger := testEndpoint(t, n, "10.0.0.3:3000", []byte("someone else's session key......"))
+	tr := &quic.Transport{Conn: stranger.pc}
+	defer func() {
+		stranger.pc.Close()
+		tr.Close()
+	}()
+	tlsConf, err := stranger.tlsConfig(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stranger would take anyone, b has to turn it away
+	tlsConf.VerifyPeerCertificate = nil
+	found := make(chan net.Addr, 1)
+	found <- udpAddr("10.0.0.2:2000")
+	ctx, cancel := context.WithTimeout(context.Background(), PunchTimeout)
+	defer cancel()
+	// A TLS 1.3 client finishes its handshake before the server has checked its certificate,
+	// so b turns the stranger away by closing the connection
+	if conn, err := stranger.dial(ctx, tr, found, tlsConf); err == nil {
+		select {
+		case <-conn.conn.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("stranger connected without the session key")
+		}
+	}
+	// The peer still gets in
+	ca, err := a.Connect(b.Candidates(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := <-responder
+	if rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	closePair(ca, rb.conn)
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	a, b := connPair(t, newFakeNet(0, 0))
+	defer closePair(a, b)
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read with nothing sent returned before the deadline")
+	}
+}
@@ -0,0 +1,155 @@
+package direct
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// fakeNet is an in-process UDP network. It loses a share of the packets, delays the rest by a
+// random amount so they arrive out of order, and puts sockets behind NATs on request.
+type fakeNet struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	loss    float64
+	jitter  time.Duration
+	sockets map[string]*fakeSocket // by the address packets to the socket are sent to
+	// tap, if set, sees every packet sent
+	tap func(b []byte)
+}
+
+func newFakeNet(loss float64, jitter time.Duration) *fakeNet {
+	return &fakeNet{rng: rand.New(rand.NewSource(1)), loss: loss, jitter: jitter, sockets: map[string]*fakeSocket{}}
+}
+
+// listen opens a socket at local. If public is not nil the socket sits behind a NAT that
+// rewrites its packets to come from public, and lets in only packets from hosts it has sent to.
+func (n *fakeNet) listen(local, public string) *fakeSocket {
+	s := &fakeSocket{
+		net:     n,
+		local:   udpAddr(local),
+		public:  udpAddr(local),
+		inbox:   make(chan fakePacket, 4096),
+		closed:  make(chan struct{}),
+		allowed: map[string]bool{},
+	}
+	if public != "" {
+		s.public, s.nat = udpAddr(public), true
+	}
+	n.mu.Lock()
+	n.sockets[s.public.String()] = s
+	n.mu.Unlock()
+	return s
+}
+
+func (n *fakeNet) send(from *fakeSocket, b []byte, to *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	from.allowed[to.IP.String()] = true
+	if n.tap != nil {
+		n.tap(b)
+	}
+	dst, ok := n.sockets[to.String()]
+	if !ok || n.rng.Float64() < n.loss {
+		return
+	}
+	if dst.nat && !dst.allowed[from.public.IP.String()] {
+		return
+	}
+	pkt := fakePacket{data: append([]byte(nil), b...), from: from.public}
+	var delay time.Duration
+	if n.jitter > 0 {
+		delay = time.Duration(n.rng.Int63n(int64(n.jitter)))
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case dst.inbox <- pkt:
+		default:
+			// A full socket buffer drops packets, as the kernel does
+		}
+	})
+}
+
+type fakePacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// fakeSocket is one socket on a fakeNet. It implements packetConn and net.PacketConn.
+type fakeSocket struct {
+	net     *fakeNet
+	local   *net.UDPAddr
+	public  *net.UDPAddr
+	nat     bool
+	inbox   chan fakePacket
+	closed  chan struct{}
+	once    sync.Once
+	allowed map[string]bool // guarded by net.mu
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (s *fakeSocket) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case pkt := <-s.inbox:
+		return copy(b, pkt.data), pkt.from, nil
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	case <-expired:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *fakeSocket) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.net.send(s, b, addr)
+	return len(b), nil
+}
+
+func (s *fakeSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	return s.ReadFromUDP(b)
+}
+
+func (s *fakeSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.WriteToUDP(b, addr.(*net.UDPAddr))
+}
+
+func (s *fakeSocket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.deadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSocket) SetDeadline(t time.Time) error      { return s.SetReadDeadline(t) }
+func (s *fakeSocket) SetWriteDeadline(t time.Time) error { return nil }
+func (s *fakeSocket) LocalAddr() net.Addr                { return s.local }
+
+func (s *fakeSocket) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package direct connects two peers straight to each other over UDP. The relay's rendezvous
+// service tells each peer the public address its NAT gives it, the peers swap addresses over
+// the relayed connection, then punch through their NATs by sending to each other at once.
+package direct
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+const (
+	probeAttempts = 3
+	probeTimeout  = 300 * time.Millisecond
+	punchInterval = 100 * time.Millisecond
+	// PunchTimeout is how long Connect tries before giving up, leaving the transfer on the relay
+	PunchTimeout = 3 * time.Second
+	// maxCandidates bounds how many peer addresses are punched at
+	maxCandidates = 8
+)
+
+// Endpoint is a UDP socket together with the addresses a peer may reach it at
+type Endpoint struct {
+	pc         packetConn
+	key        []byte
+	candidates []string
+
+	mu   sync.Mutex
+	used bool
+}
+
+// Discover opens a UDP socket and asks the relay's rendezvous service at relayAddr how it sees
+// the socket from outside. key is the session key shared with the peer, used to recognise its
+// packets. The socket's address on the local network is offered too, for peers behind the
+// same NAT. Fails if the relay does not answer: without a public address punching would only
+// hold the transfer up for PunchTimeout before it falls back to the relay.
+func Discover(relayAddr string, key []byte) (*Endpoint, error) {
+	raddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving relay address: %w", err)
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening UDP socket: %w", err)
+	}
+	return discover(pc, raddr, key)
+}
+
+func discover(pc packetConn, raddr *net.UDPAddr, key []byte) (*Endpoint, error) {
+	e := &Endpoint{pc: pc, key: punchKey(key)}
+	public, err := e.probe(raddr)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("no public address to offer the peer: %w", err)
+	}
+	e.addCandidate(public)
+	if local, err := localAddr(raddr, pc); err == nil {
+		e.addCandidate(local)
+	}
+	return e, nil
+}
+
+// punchKey derives the key that setting up a direct connection uses from the session key
+func punchKey(key []byte) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("qshare-punch"))
+	return h.Sum(nil)
+}
+
+// Candidates returns the addresses the peer should punch at
+func (e *Endpoint) Candidates() []string {
+	return append([]string(nil), e.candidates...)
+}
+
+// Close releases the socket unless Connect handed it to a Conn
+func (e *Endpoint) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.used {
+		return nil
+	}
+	e.used = true
+	return e.pc.Close()
+}
+
+func (e *Endpoint) addCandidate(addr string) {
+	for _, c := range e.candidates {
+		if c == addr {
+			return
+		}
+	}
+	e.candidates = append(e.candidates, addr)
+}
+
+// probe asks the relay for our public address
+func (e *Endpoint) probe(raddr *net.UDPAddr) (string, error) {
+	b := make([]byte, relay.MaxNonceLen/2)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	req := relay.ProbeRequest(nonce)
+	buf := make([]byte, 512)
+	defer e.pc.SetReadDeadline(time.Time{})
+	for range probeAttempts {
+		if _, err := e.pc.WriteToUDP(req, raddr); err != nil {
+			return "", fmt.Errorf("error probing relay: %w", err)
+		}
+		e.pc.SetReadDeadline(time.Now().Add(probeTimeout))
+		for {
+			n, from, err := e.pc.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if !sameAddr(from, raddr) {
+				continue
+			}
+			if got, addr, ok := relay.ParseProbeReply(buf[:n]); ok && got == nonce {
+				return addr, nil
+			}
+		}
+	}
+	return "", errors.New("relay did not answer rendezvous probes")
+}
+
+// localAddr returns the socket's address on the interface that routes to the relay
+func localAddr(raddr *net.UDPAddr, pc packetConn) (string, error) {
+	route, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return "", err
+	}
+	defer route.Close()
+	ip := route.LocalAddr().(*net.UDPAddr).IP
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	return (&net.UDPAddr{IP: ip, Port: port}).String(), nil
+}
+
+// tag is the packet a peer in role ('i' initiator or 'r' responder) sends for setup step typ.
+// Only someone holding the session key can produce it.
+func (e *Endpoint) tag(typ, role byte) []byte {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write([]byte{typ, role})
+	return append([]byte{typ}, mac.Sum(nil)[:16]...)
+}
+
+// Connect punches through to the peer at one of its candidate addresses and returns a QUIC
+// connection to it. Both peers call Connect at about the same time, the sender as initiator:
+// it connects to the first address the responder's punches arrive from. Gives up after
+// PunchTimeout. The Endpoint's socket belongs to the returned Conn, or is closed on failure.
+func (e *Endpoint) Connect(peer []string, initiator bool) (*Conn, error) {
+	e.mu.Lock()
+	if e.used {
+		e.mu.Unlock()
+		return nil, errors.New("endpoint already used")
+	}
+	e.used = true
+	e.mu.Unlock()
+
+	var addrs []*net.UDPAddr
+	for _, c := range peer[:min(len(peer), maxCandidates)] {
+		if a, err := net.ResolveUDPAddr("udp", c); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	tlsConf, err := e.tlsConfig(initiator)
+	if err != nil {
+		e.pc.Close()
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: e.pc}
+	ctx, cancel := context.WithTimeout(context.Background(), PunchTimeout)
+	// Punching stops once connected
+	defer cancel()
+	found := make(chan net.Addr, 1)
+	go e.punch(ctx, tr, addrs, initiator, found)
+	var conn *Conn
+	if initiator {
+		conn, err = e.dial(ctx, tr, found, tlsConf)
+	} else {
+		conn, err = e.accept(ctx, tr, tlsConf)
+	}
+	if err != nil {
+		// Closing the socket first wakes the transport's read
+		e.pc.Close()
+		tr.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("could not reach the peer directly within %v", PunchTimeout)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// punch sends punches to addrs every punchInterval until ctx ends, and passes the address of
+// the peer's first punch to found. The responder answers every punch at once, so the initiator
+// learns an address that works both ways.
+func (e *Endpoint) punch(ctx context.Context, tr *quic.Transport, addrs []*net.UDPAddr, initiator bool, found chan<- net.Addr) {
+	me, them := byte('r'), byte('i')
+	if initiator {
+		me, them = 'i', 'r'
+	}
+	punch, peerPunch := e.tag(pktPunch, me), e.tag(pktPunch, them)
+	buf := make([]byte, 2048)
+	next := time.Now()
+	for ctx.Err() == nil {
+		if !time.Now().Before(next) {
+			for _, a := range addrs {
+				tr.WriteTo(punch, a)
+			}
+			next = time.Now().Add(punchInterval)
+		}
+		read, cancel := context.WithDeadline(ctx, next)
+		n, from, err := tr.ReadNonQUICPacket(read, buf)
+		cancel()
+		if err != nil {
+			if read.Err() != nil {
+				continue
+			}
+			return
+		}
+		if !hmac.Equal(buf[:n], peerPunch) {
+			continue
+		}
+		if !initiator {
+			tr.WriteTo(punch, from)
+		}
+		select {
+		case found <- from:
+		default:
+		}
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,113 @@
+package direct
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// startRendezvous answers rendezvous probes at addr on n until the test ends
+func startRendezvous(t *testing.T, n *fakeNet, addr string) *fakeSocket {
+	t.Helper()
+	s := n.listen(addr, "")
+	go relay.ServeRendezvous(s)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDiscoverLearnsPublicAddress(t *testing.T) {
+	n := newFakeNet(0, 0)
+	relayAddr := startRendezvous(t, n, "198.51.100.1:4000").public
+	e, err := discover(n.listen("10.0.0.2:5000", "203.0.113.2:40000"), relayAddr, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if c := e.Candidates(); len(c) == 0 || c[0] != "203.0.113.2:40000" {
+		t.Fatalf("candidates = %v, want the NAT's address first", c)
+	}
+}
+
+func TestDiscoverWithoutRendezvousFails(t *testing.T) {
+	n := newFakeNet(0, 0)
+	pc := n.listen("10.0.0.2:5000", "203.0.113.2:40000")
+	if _, err := discover(pc, udpAddr("198.51.100.1:4000"), testKey); err == nil {
+		t.Fatal("discover succeeded without learning a public address")
+	}
+	select {
+	case <-pc.closed:
+	default:
+		t.Fatal("socket left open after discover failed")
+	}
+}
+
+func TestConnectThroughNATs(t *testing.T) {
+	n := newFakeNet(0.05, 2*time.Millisecond)
+	relayAddr := startRendezvous(t, n, "198.51.100.1:4000").public
+	// discover retries its probes, so 5% loss still finds the public address
+	a, err := discover(n.listen("10.0.0.2:5000", "203.0.113.2:40000"), relayAddr, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := discover(n.listen("192.168.1.9:6000", "203.0.113.77:50000"), relayAddr, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	responder := make(chan result, 1)
+	go func() {
+		conn, err := b.Connect(a.Candidates(), false)
+		responder <- result{conn, err}
+	}()
+	ca, err := a.Connect(b.Candidates(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := <-responder
+	if rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	defer closePair(ca, rb.conn)
+	if got := ca.RemoteAddr().String(); got != "203.0.113.77:50000" {
+		t.Fatalf("initiator reached the peer at %s, want its NAT's address", got)
+	}
+	// Both directions work once punched
+	for _, pair := range [][2]*Conn{{ca, rb.conn}, {rb.conn, ca}} {
+		if _, err := pair[0].Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 5)
+		pair[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(pair[1], got); err != nil || string(got) != "hello" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+}
+
+func TestConnectRejectsWrongKey(t *testing.T) {
+	n := newFakeNet(0, 0)
+	relayAddr := startRendezvous(t, n, "198.51.100.1:4000").public
+	a, err := discover(n.listen("10.0.0.2:5000", ""), relayAddr, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := discover(n.listen("10.0.0.3:5000", ""), relayAddr, []byte("someone else's session key......"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Connect(a.Candidates(), false)
+	start := time.Now()
+	if _, err := a.Connect(b.Candidates(), true); err == nil {
+		t.Fatal("connected to a peer with a different key")
+	}
+	if elapsed := time.Since(start); elapsed < PunchTimeout {
+		t.Fatalf("gave up after %v, before PunchTimeout", elapsed)
+	}
+}
@@ -0,0 +1,102 @@
+// Package logging sets up the structured logger both binaries use. Codes, tokens and keys are
+// secrets, so the handler redacts them wherever they appear: attributes named after them are
+// replaced whole, and anything shaped like a code or token is cut out of every other string.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Formats for New
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// secretKeys are attribute keys whose values are always redacted
+var secretKeys = map[string]bool{"code": true, "token": true, "key": true, "ekey": true}
+
+var (
+	// codePattern matches generated codes like 5-lion-2-kiwi, with a parallel connection suffix
+	codePattern = regexp.MustCompile(`\b\d+-[a-z]+-\d+-[a-z]+(#\d+)?\b`)
+	// tokenPattern matches relay auth tokens
+	tokenPattern = regexp.MustCompile(`qst1\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+)
+
+// redactKey makes redacted values stable within a run, so lines about one code can be matched
+// up, but not across runs or guessable from the short list of possible codes
+var redactKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// Redact returns a stand-in for secret s, the same for the same s within a run
+func Redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(s))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// Scrub redacts anything shaped like a code or token in s
+func Scrub(s string) string {
+	s = codePattern.ReplaceAllStringFunc(s, Redact)
+	return tokenPattern.ReplaceAllStringFunc(s, Redact)
+}
+
+// New returns a logger writing to w in format (text or json) that drops records below level
+// (debug, info, warn or error)
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q (text or json)", format)
+}
+
+// Setup makes a logger for stderr the default, for slog and the log package alike
+func Setup(format, level string) error {
+	l, err := New(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redact(a.Value.Resolve().String()))
+	}
+	switch v := a.Value.Resolve(); v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, Scrub(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Scrub(x.String()))
+		}
+	}
+	return a
+}
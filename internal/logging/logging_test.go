@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// logged returns what log writes through a logger from New in format
+func logged(t *testing.T, format string, log func(*slog.Logger)) string {
+	t.Helper()
+	var buf bytes.Buffer
+	l, err := New(&buf, format, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log(l)
+	return buf.String()
+}
+
+// wantRedacted fails if out holds any of the words of code
+func wantRedacted(t *testing.T, out string, code string) {
+	t.Helper()
+	for _, word := range []string{"lion", "kiwi"} {
+		if strings.Contains(out, word) {
+			t.Fatalf("%s leaked into %q", code, out)
+		}
+	}
+	if !strings.Contains(out, "redacted:") {
+		t.Fatalf("no redaction in %q", out)
+	}
+}
+
+func TestCodesRedacted(t *testing.T) {
+	for _, code := range []string{
+		"5-lion-2-kiwi",
+		// An extra connection of a parallel transfer
+		"5-lion-2-kiwi#3",
+		// Issued on the second relay of a list
+		"5-lion-2-kiwi-r2",
+	} {
+		for _, format := range []string{FormatText, FormatJSON} {
+			for name, log := range map[string]func(*slog.Logger){
+				"message":     func(l *slog.Logger) { l.Info("Joined room " + code) },
+				"secret attr": func(l *slog.Logger) { l.Info("Joined room", "code", code) },
+				"other attr":  func(l *slog.Logger) { l.Info("Joined room", "handshake", "sender "+code) },
+				"error":       func(l *slog.Logger) { l.Warn("Join failed", "err", errors.New("room "+code+" is full")) },
+				"group": func(l *slog.Logger) {
+					l.Info("Joined room", slog.Group("room", slog.String("code", code), slog.Group("peer", slog.String("said", "hello "+code))))
+				},
+				"logger group": func(l *slog.Logger) {
+					l.WithGroup("room").With("handshake", "receiver "+code).Info("Joined room")
+				},
+			} {
+				t.Run(code+"/"+format+"/"+name, func(t *testing.T) {
+					wantRedacted(t, logged(t, format, log), code)
+				})
+			}
+		}
+	}
+}
+
+func TestTokensRedacted(t *testing.T) {
+	token := "qst1.eyJpZCI6ImNpIn0.c2lnbmF0dXJl"
+	out := logged(t, FormatJSON, func(l *slog.Logger) {
+		l.Info("Refused "+token, "token", token, "err", errors.New("bad token "+token))
+	})
+	if strings.Contains(out, "eyJpZCI6ImNpIn0") {
+		t.Fatalf("token leaked into %q", out)
+	}
+}
+
+func TestRedactIsStable(t *testing.T) {
+	if Redact("5-lion-2-kiwi") != Redact("5-lion-2-kiwi") {
+		t.Fatal("one code redacted two ways")
+	}
+	if Redact("5-lion-2-kiwi") == Redact("6-lion-2-kiwi") {
+		t.Fatal("two codes redacted the same")
+	}
+	// Lines about one code can be matched up whichever way it was logged
+	if got := Scrub("joined 5-lion-2-kiwi"); got != "joined "+Redact("5-lion-2-kiwi") {
+		t.Fatalf("Scrub = %q", got)
+	}
+	if Redact("") != "" {
+		t.Fatal("empty value redacted")
+	}
+}
+
+func TestNewRejectsBadOptions(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := New(&buf, "xml", "info"); err == nil {
+		t.Fatal("New accepted format xml")
+	}
+	if _, err := New(&buf, FormatText, "loud"); err == nil {
+		t.Fatal("New accepted level loud")
+	}
+	l, err := New(&buf, FormatText, "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("info logged at level warn: %q", buf.String())
+	}
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// admit reserves a connection slot for ip. Returns a reason if the server or the IP is at capacity.
+// Every successful admit must be paired with release.
+func (s *Server) admit(ip string) string {
+	select {
+	case s.connSlots <- struct{}{}:
+	default:
+		return "relay is at capacity, try again later"
+	}
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	if s.ipConns[ip] >= s.cfg.MaxConnsPerIP {
+		<-s.connSlots
+		return "too many connections from your address"
+	}
+	s.ipConns[ip]++
+	return ""
+}
+
+// release frees the slots taken by admit
+func (s *Server) release(ip string) {
+	s.ipMu.Lock()
+	s.ipConns[ip]--
+	if s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+	s.ipMu.Unlock()
+	<-s.connSlots
+}
+
+// readHandshake reads the handshake line within HandshakeTimeout, holding one of the bounded
+// handshake slots while doing so. The returned conn replays any bytes read past the line.
+// On a parse error the returned Handshake still carries the code if one was sent.
+func (s *Server) readHandshake(conn net.Conn) (Handshake, net.Conn, error) {
+	timeout := s.cfg.HandshakeTimeout
+	deadline := time.Now().Add(timeout)
+	select {
+	case s.handshakeSlots <- struct{}{}:
+		defer func() { <-s.handshakeSlots }()
+	case <-time.After(timeout):
+		return Handshake{}, conn, errHandshakeBusy
+	}
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(io.LimitReader(conn, 512))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Handshake{}, conn, err
+	}
+	hs, err := ParseHandshake(line)
+	if err != nil {
+		code, _, _ := strings.Cut(line, ":")
+		return Handshake{Code: strings.TrimSpace(code)}, conn, err
+	}
+	return hs, &bufferedConn{Conn: conn, r: io.MultiReader(reader, conn)}, nil
+}
+
+var errHandshakeBusy = errors.New("too many concurrent handshakes")
+
+// bufferedConn is a net.Conn whose reads first drain data buffered while reading the handshake
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// reject tells the client why it was turned away
+func reject(conn net.Conn, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, ReplyErr+" "+reason+"\n")
+}
+
+// untrack forgets conn and releases its handler. Caller holds s.mu.
+func (s *Server) untrack(conn net.Conn) {
+	if done, ok := s.conns[conn]; ok {
+		close(done)
+		delete(s.conns, conn)
+	}
+}
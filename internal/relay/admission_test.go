@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialIdle opens a connection that never sends its handshake
+func dialIdle(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitAdmitted waits until srv holds n connection slots
+func waitAdmitted(t *testing.T, srv *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.connSlots) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections admitted, want %d", len(srv.connSlots), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readReply reads the line the relay answers conn with
+func readReply(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestSlowClientsDoNotStallAccept(t *testing.T) {
+	const slow = 300
+	cfg := testConfig()
+	cfg.MaxConns, cfg.MaxConnsPerIP, cfg.MaxHandshakes = 2*slow, 2*slow, 2*slow
+	cfg.HandshakeTimeout = 10 * time.Second
+	_, addr := startServer(t, cfg)
+	for i := 0; i < slow; i++ {
+		dialIdle(t, addr)
+	}
+	// Each slow client holds its handshake for the full timeout. If they were handled one at a
+	// time, nobody else would get in for a long while.
+	start := time.Now()
+	code := "7-pear-8-tiger"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	if _, err := sender.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := receiver.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("transfer took %v with %d slow clients connected", elapsed, slow)
+	}
+}
+
+func TestHandshakeDeadline(t *testing.T) {
+	cfg := testConfig()
+	cfg.HandshakeTimeout = 100 * time.Millisecond
+	_, addr := startServer(t, cfg)
+	conn := dialIdle(t, addr)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("relay kept a connection that never sent its handshake")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("relay did not close a connection that never sent its handshake")
+	}
+}
+
+func TestPerIPConnectionCap(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConnsPerIP = 3
+	srv, addr := startServer(t, cfg)
+	for i := 0; i < 3; i++ {
+		dialIdle(t, addr)
+	}
+	waitAdmitted(t, srv, 3)
+	if got := readReply(t, dialIdle(t, addr)); got != ReplyErr+" too many connections from your address" {
+		t.Fatalf("reply = %q", got)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConns = 2
+	srv, addr := startServer(t, cfg)
+	for i := 0; i < 2; i++ {
+		dialIdle(t, addr)
+	}
+	waitAdmitted(t, srv, 2)
+	if got := readReply(t, dialIdle(t, addr)); got != ReplyErr+" relay is at capacity, try again later" {
+		t.Fatalf("reply = %q", got)
+	}
+}
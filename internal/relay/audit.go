@@ -0,0 +1,290 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Audit events
+const (
+	AuditSession         = "session"
+	AuditParallel        = "parallel"
+	AuditBroadcast       = "broadcast"
+	AuditMailboxUpload   = "mailbox-upload"
+	AuditMailboxDownload = "mailbox-download"
+	// AuditRejected is a connection turned away before it joined a room
+	AuditRejected = "rejected"
+)
+
+// Audit outcomes
+const (
+	// OutcomeCompleted means every peer hung up without the relay seeing an error. The relay
+	// cannot look inside the encrypted stream, so it does not prove the file arrived.
+	OutcomeCompleted    = "completed"
+	OutcomeDisconnected = "disconnected"
+	OutcomeRateLimited  = "rate-limited"
+	OutcomeBlocked      = "blocked"
+	OutcomeRejected     = "rejected"
+	OutcomeQuota        = "quota-exceeded"
+	// OutcomeAbandoned is a room whose other peer never came
+	OutcomeAbandoned = "abandoned"
+	OutcomeShutdown  = "shutdown"
+)
+
+// AuditRecord describes one session, or one connection the relay turned away. Codes are only
+// recorded hashed, see HashCode.
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Code    string    `json:"code,omitempty"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+	// IP is the client a rejection was for
+	IP             string    `json:"ip,omitempty"`
+	SenderIP       string    `json:"sender_ip,omitempty"`
+	ReceiverIPs    []string  `json:"receiver_ips,omitempty"`
+	SenderJoined   time.Time `json:"sender_joined,omitzero"`
+	ReceiverJoined time.Time `json:"receiver_joined,omitzero"`
+	// BytesUp is what the sender sent through the relay, BytesDown what the receivers sent back
+	BytesUp    int64 `json:"bytes_up"`
+	BytesDown  int64 `json:"bytes_down"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// AuditSink receives audit records. Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Record(rec AuditRecord) error
+}
+
+// JSONLSink writes each record to w as one line of JSON, in a single Write so a rotating
+// writer never splits a record across files
+type JSONLSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w}
+}
+
+func (s *JSONLSink) Record(rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error encoding audit record: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing audit record: %w", err)
+	}
+	return nil
+}
+
+// HashCode returns a keyed hash of code, so records of one code can be matched up without
+// the log revealing codes, which are short enough to guess from a plain hash
+func HashCode(key []byte, code string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// RotatingFile appends to a file, renaming it to path.1 (and older files to path.2 and so on,
+// keeping keep of them) once the next write would take it past maxSize. maxSize 0 never
+// rotates, for use with an external tool like logrotate that calls Reopen after moving the file.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening %s: %w", r.path, err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files along and starts a new one. Caller holds r.mu.
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	if r.keep <= 0 {
+		os.Remove(r.path)
+	} else {
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(r.backup(i), r.backup(i+1))
+		}
+		if err := os.Rename(r.path, r.backup(1)); err != nil {
+			return fmt.Errorf("error rotating %s: %w", r.path, err)
+		}
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) backup(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// Reopen closes the file and opens path again, picking up a new file after external rotation
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Close()
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// audit writes rec to the server's audit sink, if there is one
+func (s *Server) audit(rec AuditRecord) {
+	if s.cfg.Audit == nil {
+		return
+	}
+	rec.Time = s.clock.Now().UTC()
+	if err := s.cfg.Audit.Record(rec); err != nil {
+		slog.Error("Audit log failed", "err", err)
+	}
+}
+
+// auditCode hashes a room code for the audit log. Parallel connections are logged under the
+// code of their session.
+func (s *Server) auditCode(code string) string {
+	if code == "" {
+		return ""
+	}
+	code, _, _ = strings.Cut(code, "#")
+	return HashCode(s.cfg.AuditKey, code)
+}
+
+// auditReject records a connection from ip turned away before it joined a room
+func (s *Server) auditReject(ip, code, outcome, reason string) {
+	s.audit(AuditRecord{Event: AuditRejected, Code: s.auditCode(code), Outcome: outcome, Reason: reason, IP: ip})
+}
+
+// sessionAudit is what a room collects for its audit record while it pipes. Guarded by the
+// server's mu.
+type sessionAudit struct {
+	senderJoined   time.Time
+	receiverJoined time.Time
+	up, down       int64
+	outcome        string
+	// pipes counts the pipe goroutines still running, the last one writes the record
+	pipes int
+}
+
+// pipeEnded adds the n bytes one direction of r relayed and returns the room's record once
+// both directions have ended. notice is what the server told the other side. Caller holds s.mu.
+func (s *Server) pipeEnded(r *room, who string, n int64, err error, notice Notice) (AuditRecord, bool) {
+	a := &r.audit
+	if who == "sender" {
+		a.up += n
+	} else {
+		a.down += n
+	}
+	switch {
+	case notice.Kind == NoticeQuota:
+		a.outcome = OutcomeQuota
+	case !hungUp(err) && a.outcome == OutcomeCompleted:
+		a.outcome = OutcomeDisconnected
+	}
+	if a.pipes--; a.pipes > 0 {
+		return AuditRecord{}, false
+	}
+	event := AuditSession
+	if strings.Contains(r.code, "#") {
+		event = AuditParallel
+	}
+	rec := s.auditRecord(r, event, a.outcome)
+	rec.BytesUp, rec.BytesDown = a.up, a.down
+	// A retryable room may pipe again after a reconnect, and gets a record of its own then
+	r.audit = sessionAudit{senderJoined: a.senderJoined, receiverJoined: a.receiverJoined}
+	return rec, true
+}
+
+// hungUp reports whether a pipe ended with err because a peer closed its connection, which
+// clients often do with unread data still queued, so a reset counts too
+func hungUp(err error) bool {
+	return err == nil || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed)
+}
+
+// auditRecord returns a record of r with who joined and when. Caller holds s.mu.
+func (s *Server) auditRecord(r *room, event, outcome string) AuditRecord {
+	rec := AuditRecord{
+		Event:          event,
+		Code:           s.auditCode(r.code),
+		Outcome:        outcome,
+		SenderJoined:   r.audit.senderJoined,
+		ReceiverJoined: r.audit.receiverJoined,
+		DurationMS:     s.clock.Now().Sub(r.createdAt).Milliseconds(),
+	}
+	if r.sender != nil {
+		rec.SenderIP = ipOf(r.sender)
+	}
+	for _, c := range append([]net.Conn{r.receiver}, r.receivers...) {
+		if c != nil {
+			rec.ReceiverIPs = append(rec.ReceiverIPs, ipOf(c))
+		}
+	}
+	return rec
+}
+
+// countingReader counts the bytes read through it for the audit log
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
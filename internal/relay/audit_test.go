@@ -0,0 +1,246 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readLines returns the lines of the file at path, or nil if it does not exist
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// line is the nth line written in the rotation tests, 10 bytes with its newline
+func line(n int) string {
+	return fmt.Sprintf("record %02d", n)
+}
+
+func TestRotatingFileRotatesAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Room for three 10 byte lines
+	r, err := OpenRotatingFile(path, 30, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := range 4 {
+		if _, err := r.Write([]byte(line(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() > 30 {
+			t.Fatalf("after line %d: %v, %v", i, info.Size(), err)
+		}
+	}
+	if got := readLines(t, path+".1"); len(got) != 3 || got[0] != line(0) {
+		t.Fatalf("rotated file holds %q, want the first three lines", got)
+	}
+	if got := readLines(t, path); len(got) != 1 || got[0] != line(3) {
+		t.Fatalf("current file holds %q, want the fourth line", got)
+	}
+}
+
+func TestRotatingFileKeepsLastN(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	// One line per file, two old files kept
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := range 6 {
+		if _, err := r.Write([]byte(line(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d files kept, want the current one and 2 old ones", len(entries))
+	}
+	for name, want := range map[string]string{path: line(5), path + ".1": line(4), path + ".2": line(3)} {
+		if got := readLines(t, name); len(got) != 1 || got[0] != want {
+			t.Fatalf("%s holds %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+
+	// keep 0 only ever has the current file
+	single := filepath.Join(t.TempDir(), "audit.log")
+	r0, err := OpenRotatingFile(single, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r0.Close()
+	for i := range 3 {
+		r0.Write([]byte(line(i) + "\n"))
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(single)); len(entries) != 1 {
+		t.Fatalf("%d files with keep 0, want 1", len(entries))
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Size 0 leaves rotating to logrotate, which moves the file and asks for a reopen
+	r, err := OpenRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := range 20 {
+		r.Write([]byte(line(i) + "\n"))
+	}
+	if got := readLines(t, path); len(got) != 20 {
+		t.Fatalf("%d lines before the move, want 20 in one file", len(got))
+	}
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	// Until reopened, writes follow the moved file
+	r.Write([]byte(line(20) + "\n"))
+	if err := r.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte(line(21) + "\n"))
+	if got := readLines(t, path+".moved"); len(got) != 21 || got[20] != line(20) {
+		t.Fatalf("moved file holds %d lines, want 21", len(got))
+	}
+	if got := readLines(t, path); len(got) != 1 || got[0] != line(21) {
+		t.Fatalf("reopened file holds %q, want the line after the reopen", got)
+	}
+}
+
+func TestJSONLSinkWritesWholeLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLSink(&buf)
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.Record(AuditRecord{Event: AuditSession, Outcome: OutcomeCompleted, Reason: strings.Repeat("x", 100)})
+		}()
+	}
+	wg.Wait()
+	scanner := bufio.NewScanner(&buf)
+	n := 0
+	for ; scanner.Scan(); n++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+	}
+	if n != 50 {
+		t.Fatalf("%d records, want 50", n)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer the server's goroutines and the test can share
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// records parses the JSON lines written so far
+func (b *lockedBuffer) records(t *testing.T) []AuditRecord {
+	t.Helper()
+	var recs []AuditRecord
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if l == "" {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(l), &rec); err != nil {
+			t.Fatalf("record %q: %v", l, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditHashesCodesWithKey(t *testing.T) {
+	key := []byte("audit key, kept by the operator.")
+	var log lockedBuffer
+	cfg := testConfig()
+	cfg.Audit, cfg.AuditKey = NewJSONLSink(&log), key
+	srv, addr := startServer(t, cfg)
+	code := "3-kiwi-7-frog"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	waitUntil(t, "the session runs", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		_, ok := srv.sessions[code]
+		return ok
+	})
+	// An extra connection of the same transfer is logged under the session's code
+	extraSender := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptConn: "1"}})
+	extraReceiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver", Options: map[string]string{OptConn: "1"}})
+	// As is a connection turned away
+	rejected := "9-plum-2-newt"
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := ClientHandshake(conn, Handshake{Code: rejected, Role: "sender", Options: map[string]string{OptConn: "1"}}); err == nil {
+		t.Fatal("extra connection without a running transfer was let in")
+	}
+	extraSender.Close()
+	extraReceiver.Close()
+	sender.Close()
+	receiver.Close()
+	waitUntil(t, "the sessions and the rejection are logged", func() bool { return len(log.records(t)) >= 3 })
+
+	if HashCode(key, code) == HashCode([]byte("some other key.................."), code) {
+		t.Fatal("hash does not depend on the key")
+	}
+	want := map[string]string{
+		AuditSession:  HashCode(key, code),
+		AuditParallel: HashCode(key, code),
+		AuditRejected: HashCode(key, rejected),
+	}
+	seen := map[string]bool{}
+	for _, rec := range log.records(t) {
+		if rec.Code != want[rec.Event] {
+			t.Fatalf("%s record has code %q, want %q", rec.Event, rec.Code, want[rec.Event])
+		}
+		seen[rec.Event] = true
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("records of %v, want %d events", seen, len(want))
+	}
+	if strings.Contains(log.String(), "kiwi") || strings.Contains(log.String(), "plum") {
+		t.Fatal("the log holds a code in the clear")
+	}
+}
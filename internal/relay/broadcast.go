@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Status lines the relay writes back to the sender of a broadcast room, one per event:
+//
+//	PROGRESS <receiver> <bytes>
+//	DONE <receiver> <bytes>
+//	FAILED <receiver> <reason>
+const (
+	StatusProgress = "PROGRESS"
+	StatusDone     = "DONE"
+	StatusFailed   = "FAILED"
+)
+
+// ReceiverStatus reports how far the relay got delivering a broadcast to one receiver
+type ReceiverStatus struct {
+	Receiver int
+	Bytes    int64
+	Done     bool
+	Err      string
+}
+
+// Finished reports whether the receiver completed or failed
+func (s ReceiverStatus) Finished() bool {
+	return s.Done || s.Err != ""
+}
+
+// String returns the wire form of the status, including the trailing newline
+func (s ReceiverStatus) String() string {
+	switch {
+	case s.Err != "":
+		return fmt.Sprintf("%s %d %s\n", StatusFailed, s.Receiver, s.Err)
+	case s.Done:
+		return fmt.Sprintf("%s %d %d\n", StatusDone, s.Receiver, s.Bytes)
+	}
+	return fmt.Sprintf("%s %d %d\n", StatusProgress, s.Receiver, s.Bytes)
+}
+
+// ParseReceiverStatus parses a status line written by the relay
+func ParseReceiverStatus(line string) (ReceiverStatus, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(fields) != 3 {
+		return ReceiverStatus{}, fmt.Errorf("invalid receiver status: %q", line)
+	}
+	idx, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return ReceiverStatus{}, fmt.Errorf("invalid receiver status: %q", line)
+	}
+	s := ReceiverStatus{Receiver: idx}
+	switch fields[0] {
+	case StatusFailed:
+		s.Err = fields[2]
+		return s, nil
+	case StatusDone:
+		s.Done = true
+	case StatusProgress:
+	default:
+		return ReceiverStatus{}, fmt.Errorf("invalid receiver status: %q", line)
+	}
+	if s.Bytes, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return ReceiverStatus{}, fmt.Errorf("invalid receiver status: %q", line)
+	}
+	return s, nil
+}
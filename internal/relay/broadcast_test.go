@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStatuses reads broadcast status lines from the sender's connection until each of n
+// receivers has finished, and returns the final status of each
+func readStatuses(t *testing.T, conn net.Conn, n int) []ReceiverStatus {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	statuses := make([]ReceiverStatus, n)
+	for finished := 0; finished < n; {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading receiver status: %v", err)
+		}
+		st, err := ParseReceiverStatus(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Finished() {
+			finished++
+		}
+		statuses[st.Receiver-1] = st
+	}
+	return statuses
+}
+
+// receive reads want from a broadcast receiver and hangs up, which confirms it to the relay
+func receive(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("receiver got %d bytes, %v", len(got), err)
+	}
+	conn.Close()
+}
+
+func TestBroadcastReceiversSkipRateLimit(t *testing.T) {
+	// The default limits allow 5 connections a minute per IP and per code
+	srv, addr := startServer(t, Config{})
+	code := "3-plum-6-ibis"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptReceivers: "5"}})
+	waitUntil(t, "the room exists", func() bool { return srv.roomExists(code) })
+	var receivers []net.Conn
+	for range 5 {
+		receivers = append(receivers, dialRoom(t, addr, Handshake{Code: code, Role: "receiver"}))
+	}
+	payload := []byte("the same bytes for everyone")
+	sender.Write(payload)
+	sender.(*net.TCPConn).CloseWrite()
+	for _, conn := range receivers {
+		receive(t, conn, payload)
+	}
+	for _, st := range readStatuses(t, sender, 5) {
+		if !st.Done {
+			t.Fatalf("receiver %d: %+v", st.Receiver, st)
+		}
+	}
+}
+
+func TestBroadcastReceiversCapped(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxReceivers = 4
+	_, addr := startServer(t, cfg)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = ClientHandshake(conn, Handshake{Code: "4-kale-2-newt", Role: "sender", Options: map[string]string{OptReceivers: "5"}})
+	if err == nil || !strings.Contains(err.Error(), "at most 4 receivers") {
+		t.Fatalf("handshake = %v, want it rejected", err)
+	}
+}
+
+func TestBroadcastStartsWithoutMissingReceivers(t *testing.T) {
+	clock := newFakeClock()
+	cfg := testConfig()
+	cfg.Clock, cfg.BroadcastWait, cfg.CleanupInterval = clock, time.Minute, time.Hour
+	srv, addr := startServer(t, cfg)
+	code := "5-leek-7-tern"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptReceivers: "3"}})
+	waitUntil(t, "the room exists", func() bool { return srv.roomExists(code) })
+	first := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	second := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	waitUntil(t, "both receivers joined and the wait started", func() bool {
+		srv.mu.Lock()
+		joined := len(srv.rooms[code].receivers)
+		srv.mu.Unlock()
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		// The cleanup loop waits on the clock too
+		return joined == 2 && len(clock.waiters) == 2
+	})
+	clock.Advance(59 * time.Second)
+	if !srv.roomExists(code) {
+		t.Fatal("broadcast started before BroadcastWait")
+	}
+	clock.Advance(time.Second)
+	waitUntil(t, "the broadcast starts", func() bool { return !srv.roomExists(code) })
+
+	payload := []byte("sent to whoever came")
+	sender.Write(payload)
+	sender.(*net.TCPConn).CloseWrite()
+	receive(t, first, payload)
+	receive(t, second, payload)
+	statuses := readStatuses(t, sender, 3)
+	if !statuses[0].Done || !statuses[1].Done {
+		t.Fatalf("joined receivers not done: %+v", statuses[:2])
+	}
+	if statuses[2].Err != "receiver did not join" {
+		t.Fatalf("missing receiver status = %+v", statuses[2])
+	}
+}
+
+func TestBroadcastDropsLaggingReceiver(t *testing.T) {
+	srv, addr := startServer(t, testConfig())
+	code := "6-okra-1-rook"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptReceivers: "2"}})
+	waitUntil(t, "the room exists", func() bool { return srv.roomExists(code) })
+	reader := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	// The second receiver never reads
+	dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+
+	// Far more than the socket buffers and the backlog hold
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	sent := make(chan error, 1)
+	go func() {
+		defer sender.(*net.TCPConn).CloseWrite()
+		// Paced so the reading receiver keeps up however the goroutines are scheduled
+		for chunk := range slices.Chunk(payload, 64<<10) {
+			if _, err := sender.Write(chunk); err != nil {
+				sent <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		sent <- nil
+	}()
+	receive(t, reader, payload)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	statuses := readStatuses(t, sender, 2)
+	if !statuses[0].Done {
+		t.Fatalf("reading receiver: %+v", statuses[0])
+	}
+	if statuses[1].Err != "receiver fell behind" {
+		t.Fatalf("stalled receiver: %+v", statuses[1])
+	}
+}
@@ -0,0 +1,309 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator shares room registrations between the relays of a cluster, so the peers of a
+// code meet on one node however the load balancer spreads them. Nodes are named by the address
+// other nodes reach their ServeCluster listener at.
+type Coordinator interface {
+	// Claim registers code to node for ttl unless another node holds it, and returns the holder.
+	// Claiming a code node already holds extends it.
+	Claim(code, node string, ttl time.Duration) (string, error)
+	// Owner returns the node holding code, or "" if none does
+	Owner(code string) (string, error)
+	// Release drops node's registration of code. A code held by another node is left alone.
+	Release(code, node string) error
+}
+
+// Forwarded handshake option keys, only accepted on the cluster listener
+const (
+	// optForward signs a handshake another node forwarded, see forwardMAC
+	optForward = "fwd"
+	// optFrom is the hex encoded address of the client a forwarded handshake came from
+	optFrom = "from"
+	// optStamp is the unix time a handshake was forwarded at
+	optStamp = "ts"
+)
+
+// forwardMaxAge is how old a forwarded handshake may be, which bounds replaying a captured one.
+// It also allows for the clocks of the nodes to differ a little.
+const forwardMaxAge = 30 * time.Second
+
+// MemoryCoordinator is an in-process Coordinator. It stands in for the networked one in tests
+// and for several Servers run in one process.
+type MemoryCoordinator struct {
+	mu     sync.Mutex
+	claims map[string]roomClaim
+	now    func() time.Time
+}
+
+type roomClaim struct {
+	node    string
+	expires time.Time
+}
+
+func NewMemoryCoordinator() *MemoryCoordinator {
+	return &MemoryCoordinator{claims: make(map[string]roomClaim), now: time.Now}
+}
+
+func (m *MemoryCoordinator) Claim(code, node string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if c, ok := m.claims[code]; ok && now.Before(c.expires) && c.node != node {
+		return c.node, nil
+	}
+	m.claims[code] = roomClaim{node: node, expires: now.Add(ttl)}
+	return node, nil
+}
+
+func (m *MemoryCoordinator) Owner(code string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.claims[code]; ok && m.now().Before(c.expires) {
+		return c.node, nil
+	}
+	return "", nil
+}
+
+func (m *MemoryCoordinator) Release(code, node string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.claims[code]; ok && c.node == node {
+		delete(m.claims, code)
+	}
+	return nil
+}
+
+// Scripts that make each registration change atomic on the store
+const (
+	claimScript = `local v = redis.call('GET', KEYS[1])
+if v and v ~= ARGV[1] then return v end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]`
+	releaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`
+)
+
+// RESPStore is also a Coordinator, keeping registrations under qshare:room:<code>. The server
+// must support EVAL.
+func (s *RESPStore) Claim(code, node string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.exec([]string{"EVAL", claimScript, "1", "qshare:room:" + code, node, strconv.FormatInt(ttl.Milliseconds(), 10)})
+	if err != nil {
+		return "", err
+	}
+	return replies[0], nil
+}
+
+func (s *RESPStore) Owner(code string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.exec([]string{"GET", "qshare:room:" + code})
+	if err != nil {
+		return "", err
+	}
+	return replies[0], nil
+}
+
+func (s *RESPStore) Release(code, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.exec([]string{"EVAL", releaseScript, "1", "qshare:room:" + code, node})
+	return err
+}
+
+// owner returns the node the peers of hs meet on. New codes are claimed for this node, while
+// extra connections of a parallel transfer go wherever their session runs. Returns "" to serve
+// hs here, which is also what happens when the coordinator cannot be reached.
+func (s *Server) owner(hs Handshake) string {
+	if s.cfg.Coordinator == nil {
+		return ""
+	}
+	var node string
+	var err error
+	if _, extra := hs.Options[OptConn]; extra {
+		node, err = s.cfg.Coordinator.Owner(hs.Code)
+	} else {
+		node, err = s.cfg.Coordinator.Claim(hs.Code, s.cfg.ClusterNode, s.cfg.AbandonAfter)
+	}
+	if err != nil {
+		slog.Error("Cluster coordinator failed, serving connection here", "err", err)
+		return ""
+	}
+	if node == s.cfg.ClusterNode {
+		return ""
+	}
+	return node
+}
+
+// claim extends this node's registration of code, for rooms still waiting or piping
+func (s *Server) claim(code string, ttl time.Duration) {
+	if s.cfg.Coordinator == nil || strings.Contains(code, "#") {
+		return
+	}
+	if _, err := s.cfg.Coordinator.Claim(code, s.cfg.ClusterNode, ttl); err != nil {
+		slog.Error("Error extending cluster registration", "code", code, "err", err)
+	}
+}
+
+// unclaim drops this node's registration of code once nobody can join its room here any more
+func (s *Server) unclaim(code string) {
+	if s.cfg.Coordinator == nil || strings.Contains(code, "#") {
+		return
+	}
+	if err := s.cfg.Coordinator.Release(code, s.cfg.ClusterNode); err != nil {
+		slog.Error("Error releasing cluster registration", "code", code, "err", err)
+	}
+}
+
+// forwardMAC signs everything in hs except the signature itself, so the cluster listener only
+// takes handshakes another node has admitted, exactly as that node passed them on
+func (s *Server) forwardMAC(hs Handshake) string {
+	mac := hmac.New(sha256.New, s.cfg.ClusterKey)
+	mac.Write([]byte(hs.Code + "\n" + hs.Role + "\n" + strconv.FormatBool(hs.Retry) + "\n"))
+	keys := make([]string, 0, len(hs.Options))
+	for k := range hs.Options {
+		if k != optForward {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		mac.Write([]byte(k + "=" + hs.Options[k] + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// forward proxies conn to node, which holds the room for hs. The handshake is passed on signed
+// and without the token, since this node has already checked it and meters conn against it.
+func (s *Server) forward(conn net.Conn, hs Handshake, node string) {
+	up, err := net.DialTimeout("tcp", node, s.cfg.HandshakeTimeout)
+	if err != nil {
+		slog.Warn("Cluster node unreachable", "node", node, "code", hs.Code, "err", err)
+		reject(conn, "the relay holding this code is unreachable, try again later")
+		return
+	}
+	defer up.Close()
+	delete(hs.Options, OptToken)
+	hs.Options[optFrom] = hex.EncodeToString([]byte(conn.RemoteAddr().String()))
+	hs.Options[optStamp] = strconv.FormatInt(s.clock.Now().Unix(), 10)
+	hs.Options[optForward] = s.forwardMAC(hs)
+	if _, err := io.WriteString(up, hs.String()); err != nil {
+		reject(conn, "the relay holding this code is unreachable, try again later")
+		return
+	}
+	slog.Info("Forwarding connection", "code", hs.Code, "role", hs.Role, "node", node)
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.conns[conn] = done
+	s.mu.Unlock()
+	s.activePipes.Add(1)
+	defer s.activePipes.Done()
+	go func() {
+		io.Copy(up, conn)
+		// Pass on a half-close, which ends mailbox uploads and broadcasts
+		if cw, ok := up.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	// Shutdown releases the handler by closing done
+	go func() {
+		<-done
+		up.Close()
+	}()
+	io.Copy(conn, up)
+	s.mu.Lock()
+	s.untrack(conn)
+	s.mu.Unlock()
+}
+
+// ServeCluster accepts connections other nodes forward on ln until Shutdown closes it. ln must
+// only be reachable by the cluster: it skips admission limits, which the forwarding node applies.
+func (s *Server) ServeCluster(ln net.Listener) error {
+	s.mu.Lock()
+	if s.draining.Load() {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
+			continue
+		}
+		go s.handleForwarded(conn)
+	}
+}
+
+func (s *Server) handleForwarded(conn net.Conn) {
+	defer conn.Close()
+	hs, bconn, err := s.readHandshake(conn)
+	if err != nil {
+		slog.Warn("Forwarded handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	if len(s.cfg.ClusterKey) == 0 || !hmac.Equal([]byte(hs.Options[optForward]), []byte(s.forwardMAC(hs))) {
+		slog.Warn("Forwarded connection has a bad signature", "remote", conn.RemoteAddr())
+		reject(conn, "bad forward signature")
+		return
+	}
+	stamp, err := strconv.ParseInt(hs.Options[optStamp], 10, 64)
+	if age := s.clock.Now().Sub(time.Unix(stamp, 0)); err != nil || age > forwardMaxAge || age < -forwardMaxAge {
+		slog.Warn("Forwarded connection is stale", "remote", conn.RemoteAddr(), "stamp", hs.Options[optStamp])
+		reject(conn, "stale forwarded handshake")
+		return
+	}
+	from := hs.Options[optFrom]
+	delete(hs.Options, optFrom)
+	delete(hs.Options, optStamp)
+	delete(hs.Options, optForward)
+	addr, err := hex.DecodeString(from)
+	if err != nil {
+		reject(conn, "bad forwarded address")
+		return
+	}
+	client := &forwardedConn{Conn: bconn, addr: clientAddr(addr)}
+	if s.draining.Load() {
+		goAway(client)
+		s.auditReject(ipOf(client), hs.Code, OutcomeShutdown, "relay is shutting down")
+		return
+	}
+	slog.Debug("Forwarded connection", "node", conn.RemoteAddr(), "remote", client.RemoteAddr())
+	s.join(client, hs)
+}
+
+// forwardedConn is a connection another node forwarded, reporting the client's address so
+// quotas and the audit log see who is really on the other end
+type forwardedConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// clientAddr is the host:port of a client as another node saw it
+type clientAddr string
+
+func (a clientAddr) Network() string { return "tcp" }
+func (a clientAddr) String() string  { return string(a) }
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testClusterKey = []byte("0123456789abcdef0123456789abcdef")
+
+// startNode runs a cluster node sharing coord and the rate limits in store until the test ends.
+// It returns the server, the address clients connect to and the address of its cluster
+// listener, which names the node.
+func startNode(t *testing.T, coord Coordinator, store CounterStore, clock Clock) (*Server, string, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.RateLimit, cfg.HandshakeGuard = NewSharedRateLimit(store), &HandshakeGuard{Store: store}
+	cfg.Coordinator, cfg.ClusterNode, cfg.ClusterKey, cfg.Clock = coord, ln.Addr().String(), testClusterKey, clock
+	srv, addr := startServer(t, cfg)
+	go srv.ServeCluster(ln)
+	return srv, addr, ln.Addr().String()
+}
+
+// forwardedHandshake is the handshake a node passes on for a client at from, signed by srv
+func forwardedHandshake(srv *Server, hs Handshake, from string, at time.Time) Handshake {
+	hs.Options = map[string]string{
+		optFrom:  hex.EncodeToString([]byte(from)),
+		optStamp: strconv.FormatInt(at.Unix(), 10),
+	}
+	hs.Options[optForward] = srv.forwardMAC(hs)
+	return hs
+}
+
+// dialCluster sends hs to a cluster listener and returns the handshake error
+func dialCluster(t *testing.T, addr string, hs Handshake) error {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = ClientHandshake(conn, hs)
+	return err
+}
+
+func TestClusterForwardsPeersToOwningNode(t *testing.T) {
+	coord, store := NewMemoryCoordinator(), NewMemoryStore()
+	a, addrA, nodeA := startNode(t, coord, store, nil)
+	_, addrB, _ := startNode(t, coord, store, nil)
+	code := "4-gull-6-sage"
+	sender := dialRoom(t, addrA, Handshake{Code: code, Role: "sender"})
+	if owner, _ := coord.Owner(code); owner != nodeA {
+		t.Fatalf("code held by %q, want the sender's node %s", owner, nodeA)
+	}
+	// The receiver reaches the other node, which forwards it to the sender's
+	receiver := dialRoom(t, addrB, Handshake{Code: code, Role: "receiver"})
+	for _, pair := range [][2]net.Conn{{sender, receiver}, {receiver, sender}} {
+		if _, err := pair[0].Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		pair[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(pair[1], got); err != nil || string(got) != "ping" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+	// Node A sees the receiver's own address, not node B's
+	a.mu.Lock()
+	seen := false
+	for conn := range a.conns {
+		if _, ok := conn.(*forwardedConn); ok && conn.RemoteAddr().String() == receiver.LocalAddr().String() {
+			seen = true
+		}
+	}
+	a.mu.Unlock()
+	if !seen {
+		t.Fatal("node A does not see the forwarded receiver's address")
+	}
+	sender.Close()
+	receiver.Close()
+	waitUntil(t, "the code is released", func() bool {
+		owner, _ := coord.Owner(code)
+		return owner == ""
+	})
+}
+
+func TestClusterNodesShareRateLimits(t *testing.T) {
+	coord, store := NewMemoryCoordinator(), NewMemoryStore()
+	_, addrA, _ := startNode(t, coord, store, nil)
+	_, addrB, _ := startNode(t, coord, store, nil)
+	// Each node alone would let all of these through, together they allow codeLimit
+	for i := range codeLimit {
+		addr := addrA
+		if i%2 == 1 {
+			addr = addrB
+		}
+		dialRoom(t, addr, Handshake{Code: "9-kelp-3-owl", Role: "receiver"})
+	}
+	conn := dialIdle(t, addrB)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ClientHandshake(conn, Handshake{Code: "9-kelp-3-owl", Role: "receiver"}); err == nil {
+		t.Fatalf("attempt %d on the code accepted across the cluster", codeLimit+1)
+	}
+}
+
+func TestClusterChecksForwardedHandshakes(t *testing.T) {
+	clock := newFakeClock()
+	srv, _, node := startNode(t, NewMemoryCoordinator(), NewMemoryStore(), clock)
+	hs := Handshake{Code: "8-newt-2-plum", Role: "sender"}
+	now := clock.Now()
+
+	tampered := forwardedHandshake(srv, hs, "203.0.113.9:5000", now)
+	tampered.Options[OptReceivers] = "5"
+	if err := dialCluster(t, node, tampered); err == nil {
+		t.Fatal("handshake with an option added after signing accepted")
+	}
+	tampered = forwardedHandshake(srv, hs, "203.0.113.9:5000", now)
+	tampered.Retry = true
+	if err := dialCluster(t, node, tampered); err == nil {
+		t.Fatal("handshake with retry added after signing accepted")
+	}
+	other := &Server{cfg: Config{ClusterKey: []byte("another cluster's key...........")}}
+	if err := dialCluster(t, node, forwardedHandshake(other, hs, "203.0.113.9:5000", now)); err == nil {
+		t.Fatal("handshake signed with another key accepted")
+	}
+	if err := dialCluster(t, node, forwardedHandshake(srv, hs, "203.0.113.9:5000", now.Add(-time.Minute))); err == nil {
+		t.Fatal("stale handshake accepted")
+	}
+	if err := dialCluster(t, node, forwardedHandshake(srv, hs, "203.0.113.9:5000", now.Add(-5*time.Second))); err != nil {
+		t.Fatalf("fresh handshake rejected: %v", err)
+	}
+}
+
+func TestMemoryCoordinatorClaims(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewMemoryCoordinator()
+	m.now = func() time.Time { return now }
+	if node, _ := m.Claim("code", "a", time.Minute); node != "a" {
+		t.Fatalf("first claim went to %q, want a", node)
+	}
+	if node, _ := m.Claim("code", "b", time.Minute); node != "a" {
+		t.Fatalf("second node got %q, want the holder a", node)
+	}
+	m.Release("code", "b")
+	if node, _ := m.Owner("code"); node != "a" {
+		t.Fatalf("release by another node dropped the claim, owner %q", node)
+	}
+	// Claiming again extends the registration
+	now = now.Add(50 * time.Second)
+	m.Claim("code", "a", time.Minute)
+	now = now.Add(50 * time.Second)
+	if node, _ := m.Owner("code"); node != "a" {
+		t.Fatalf("extended claim expired, owner %q", node)
+	}
+	now = now.Add(time.Minute)
+	if node, _ := m.Claim("code", "b", time.Minute); node != "b" {
+		t.Fatalf("expired claim still held by %q", node)
+	}
+	m.Release("code", "b")
+	if node, _ := m.Owner("code"); node != "" {
+		t.Fatalf("released code owned by %q", node)
+	}
+}
+
+func TestRESPStoreCoordinates(t *testing.T) {
+	fake, addr := startFakeRESP(t)
+	s := NewRESPStore(addr)
+	defer s.Close()
+	if node, err := s.Claim("code", "a", 90*time.Second); err != nil || node != "a" {
+		t.Fatalf("Claim = %q, %v, want a", node, err)
+	}
+	if node, err := s.Claim("code", "b", 90*time.Second); err != nil || node != "a" {
+		t.Fatalf("Claim by another node = %q, %v, want the holder a", node, err)
+	}
+	if err := s.Release("code", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := s.Owner("code"); err != nil || node != "a" {
+		t.Fatalf("Owner after another node's release = %q, %v, want a", node, err)
+	}
+	fake.mu.Lock()
+	ttl := fake.ttls["qshare:room:code"]
+	fake.mu.Unlock()
+	if ttl != 90*time.Second {
+		t.Fatalf("TTL = %v, want 90s", ttl)
+	}
+	if err := s.Release("code", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := s.Owner("code"); err != nil || node != "" {
+		t.Fatalf("Owner after release = %q, %v, want none", node, err)
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthHandler reports OK while serving and 503 while draining, so load balancers stop routing to us
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("DRAINING"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+}
+
+// Shutdown stops accepting connections, tells peers that can no longer be matched to go away,
+// and waits up to timeout for active transfers to finish before notifying and closing the rest.
+func (s *Server) Shutdown(timeout time.Duration) {
+	var closed []AuditRecord
+	var gone []string
+	s.mu.Lock()
+	if s.draining.Swap(true) {
+		s.mu.Unlock()
+		return
+	}
+	close(s.stopped)
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	for code, r := range s.rooms {
+		if r.sender == nil || r.receiver == nil {
+			slog.Info("Closing unmatched room for shutdown", "code", code)
+			closed = append(closed, s.auditRecord(r, AuditSession, OutcomeShutdown))
+			for _, c := range append([]net.Conn{r.sender, r.receiver}, r.receivers...) {
+				goAway(c)
+				s.untrack(c)
+			}
+			delete(s.rooms, code)
+			gone = append(gone, code)
+		}
+	}
+	s.mu.Unlock()
+	for _, rec := range closed {
+		s.audit(rec)
+	}
+	for _, code := range gone {
+		s.unclaim(code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.activePipes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All transfers finished")
+	case <-time.After(timeout):
+		s.mu.Lock()
+		slog.Warn("Drain deadline reached, closing connections", "conns", len(s.conns))
+		// Notify everyone before closing anything, or a closed side's pipe could tell the
+		// other side its peer disconnected first
+		for conn := range s.conns {
+			notifyGoAway(conn)
+		}
+		for conn := range s.conns {
+			conn.Close()
+			s.untrack(conn)
+		}
+		s.mu.Unlock()
+		<-done
+	}
+}
+
+// goAway writes a GOAWAY notice to conn and closes it
+func goAway(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	notifyGoAway(conn)
+	conn.Close()
+}
+
+// notifyGoAway writes a GOAWAY notice to conn
+func notifyGoAway(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(Notice{Kind: NoticeGoAway, Reason: "relay is shutting down"}.String()))
+}
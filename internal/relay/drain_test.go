@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownSendsGoAwayToUnmatchedPeers(t *testing.T) {
+	srv, addr := startServer(t, testConfig())
+	sender := dialRoom(t, addr, Handshake{Code: "1-kiwi-2-lion", Role: "sender"})
+
+	srv.Shutdown(time.Second)
+	if n := readNotice(t, sender, bufio.NewReader(sender)); n.Kind != NoticeGoAway {
+		t.Fatalf("notice = %v, want %s", n, NoticeGoAway)
+	}
+	if !srv.Draining() {
+		t.Fatal("Draining() = false after Shutdown")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("relay still accepts connections after Shutdown")
+	}
+}
+
+func TestHealthReportsDraining(t *testing.T) {
+	srv, _ := startServer(t, testConfig())
+	health := httptest.NewServer(srv.HealthHandler())
+	defer health.Close()
+	status := func() int {
+		resp, err := http.Get(health.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("status before shutdown = %d, want 200", got)
+	}
+	srv.Shutdown(time.Second)
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Fatalf("status while draining = %d, want 503", got)
+	}
+}
+
+func TestShutdownLetsActivePipesFinish(t *testing.T) {
+	srv, addr := startServer(t, testConfig())
+	code := "3-fig-4-wolf"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Shutdown(10 * time.Second)
+		close(stopped)
+	}()
+	for !srv.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	// The transfer started before the drain, so it still goes through
+	if _, err := sender.Write([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	sender.(*net.TCPConn).CloseWrite()
+	r := bufio.NewReader(receiver)
+	got := make([]byte, len("payload"))
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "payload" {
+		t.Fatalf("receiver got %q, %v", got, err)
+	}
+	if n := readNotice(t, receiver, r); n.Kind != NoticeDisconnect {
+		t.Fatalf("notice = %v, want %s", n, NoticeDisconnect)
+	}
+	receiver.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the transfer finished")
+	}
+}
+
+func TestShutdownDeadlineClosesStuckTransfers(t *testing.T) {
+	srv, addr := startServer(t, testConfig())
+	code := "5-plum-6-panda"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+
+	start := time.Now()
+	srv.Shutdown(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Shutdown took %v with a 200ms deadline", elapsed)
+	}
+	for _, conn := range []net.Conn{sender, receiver} {
+		if n := readNotice(t, conn, bufio.NewReader(conn)); n.Kind != NoticeGoAway {
+			t.Fatalf("notice = %v, want %s", n, NoticeGoAway)
+		}
+	}
+}
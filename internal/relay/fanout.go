@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// broadcastWriteTimeout fails a receiver that stops reading instead of stalling everyone
+	broadcastWriteTimeout = time.Minute
+	// broadcastConfirmTimeout is how long a receiver has to hang up after the last byte
+	broadcastConfirmTimeout = 30 * time.Second
+	progressInterval        = 250 * time.Millisecond
+	// broadcastBacklog is how many chunks of the sender's stream a receiver may fall behind by
+	// before it is dropped, so a slow one never holds up the rest
+	broadcastBacklog = 256
+)
+
+// fanout delivers a copy of the sender's stream to one broadcast receiver
+type fanout struct {
+	index  int
+	conn   net.Conn
+	chunks chan []byte
+	srcErr error // set before chunks is closed if the sender went away mid-stream
+	lagged bool  // set before chunks is closed if the receiver fell too far behind
+	failed bool  // set once run returns if the receiver did not get everything
+}
+
+// broadcast fans the sender's stream out to every receiver in r. Each receiver has its own
+// writer so one failing does not stop the others, and the sender is told how each is doing.
+func (s *Server) broadcast(r *room) {
+	defer s.activePipes.Done()
+	sender := r.sender
+	var statusMu sync.Mutex
+	report := func(st ReceiverStatus) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		sender.Write([]byte(st.String()))
+	}
+
+	outs := make([]*fanout, len(r.receivers))
+	var wg sync.WaitGroup
+	for i, conn := range r.receivers {
+		o := &fanout{index: i + 1, conn: conn, chunks: make(chan []byte, broadcastBacklog)}
+		outs[i] = o
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.run(report)
+		}()
+	}
+	// Slots nobody took by the time the room started count as failed
+	for i := len(outs) + 1; i <= r.maxReceivers; i++ {
+		report(ReceiverStatus{Receiver: i, Err: "receiver did not join"})
+	}
+	buf := make([]byte, 32*1024)
+	src := &countingReader{r: s.limitRoom(r, s.meterQuota(sender, ipOf(sender), r.relayed))}
+	var err error
+	for {
+		var n int
+		n, err = src.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			for _, o := range outs {
+				if o.lagged {
+					continue
+				}
+				select {
+				case o.chunks <- chunk:
+				default:
+					// Closing the connection also unblocks a write stuck on it
+					o.lagged = true
+					close(o.chunks)
+					o.conn.Close()
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, o := range outs {
+		if o.lagged {
+			continue
+		}
+		if err != io.EOF {
+			o.srcErr = err
+		}
+		close(o.chunks)
+	}
+	if err != io.EOF {
+		slog.Warn("Broadcast sender error", "code", r.code, "err", err)
+	}
+	wg.Wait()
+	outcome := OutcomeCompleted
+	if notice := endNotice(err); notice.Kind == NoticeQuota {
+		outcome = OutcomeQuota
+	} else if err != io.EOF && !hungUp(err) {
+		outcome = OutcomeDisconnected
+	}
+	for _, o := range outs {
+		if o.failed && outcome == OutcomeCompleted {
+			outcome = OutcomeDisconnected
+		}
+	}
+	s.mu.Lock()
+	rec := s.auditRecord(r, AuditBroadcast, outcome)
+	s.untrack(sender)
+	for _, o := range outs {
+		s.untrack(o.conn)
+	}
+	s.mu.Unlock()
+	rec.BytesUp = src.n
+	s.audit(rec)
+	s.unclaim(r.code)
+}
+
+func (o *fanout) run(report func(ReceiverStatus)) {
+	// The receiver hangs up once it has read everything, which is our completion signal
+	hungUp := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, o.conn)
+		close(hungUp)
+	}()
+	var sent int64
+	var werr error
+	lastReport := time.Now()
+	for chunk := range o.chunks {
+		if werr != nil {
+			continue // keep draining so the sender is not held up by a dead receiver
+		}
+		o.conn.SetWriteDeadline(time.Now().Add(broadcastWriteTimeout))
+		if _, werr = o.conn.Write(chunk); werr != nil {
+			continue
+		}
+		sent += int64(len(chunk))
+		if time.Since(lastReport) >= progressInterval {
+			report(ReceiverStatus{Receiver: o.index, Bytes: sent})
+			lastReport = time.Now()
+		}
+	}
+	o.failed = true
+	switch {
+	case o.lagged:
+		slog.Warn("Broadcast receiver dropped, it fell behind", "receiver", o.index)
+		report(ReceiverStatus{Receiver: o.index, Bytes: sent, Err: "receiver fell behind"})
+	case werr != nil:
+		slog.Warn("Broadcast receiver failed", "receiver", o.index, "err", werr)
+		report(ReceiverStatus{Receiver: o.index, Bytes: sent, Err: "connection lost"})
+	case o.srcErr != nil:
+		notice := endNotice(o.srcErr)
+		o.conn.Write([]byte(notice.String()))
+		reason := "sender disconnected"
+		if notice.Kind == NoticeQuota {
+			reason = o.srcErr.Error()
+		}
+		report(ReceiverStatus{Receiver: o.index, Bytes: sent, Err: reason})
+	default:
+		select {
+		case <-hungUp:
+			o.failed = false
+			report(ReceiverStatus{Receiver: o.index, Bytes: sent, Done: true})
+		case <-time.After(broadcastConfirmTimeout):
+			report(ReceiverStatus{Receiver: o.index, Bytes: sent, Err: "receiver did not confirm completion"})
+		}
+	}
+}
+
+// startBroadcastLocked starts fanning out the broadcast in r to the receivers that have joined.
+// The caller holds s.mu.
+func (s *Server) startBroadcastLocked(r *room) {
+	s.activePipes.Add(1)
+	go s.broadcast(r)
+	delete(s.rooms, r.code)
+	slog.Info("Broadcast room started", "code", r.code, "receivers", len(r.receivers), "expected", r.maxReceivers)
+}
+
+// startBroadcastAfter starts the broadcast in r after wait even if some receivers are missing,
+// so one that never turns up does not hold up the rest. It waits on while nobody has joined.
+func (s *Server) startBroadcastAfter(r *room, wait time.Duration) {
+	for {
+		select {
+		case <-s.clock.After(wait):
+		case <-s.stopped:
+			return
+		}
+		s.mu.Lock()
+		if s.rooms[r.code] != r {
+			// Started, abandoned or cleaned up meanwhile
+			s.mu.Unlock()
+			return
+		}
+		if r.sender != nil && len(r.receivers) > 0 {
+			s.startBroadcastLocked(r)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// probeTimeout bounds each health probe, so a dead relay costs little before the next is tried
+	probeTimeout = 2 * time.Second
+	// failoverDialTimeout gives up connecting to a relay of a list well before the OS would
+	failoverDialTimeout = 5 * time.Second
+	// defaultHealthPort is where relay-server serves its health check
+	defaultHealthPort = "8080"
+)
+
+// hintPrefix marks the relay hint at the end of a code, e.g. 5-kiwi-9-lion-r2
+const hintPrefix = "-r"
+
+// Endpoint is one relay of a client's list
+type Endpoint struct {
+	// URL is what Dial takes, e.g. relay.example.com:4000 or tcp://relay.example.com:4000
+	URL string
+	// Health is the relay's HTTP health check, e.g. http://relay.example.com:8080/. Empty
+	// skips the probe, the relay is then only tried by connecting to it.
+	Health string
+}
+
+// ParseRelayList parses a comma separated, ordered list of relays. Each entry is a relay URL
+// optionally followed by ?health=<url> naming its health check, e.g.
+// relay1:4000?health=http://relay1:9000/,relay2:4000. Without one the relay's host is probed on
+// port 8080, where relay-server serves it, and an empty ?health= skips the probe.
+func ParseRelayList(list string) ([]Endpoint, error) {
+	var eps []Endpoint
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		url, health, explicit := strings.Cut(entry, "?health=")
+		_, addr, err := ParseRelayURL(url)
+		if err != nil {
+			return nil, err
+		}
+		if !explicit {
+			health = defaultHealth(addr)
+		}
+		eps = append(eps, Endpoint{URL: url, Health: health})
+	}
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("invalid relay list %q", list)
+	}
+	return eps, nil
+}
+
+// defaultHealth returns the health check relay-server serves alongside the relay at addr
+func defaultHealth(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return "http://" + net.JoinHostPort(host, defaultHealthPort) + "/"
+}
+
+// Probe checks that the relay is up and not draining by asking its health check for a 200
+func (e Endpoint) Probe() error {
+	if e.Health == "" {
+		return nil
+	}
+	client := http.Client{Timeout: probeTimeout}
+	resp, err := client.Get(e.Health)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// dialTimeout connects like Dial, giving up on tcp relays after timeout
+func dialTimeout(url string, timeout time.Duration) (net.Conn, error) {
+	scheme, addr, err := ParseRelayURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "tcp" {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return Dial(url)
+}
+
+// DialFirst connects to the first relay of eps that passes its probe and accepts a connection,
+// returning the connection and the relay's index in eps
+func DialFirst(eps []Endpoint) (net.Conn, int, error) {
+	var errs []error
+	for i, ep := range eps {
+		if err := ep.Probe(); err != nil {
+			slog.Info("Relay is unavailable, trying the next", "relay", ep.URL, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", ep.URL, err))
+			continue
+		}
+		conn, err := dialTimeout(ep.URL, failoverDialTimeout)
+		if err != nil {
+			slog.Info("Relay is unavailable, trying the next", "relay", ep.URL, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", ep.URL, err))
+			continue
+		}
+		return conn, i, nil
+	}
+	return nil, -1, errors.Join(errs...)
+}
+
+// WithHint appends the index of the relay a code was issued on, so the other side joins the same
+// one. The first relay needs no hint, keeping codes from single relay setups unchanged.
+func WithHint(code string, index int) string {
+	if index <= 0 {
+		return code
+	}
+	return code + hintPrefix + strconv.Itoa(index+1)
+}
+
+// HintOf returns the index of the relay code was issued on, 0 if it carries no hint
+func HintOf(code string) int {
+	i := strings.LastIndex(code, hintPrefix)
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(code[i+len(hintPrefix):])
+	if err != nil || n < 2 {
+		return 0
+	}
+	return n - 1
+}
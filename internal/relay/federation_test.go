@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseRelayList(t *testing.T) {
+	for list, want := range map[string][]Endpoint{
+		"relay1:4000": {{URL: "relay1:4000", Health: "http://relay1:8080/"}},
+		" relay1:4000?health=http://relay1:9000/ , tls://relay2.example.com:443,": {
+			{URL: "relay1:4000", Health: "http://relay1:9000/"},
+			{URL: "tls://relay2.example.com:443", Health: "http://relay2.example.com:8080/"},
+		},
+		"relay1:4000?health=,[::1]:4000": {
+			{URL: "relay1:4000"},
+			{URL: "[::1]:4000", Health: "http://[::1]:8080/"},
+		},
+	} {
+		got, err := ParseRelayList(list)
+		if err != nil {
+			t.Fatalf("ParseRelayList(%q): %v", list, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ParseRelayList(%q) = %+v, want %+v", list, got, want)
+		}
+	}
+	for _, list := range []string{"", " , ", "tcp://", "relay1:4000,tls://"} {
+		if _, err := ParseRelayList(list); err == nil {
+			t.Fatalf("ParseRelayList(%q) accepted", list)
+		}
+	}
+}
+
+func TestHint(t *testing.T) {
+	code := "5-kiwi-9-lion"
+	if got := WithHint(code, 0); got != code {
+		t.Fatalf("WithHint for the first relay = %q, want the code unchanged", got)
+	}
+	for i := 0; i < 12; i++ {
+		if got := HintOf(WithHint(code, i)); got != i {
+			t.Fatalf("HintOf(WithHint(code, %d)) = %d", i, got)
+		}
+	}
+	if got := WithHint(code, 1); got != code+"-r2" {
+		t.Fatalf("WithHint(code, 1) = %q", got)
+	}
+	for _, c := range []string{code, code + "-r", code + "-r1", code + "-r0", code + "-rx", code + "-r-3"} {
+		if got := HintOf(c); got != 0 {
+			t.Fatalf("HintOf(%q) = %d, want 0", c, got)
+		}
+	}
+}
+
+func TestDialFirstSkipsUnhealthy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer draining.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	// A closed port, where nothing answers the probe
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	eps := []Endpoint{
+		{URL: ln.Addr().String(), Health: draining.URL},
+		{URL: ln.Addr().String(), Health: gone.URL},
+		{URL: ln.Addr().String(), Health: healthy.URL},
+	}
+	conn, i, err := DialFirst(eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if i != 2 {
+		t.Fatalf("DialFirst chose relay %d, want the healthy one", i)
+	}
+	if _, _, err := DialFirst(eps[:2]); err == nil {
+		t.Fatal("DialFirst connected with no healthy relay")
+	}
+}
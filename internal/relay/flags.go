@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Flags are the command line settings shared by every program that runs a relay, so
+// relay-server and "qshare relay" offer and parse them the same way
+type Flags struct {
+	MaxConns        int
+	MaxConnsPerIP   int
+	MaxReceivers    int
+	BroadcastWait   time.Duration
+	RoomBandwidth   string
+	GlobalBandwidth string
+	RoomQuota       string
+	IPQuota         string
+	GlobalQuota     string
+	TokenKeyFile    string
+}
+
+// Units parses the sizes and rates given in Flags and throttles to them. The transfer package
+// provides them, see transfer.RelayUnits, since it reads relay notices and so cannot be imported here.
+type Units struct {
+	ParseRate func(string) (int64, error)
+	ParseSize func(string) (int64, error)
+	// Throttle caps everything the returned Throttle wraps together at rate bytes per second
+	Throttle func(rate int64) Throttle
+}
+
+// Register defines the flags on fs
+func (f *Flags) Register(fs *flag.FlagSet) {
+	fs.IntVar(&f.MaxConns, "max-conns", 1000, "Maximum number of open client connections")
+	fs.IntVar(&f.MaxConnsPerIP, "max-conns-per-ip", 20, "Maximum number of open connections from one IP")
+	fs.IntVar(&f.MaxReceivers, "max-receivers", 32, "Most receivers one broadcast may ask for")
+	fs.DurationVar(&f.BroadcastWait, "broadcast-wait", 5*time.Minute, "How long a broadcast waits for all its receivers before starting with those that joined")
+	fs.StringVar(&f.RoomBandwidth, "room-bandwidth", "", "Bandwidth cap per transfer, e.g. 10MB/s (empty for no cap)")
+	fs.StringVar(&f.GlobalBandwidth, "global-bandwidth", "", "Bandwidth cap for the whole relay, e.g. 100MB/s (empty for no cap)")
+	fs.StringVar(&f.RoomQuota, "room-quota", "", "Most bytes one transfer may relay, e.g. 10GB (empty for no quota)")
+	fs.StringVar(&f.IPQuota, "ip-quota", "", "Bytes one IP may relay per UTC day, e.g. 50GB (empty for no quota)")
+	fs.StringVar(&f.GlobalQuota, "global-quota", "", "Bytes the whole relay may carry per UTC day, e.g. 1TB (empty for no quota)")
+	fs.StringVar(&f.TokenKeyFile, "token-key-file", "", "File holding the hex issuer key; clients then need a token signed with it (empty leaves the relay open)")
+}
+
+// Apply parses the flags into cfg
+func (f *Flags) Apply(cfg *Config, u Units) error {
+	cfg.MaxConns, cfg.MaxConnsPerIP = f.MaxConns, f.MaxConnsPerIP
+	cfg.MaxReceivers, cfg.BroadcastWait = f.MaxReceivers, f.BroadcastWait
+	roomRate, err := u.ParseRate(f.RoomBandwidth)
+	if err != nil {
+		return fmt.Errorf("invalid --room-bandwidth: %w", err)
+	}
+	if roomRate > 0 {
+		// Both directions of a room share its cap
+		cfg.RoomThrottle = func() Throttle { return u.Throttle(roomRate) }
+	}
+	rate, err := u.ParseRate(f.GlobalBandwidth)
+	if err != nil {
+		return fmt.Errorf("invalid --global-bandwidth: %w", err)
+	}
+	if rate > 0 {
+		cfg.Throttle = u.Throttle(rate)
+	}
+	for _, q := range []struct {
+		name  string
+		value string
+		dst   *int64
+	}{{"room-quota", f.RoomQuota, &cfg.RoomQuota}, {"ip-quota", f.IPQuota, &cfg.IPQuota}, {"global-quota", f.GlobalQuota, &cfg.GlobalQuota}} {
+		if *q.dst, err = u.ParseSize(q.value); err != nil {
+			return fmt.Errorf("invalid --%s: %w", q.name, err)
+		}
+	}
+	if f.TokenKeyFile != "" {
+		if cfg.TokenKey, err = ReadKeyFile(f.TokenKeyFile); err != nil {
+			return fmt.Errorf("invalid --token-key-file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testUnits parses plain numbers and records the rates it throttles to
+func testUnits(rates *[]int64) Units {
+	parse := func(s string) (int64, error) {
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, errors.New("not a number")
+		}
+		return n, nil
+	}
+	return Units{
+		ParseRate: parse,
+		ParseSize: parse,
+		Throttle: func(rate int64) Throttle {
+			*rates = append(*rates, rate)
+			return func(r io.Reader) io.Reader { return r }
+		},
+	}
+}
+
+func TestFlagsApply(t *testing.T) {
+	var f Flags
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	f.Register(fs)
+	err := fs.Parse([]string{"-max-conns", "50", "-max-receivers", "4", "-room-bandwidth", "100", "-global-bandwidth", "1000", "-room-quota", "7", "-global-quota", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rates []int64
+	var cfg Config
+	if err := f.Apply(&cfg, testUnits(&rates)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxConns != 50 || cfg.MaxConnsPerIP != 20 {
+		t.Fatalf("MaxConns, MaxConnsPerIP = %d, %d, want 50, 20", cfg.MaxConns, cfg.MaxConnsPerIP)
+	}
+	if cfg.MaxReceivers != 4 || cfg.BroadcastWait != 5*time.Minute {
+		t.Fatalf("MaxReceivers, BroadcastWait = %d, %v, want 4, 5m", cfg.MaxReceivers, cfg.BroadcastWait)
+	}
+	if cfg.RoomQuota != 7 || cfg.IPQuota != 0 || cfg.GlobalQuota != 9 {
+		t.Fatalf("quotas = %d, %d, %d, want 7, 0, 9", cfg.RoomQuota, cfg.IPQuota, cfg.GlobalQuota)
+	}
+	if cfg.Throttle == nil || cfg.RoomThrottle == nil {
+		t.Fatal("bandwidth caps not applied")
+	}
+	// Every room gets a throttle of its own
+	cfg.RoomThrottle()
+	cfg.RoomThrottle()
+	if len(rates) != 3 || rates[0] != 1000 || rates[1] != 100 || rates[2] != 100 {
+		t.Fatalf("throttled to %v, want the global cap then one room cap per room", rates)
+	}
+}
+
+func TestFlagsApplyRejectsBadValues(t *testing.T) {
+	for _, f := range []Flags{
+		{RoomBandwidth: "fast"},
+		{GlobalBandwidth: "fast"},
+		{IPQuota: "lots"},
+		{TokenKeyFile: "/nonexistent/key"},
+	} {
+		var rates []int64
+		if err := f.Apply(&Config{}, testUnits(&rates)); err == nil {
+			t.Errorf("Apply(%+v) succeeded", f)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMailboxNotFound = errors.New("no stored transfer for this code")
+	ErrMailboxQuota    = errors.New("mailbox quota exceeded")
+	ErrMailboxTaken    = errors.New("a transfer is already stored for this code")
+)
+
+// Mailbox stores already-encrypted streams so the receiver can fetch them after the sender has gone.
+// The relay never sees plaintext, it only keeps the bytes the sender would have piped.
+type Mailbox interface {
+	// Put stores everything read from r under code and returns when it expires. It fails with
+	// ErrMailboxTaken while an earlier upload for code has not expired.
+	Put(code string, r io.Reader, ttl time.Duration) (time.Time, error)
+	// Get opens the stored stream for code, or returns ErrMailboxNotFound
+	Get(code string) (io.ReadCloser, error)
+	// Delete removes the stored stream for code
+	Delete(code string) error
+	// Expire removes every entry whose TTL has passed
+	Expire(now time.Time) error
+}
+
+// DiskMailbox is a Mailbox storing each entry as a data file and a JSON metadata file in Dir.
+// File names are hashes of the code, so codes never appear on disk.
+type DiskMailbox struct {
+	Dir           string
+	MaxItemBytes  int64         // largest single upload, 0 for no limit
+	MaxTotalBytes int64         // total bytes stored at once, 0 for no limit
+	MaxTTL        time.Duration // longest TTL a sender may ask for, 0 for no limit
+
+	mu       sync.Mutex
+	used     int64
+	reserved int64
+}
+
+type mailboxMeta struct {
+	Expires time.Time `json:"expires"`
+	Size    int64     `json:"size"`
+}
+
+// NewDiskMailbox creates dir if needed and returns a mailbox stored in it
+func NewDiskMailbox(dir string) (*DiskMailbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating mailbox dir: %w", err)
+	}
+	m := &DiskMailbox{Dir: dir}
+	m.used = m.scanUsed()
+	return m, nil
+}
+
+func (m *DiskMailbox) path(code, ext string) string {
+	sum := sha256.Sum256([]byte(code))
+	return filepath.Join(m.Dir, hex.EncodeToString(sum[:])+ext)
+}
+
+func (m *DiskMailbox) Put(code string, r io.Reader, ttl time.Duration) (time.Time, error) {
+	if m.MaxTTL > 0 && ttl > m.MaxTTL {
+		ttl = m.MaxTTL
+	}
+	// Fail before reading the upload, and check again below in case another one finished first
+	m.mu.Lock()
+	live := m.liveLocked(code)
+	m.mu.Unlock()
+	if live {
+		return time.Time{}, ErrMailboxTaken
+	}
+	limit, err := m.reserve()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer m.unreserve(limit)
+
+	tmp, err := os.CreateTemp(m.Dir, "upload-*")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error creating mailbox file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	src := r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error storing upload: %w", err)
+	}
+	if limit > 0 && n > limit {
+		return time.Time{}, ErrMailboxQuota
+	}
+
+	expires := time.Now().Add(ttl)
+	meta, _ := json.Marshal(mailboxMeta{Expires: expires, Size: n})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.liveLocked(code) {
+		return time.Time{}, ErrMailboxTaken
+	}
+	// Whatever is left has expired and can go
+	m.deleteLocked(code)
+	if err := os.WriteFile(m.path(code, ".meta"), meta, 0600); err != nil {
+		return time.Time{}, fmt.Errorf("error writing mailbox metadata: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path(code, ".data")); err != nil {
+		os.Remove(m.path(code, ".meta"))
+		return time.Time{}, fmt.Errorf("error storing upload: %w", err)
+	}
+	m.used += n
+	return expires, nil
+}
+
+func (m *DiskMailbox) Get(code string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err := readMailboxMeta(m.path(code, ".meta"))
+	if err != nil || time.Now().After(meta.Expires) {
+		return nil, ErrMailboxNotFound
+	}
+	f, err := os.Open(m.path(code, ".data"))
+	if err != nil {
+		return nil, ErrMailboxNotFound
+	}
+	return f, nil
+}
+
+func (m *DiskMailbox) Delete(code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(code)
+	return nil
+}
+
+// liveLocked reports whether an unexpired entry is stored for code
+func (m *DiskMailbox) liveLocked(code string) bool {
+	meta, err := readMailboxMeta(m.path(code, ".meta"))
+	return err == nil && !time.Now().After(meta.Expires)
+}
+
+func (m *DiskMailbox) deleteLocked(code string) {
+	if meta, err := readMailboxMeta(m.path(code, ".meta")); err == nil {
+		m.used -= meta.Size
+	}
+	os.Remove(m.path(code, ".meta"))
+	os.Remove(m.path(code, ".data"))
+}
+
+func (m *DiskMailbox) Expire(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metas, err := filepath.Glob(filepath.Join(m.Dir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	for _, p := range metas {
+		meta, err := readMailboxMeta(p)
+		if err == nil && now.Before(meta.Expires) {
+			continue
+		}
+		m.used -= meta.Size
+		os.Remove(p)
+		os.Remove(strings.TrimSuffix(p, ".meta") + ".data")
+	}
+	return nil
+}
+
+// reserve returns how many bytes the next upload may use (0 for unlimited) and holds them
+// until unreserve, so concurrent uploads cannot overshoot the total quota together.
+func (m *DiskMailbox) reserve() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit := m.MaxItemBytes
+	if m.MaxTotalBytes > 0 {
+		free := m.MaxTotalBytes - m.used - m.reserved
+		if free <= 0 {
+			return 0, ErrMailboxQuota
+		}
+		if limit == 0 || free < limit {
+			limit = free
+		}
+	}
+	m.reserved += limit
+	return limit, nil
+}
+
+func (m *DiskMailbox) unreserve(n int64) {
+	m.mu.Lock()
+	m.reserved -= n
+	m.mu.Unlock()
+}
+
+func (m *DiskMailbox) scanUsed() int64 {
+	var used int64
+	metas, _ := filepath.Glob(filepath.Join(m.Dir, "*.meta"))
+	for _, p := range metas {
+		if meta, err := readMailboxMeta(p); err == nil {
+			used += meta.Size
+		}
+	}
+	return used
+}
+
+func readMailboxMeta(path string) (mailboxMeta, error) {
+	var meta mailboxMeta
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// storeUpload reads the sender's encrypted stream until it half-closes the connection
+// and stores it under code, then confirms with the expiry time.
+func (s *Server) storeUpload(conn net.Conn, code, ttlStr string) {
+	secs, err := strconv.Atoi(ttlStr)
+	if err != nil || secs <= 0 {
+		reject(conn, "invalid mailbox ttl")
+		return
+	}
+	s.activePipes.Add(1)
+	defer s.activePipes.Done()
+	slog.Info("Mailbox upload started", "code", code, "remote", conn.RemoteAddr(), "ttl_s", secs)
+	start := s.clock.Now()
+	src := &countingReader{r: s.meterQuota(conn, ipOf(conn), new(atomic.Int64))}
+	rec := AuditRecord{Event: AuditMailboxUpload, Code: s.auditCode(code), Outcome: OutcomeCompleted, SenderIP: ipOf(conn), SenderJoined: start.UTC()}
+	defer func() {
+		rec.BytesUp, rec.DurationMS = src.n, s.clock.Now().Sub(start).Milliseconds()
+		s.audit(rec)
+	}()
+	expires, err := s.cfg.Mailbox.Put(code, s.limitGlobal(src), time.Duration(secs)*time.Second)
+	if err != nil {
+		slog.Warn("Mailbox upload failed", "code", code, "err", err)
+		reject(conn, err.Error())
+		rec.Outcome, rec.Reason = OutcomeDisconnected, err.Error()
+		if endNotice(err).Kind == NoticeQuota {
+			rec.Outcome = OutcomeQuota
+		}
+		// The claim still points receivers at the upload that was there first
+		if !errors.Is(err, ErrMailboxTaken) {
+			s.unclaim(code)
+		}
+		return
+	}
+	// The upload stays on this node, so the receiver must be sent here until it expires
+	s.claim(code, expires.Sub(s.clock.Now()))
+	slog.Info("Mailbox upload stored", "code", code, "expires", expires)
+	fmt.Fprintf(conn, "%s %d\n", ReplyStored, expires.Unix())
+}
+
+// openMailbox opens the stored upload for code, or returns nil if nothing is stored
+func (s *Server) openMailbox(code string) io.ReadCloser {
+	if s.cfg.Mailbox == nil {
+		return nil
+	}
+	stored, err := s.cfg.Mailbox.Get(code)
+	if err != nil {
+		return nil
+	}
+	return stored
+}
+
+// serveMailbox sends the stored upload for code to the receiver and closes it. The entry is
+// deleted once the receiver acknowledges it, otherwise it stays until it expires.
+func (s *Server) serveMailbox(conn net.Conn, code string, stored io.ReadCloser) {
+	defer stored.Close()
+	s.activePipes.Add(1)
+	defer s.activePipes.Done()
+	slog.Info("Mailbox download started", "code", code, "remote", conn.RemoteAddr())
+	start := s.clock.Now()
+	rec := AuditRecord{Event: AuditMailboxDownload, Code: s.auditCode(code), Outcome: OutcomeCompleted, ReceiverIPs: []string{ipOf(conn)}, ReceiverJoined: start.UTC()}
+	defer func() {
+		rec.DurationMS = s.clock.Now().Sub(start).Milliseconds()
+		s.audit(rec)
+	}()
+	n, err := io.Copy(conn, s.limitGlobal(stored))
+	rec.BytesUp = n
+	if err != nil {
+		slog.Warn("Mailbox download failed", "code", code, "err", err)
+		rec.Outcome, rec.Reason = OutcomeDisconnected, err.Error()
+		return
+	}
+	// The receiver answers once it has verified the file. Hanging up or anything else means it
+	// did not get it, so the entry stays for another try until its TTL runs out.
+	conn.SetReadDeadline(time.Now().Add(s.cfg.MailboxAckTimeout))
+	line, err := ReadLine(conn)
+	if err != nil || strings.TrimRight(line, "\r\n") != ReplyAck {
+		slog.Info("Mailbox download not acknowledged, entry kept", "code", code)
+		rec.Outcome, rec.Reason = OutcomeDisconnected, "receiver did not acknowledge the download"
+		return
+	}
+	s.cfg.Mailbox.Delete(code)
+	s.unclaim(code)
+	slog.Info("Mailbox download completed, entry deleted", "code", code)
+}
@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskMailboxQuotas(t *testing.T) {
+	m, err := NewDiskMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MaxItemBytes, m.MaxTotalBytes, m.MaxTTL = 8, 12, time.Hour
+	if _, err := m.Put("big", strings.NewReader("123456789"), time.Minute); !errors.Is(err, ErrMailboxQuota) {
+		t.Fatalf("Put over the item limit = %v, want ErrMailboxQuota", err)
+	}
+	expires, err := m.Put("a", strings.NewReader("12345678"), 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expires) > time.Hour {
+		t.Fatalf("expiry %v is past MaxTTL", expires)
+	}
+	// Only 4 bytes of the total are left
+	if _, err := m.Put("b", strings.NewReader("12345"), time.Minute); !errors.Is(err, ErrMailboxQuota) {
+		t.Fatalf("Put over the total limit = %v, want ErrMailboxQuota", err)
+	}
+	if _, err := m.Put("b", strings.NewReader("1234"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	r, err := m.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "12345678" {
+		t.Fatalf("Get = %q", data)
+	}
+	// Deleting and expiring entries frees their space
+	m.Delete("a")
+	if _, err := m.Get("a"); !errors.Is(err, ErrMailboxNotFound) {
+		t.Fatalf("Get after Delete = %v, want ErrMailboxNotFound", err)
+	}
+	m.Expire(time.Now().Add(2 * time.Minute))
+	if _, err := m.Get("b"); !errors.Is(err, ErrMailboxNotFound) {
+		t.Fatalf("Get after Expire = %v, want ErrMailboxNotFound", err)
+	}
+	if m.used != 0 {
+		t.Fatalf("%d bytes still counted as used", m.used)
+	}
+}
+
+// upload stores payload on the relay at addr under code
+func upload(t *testing.T, addr, code, payload string) {
+	t.Helper()
+	conn := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptMailbox: "60"}})
+	if _, err := io.WriteString(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadStoredReply(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// download fetches payload back from the mailbox on the relay at addr
+func download(t *testing.T, addr, code, payload string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	limits, err := ClientHandshake(conn, Handshake{Code: code, Role: "receiver"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limits.Mailbox {
+		t.Fatal("relay did not announce a mailbox download")
+	}
+	got := make([]byte, len(payload))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != payload {
+		t.Fatalf("downloaded %q, %v", got, err)
+	}
+	return conn
+}
+
+func TestMailboxDeletedOnlyAfterAck(t *testing.T) {
+	mailbox, err := NewDiskMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.Mailbox = mailbox
+	_, addr := startServer(t, cfg)
+	code := "9-lime-1-otter"
+	upload(t, addr, code, "sealed bytes")
+
+	// A receiver that hangs up without acknowledging leaves the entry for another try
+	download(t, addr, code, "sealed bytes").Close()
+	conn := download(t, addr, code, "sealed bytes")
+	if err := AckDownload(conn); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, err := mailbox.Get(code)
+		if errors.Is(err, ErrMailboxNotFound) {
+			break
+		}
+		if err == nil {
+			r.Close()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry not deleted after the receiver acknowledged it")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimitsCarryMailboxFlag(t *testing.T) {
+	l := Limits{Room: 10, Mailbox: true}
+	if got := parseLimits(l.String()); got != l {
+		t.Fatalf("parseLimits(%q) = %+v, want %+v", l.String(), got, l)
+	}
+	if got := parseLimits("room=10 future=yes"); got != (Limits{Room: 10}) {
+		t.Fatalf("unknown fields not skipped: %+v", got)
+	}
+}
+
+func TestDiskMailboxKeepsUnexpiredEntry(t *testing.T) {
+	m, err := NewDiskMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Put("a", strings.NewReader("first"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Put("a", strings.NewReader("second"), time.Minute); !errors.Is(err, ErrMailboxTaken) {
+		t.Fatalf("Put over a live entry = %v, want ErrMailboxTaken", err)
+	}
+	r, err := m.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "first" {
+		t.Fatalf("Get = %q, want the first upload", data)
+	}
+	// Once the entry has expired the code is free again
+	if _, err := m.Put("b", strings.NewReader("old"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Put("b", strings.NewReader("new"), time.Minute); err != nil {
+		t.Fatalf("Put over an expired entry = %v", err)
+	}
+	if m.used != int64(len("first")+len("new")) {
+		t.Fatalf("%d bytes counted as used", m.used)
+	}
+}
+
+func TestMailboxRejectsSecondUpload(t *testing.T) {
+	mailbox, err := NewDiskMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.Mailbox = mailbox
+	_, addr := startServer(t, cfg)
+	code := "4-pear-8-heron"
+	upload(t, addr, code, "sealed bytes")
+
+	conn := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Options: map[string]string{OptMailbox: "60"}})
+	io.WriteString(conn, "other bytes")
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadStoredReply(conn); err == nil || !strings.Contains(err.Error(), ErrMailboxTaken.Error()) {
+		t.Fatalf("second upload = %v, want it rejected", err)
+	}
+	download(t, addr, code, "sealed bytes")
+}
+
+func TestMailboxAckTimesOut(t *testing.T) {
+	mailbox, err := NewDiskMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.Mailbox, cfg.MailboxAckTimeout = mailbox, 50*time.Millisecond
+	_, addr := startServer(t, cfg)
+	code := "6-fig-3-crane"
+	upload(t, addr, code, "sealed bytes")
+
+	// A receiver that never answers is hung up on, and the entry stays
+	conn := download(t, addr, code, "sealed bytes")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the ack timeout = %v, want EOF", err)
+	}
+	r, err := mailbox.Get(code)
+	if err != nil {
+		t.Fatalf("entry gone after an unacknowledged download: %v", err)
+	}
+	r.Close()
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notice kinds the relay writes to a client outside of the encrypted stream
+const (
+	NoticeDisconnect = "DISCONNECT"
+	NoticeGoAway     = "GOAWAY"
+	NoticeRoomFull   = "ROOMFULL"
+	// NoticeQuota ends a transfer that ran out of a byte quota: QUOTA <scope> <limit>
+	NoticeQuota = "QUOTA"
+)
+
+var noticeKinds = []string{NoticeDisconnect, NoticeGoAway, NoticeRoomFull, NoticeQuota}
+
+// Byte quota scopes, see NoticeQuota
+const (
+	QuotaRoom   = "room"
+	QuotaIP     = "ip"
+	QuotaGlobal = "global"
+)
+
+// QuotaNotice returns the notice for the quota of scope running out at limit bytes
+func QuotaNotice(scope string, limit int64) Notice {
+	return Notice{Kind: NoticeQuota, Reason: scope + " " + strconv.FormatInt(limit, 10)}
+}
+
+// Quota returns the scope and limit of a QUOTA notice, or false for other notices
+func (n Notice) Quota() (scope string, limit int64, ok bool) {
+	if n.Kind != NoticeQuota {
+		return "", 0, false
+	}
+	scope, rest, _ := strings.Cut(n.Reason, " ")
+	limit, err := strconv.ParseInt(rest, 10, 64)
+	return scope, limit, err == nil
+}
+
+// Notice is a single line control message from the relay, e.g. "GOAWAY relay is shutting down\n"
+type Notice struct {
+	Kind   string
+	Reason string
+}
+
+// String returns the wire form of the notice, including the trailing newline
+func (n Notice) String() string {
+	if n.Reason == "" {
+		return n.Kind + "\n"
+	}
+	return n.Kind + " " + n.Reason + "\n"
+}
+
+// NoticeError is returned by clients when the relay interrupted a transfer with a notice
+type NoticeError struct {
+	Notice Notice
+}
+
+func (e *NoticeError) Error() string {
+	switch e.Notice.Kind {
+	case NoticeDisconnect:
+		return "peer disconnected"
+	case NoticeGoAway:
+		if e.Notice.Reason != "" {
+			return "relay going away: " + e.Notice.Reason
+		}
+		return "relay going away"
+	case NoticeRoomFull:
+		return "all receiver slots for this code are taken"
+	case NoticeQuota:
+		scope, limit, ok := e.Notice.Quota()
+		if !ok {
+			return "relay quota exceeded"
+		}
+		switch scope {
+		case QuotaRoom:
+			return fmt.Sprintf("relay quota exceeded: a transfer may relay at most %d bytes", limit)
+		case QuotaIP:
+			return fmt.Sprintf("relay quota exceeded: your address may relay at most %d bytes a day", limit)
+		case QuotaGlobal:
+			return "relay quota exceeded: the relay has used up its daily bandwidth"
+		}
+		return fmt.Sprintf("relay %s quota of %d bytes exceeded", scope, limit)
+	}
+	return fmt.Sprintf("relay notice %s: %s", e.Notice.Kind, e.Notice.Reason)
+}
+
+// ParseNotice parses a notice line. Returns false if the line is not a known notice.
+func ParseNotice(line string) (Notice, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	kind, reason, _ := strings.Cut(line, " ")
+	for _, k := range noticeKinds {
+		if kind == k {
+			return Notice{Kind: kind, Reason: reason}, true
+		}
+	}
+	return Notice{}, false
+}
+
+// IsNoticePrefix reports whether b could be the start of a notice line.
+// Used by readers of the binary stream to tell a relay notice apart from framed data.
+func IsNoticePrefix(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, k := range noticeKinds {
+		n := min(len(b), len(k))
+		if string(b[:n]) == k[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// TrailingNotice finds a notice at the very end of b. The relay may cut a stream mid-frame,
+// write a notice and hang up, leaving the notice as the tail of a truncated frame.
+func TrailingNotice(b []byte) (Notice, bool) {
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		return Notice{}, false
+	}
+	for _, k := range noticeKinds {
+		if i := bytes.LastIndex(b, []byte(k)); i >= 0 {
+			if n, ok := ParseNotice(string(b[i:])); ok && !strings.Contains(n.Reason, "\n") {
+				return n, true
+			}
+		}
+	}
+	return Notice{}, false
+}
+
+// ReadNotice reads the rest of a notice line that started with prefix and returns it as an error
+func ReadNotice(r io.Reader, prefix []byte) error {
+	line := string(prefix)
+	if !strings.HasSuffix(line, "\n") {
+		rest, _ := ReadLine(r)
+		line += rest
+	}
+	n, ok := ParseNotice(line)
+	if !ok {
+		return fmt.Errorf("unexpected data from relay: %q", line)
+	}
+	return &NoticeError{Notice: n}
+}
+
+// CheckNotice waits briefly for a notice on conn, used after a failed write to explain why
+// the relay dropped the connection. Returns nil if no notice arrives.
+func CheckNotice(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	prefix := make([]byte, 1)
+	if _, err := io.ReadFull(conn, prefix); err != nil || !IsNoticePrefix(prefix) {
+		return nil
+	}
+	if err := ReadNotice(conn, prefix); err != nil {
+		if _, ok := err.(*NoticeError); ok {
+			return err
+		}
+	}
+	return nil
+}
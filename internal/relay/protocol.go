@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineLen bounds handshake and reply lines so a client cannot make the relay buffer forever
+const maxLineLen = 512
+
+// Handshake is the first line a client sends: code:role[:option...]\n
+// Options are either flags (retry) or key=value pairs.
+type Handshake struct {
+	Code    string
+	Role    string
+	Retry   bool
+	Options map[string]string
+}
+
+// String returns the wire form of the handshake, including the trailing newline
+func (h Handshake) String() string {
+	parts := []string{h.Code, h.Role}
+	if h.Retry {
+		parts = append(parts, "retry")
+	}
+	for k, v := range h.Options {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ":") + "\n"
+}
+
+// ParseHandshake parses a handshake line (e.g 5-sku-transfer:sender:retry)
+func ParseHandshake(line string) (Handshake, error) {
+	parts := strings.Split(strings.TrimRight(line, "\r\n"), ":")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return Handshake{}, fmt.Errorf("invalid handshake: %q", line)
+	}
+	h := Handshake{Code: parts[0], Role: parts[1], Options: map[string]string{}}
+	for _, opt := range parts[2:] {
+		if opt == "retry" {
+			h.Retry = true
+			continue
+		}
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok || k == "" {
+			return Handshake{}, fmt.Errorf("invalid handshake option: %q", opt)
+		}
+		h.Options[k] = v
+	}
+	return h, nil
+}
+
+// ReadLine reads a single line from r one byte at a time, so nothing after the newline is consumed
+func ReadLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxLineLen {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return string(line), err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+	}
+	return string(line), fmt.Errorf("line too long")
+}
+
+// Handshake option keys
+const (
+	// OptMailbox asks the relay to store the sender's stream for the given number of seconds
+	OptMailbox = "mailbox"
+	// OptReceivers makes the sender's room a broadcast room for this many receivers
+	OptReceivers = "receivers"
+	// OptConn marks extra connection n of a parallel transfer already running under the code
+	OptConn = "conn"
+	// OptToken carries the client's auth token, for relays that require one
+	OptToken = "token"
+)
+
+// Reply lines the relay sends after reading a handshake
+const (
+	ReplyOK  = "OK"
+	ReplyErr = "ERR"
+	// ReplyStored confirms a mailbox upload: STORED <unix expiry>
+	ReplyStored = "STORED"
+	// ReplyAck is sent back by the receiver of a mailbox download once it has verified the
+	// file. The relay deletes the entry only then, otherwise it is kept until it expires.
+	ReplyAck = "ACK"
+)
+
+// Limits are the byte quotas that apply to a connection, sent with the relay's OK as
+// "OK room=<bytes> ip=<bytes> global=<bytes>". Each is what is left of that quota, 0 if the
+// relay sets none.
+type Limits struct {
+	Room   int64
+	IP     int64
+	Global int64
+	// Mailbox is set when the relay is about to play back a stored upload, sent as mailbox=1
+	Mailbox bool
+}
+
+// String returns the limits as reply fields, empty if there are none
+func (l Limits) String() string {
+	var parts []string
+	for _, f := range []struct {
+		key string
+		v   int64
+	}{{QuotaRoom, l.Room}, {QuotaIP, l.IP}, {QuotaGlobal, l.Global}} {
+		if f.v > 0 {
+			parts = append(parts, f.key+"="+strconv.FormatInt(f.v, 10))
+		}
+	}
+	if l.Mailbox {
+		parts = append(parts, OptMailbox+"=1")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Max returns the most bytes the relay will carry for the connection, 0 for no limit
+func (l Limits) Max() int64 {
+	var m int64
+	for _, v := range []int64{l.Room, l.IP, l.Global} {
+		if v > 0 && (m == 0 || v < m) {
+			m = v
+		}
+	}
+	return m
+}
+
+// parseLimits reads the fields after OK. Unknown fields are skipped, so relays can add more.
+func parseLimits(fields string) Limits {
+	var l Limits
+	for _, f := range strings.Fields(fields) {
+		k, v, _ := strings.Cut(f, "=")
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch k {
+		case QuotaRoom:
+			l.Room = n
+		case QuotaIP:
+			l.IP = n
+		case QuotaGlobal:
+			l.Global = n
+		case OptMailbox:
+			l.Mailbox = n == 1
+		}
+	}
+	return l
+}
+
+// ClientHandshake sends h on conn and waits for the relay to accept it, returning the limits
+// the relay announced. A rejection is returned as an error carrying the relay's reason.
+func ClientHandshake(conn io.ReadWriter, h Handshake) (Limits, error) {
+	if _, err := io.WriteString(conn, h.String()); err != nil {
+		return Limits{}, fmt.Errorf("error sending handshake: %w", err)
+	}
+	line, err := ReadLine(conn)
+	if err != nil {
+		return Limits{}, fmt.Errorf("error reading handshake reply: %w", err)
+	}
+	if n, ok := ParseNotice(line); ok {
+		return Limits{}, &NoticeError{Notice: n}
+	}
+	status, reason, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	switch status {
+	case ReplyOK:
+		return parseLimits(reason), nil
+	case ReplyErr:
+		return Limits{}, fmt.Errorf("relay rejected connection: %s", reason)
+	}
+	return Limits{}, fmt.Errorf("unexpected handshake reply: %q", line)
+}
+
+// ReadStoredReply waits for the relay to confirm a mailbox upload and returns when it expires
+func ReadStoredReply(r io.Reader) (time.Time, error) {
+	line, err := ReadLine(r)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading upload confirmation: %w", err)
+	}
+	status, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	switch status {
+	case ReplyStored:
+		unix, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid upload confirmation: %q", line)
+		}
+		return time.Unix(unix, 0), nil
+	case ReplyErr:
+		return time.Time{}, fmt.Errorf("relay could not store upload: %s", rest)
+	}
+	return time.Time{}, fmt.Errorf("unexpected upload reply: %q", line)
+}
+
+// AckDownload tells the relay a mailbox download was received and verified, so it can delete it
+func AckDownload(w io.Writer) error {
+	if _, err := io.WriteString(w, ReplyAck+"\n"); err != nil {
+		return fmt.Errorf("error acknowledging download: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// quicALPN is the application protocol relays and clients agree on during the TLS handshake
+	quicALPN = "qshare"
+	// quicDialTimeout bounds the QUIC and TLS handshake with a relay
+	quicDialTimeout = 10 * time.Second
+	// quicStreamTimeout is how long a new QUIC connection has to open its stream
+	quicStreamTimeout = 10 * time.Second
+	// quicLinger is how long a closed connection waits for its last writes, e.g. a notice, to be
+	// read before it is torn down
+	quicLinger = 2 * time.Second
+	// routeCheckInterval is how often a client looks for a new local route to the relay
+	routeCheckInterval = 2 * time.Second
+	// migrateTimeout bounds probing a new path before switching to it
+	migrateTimeout = 5 * time.Second
+)
+
+// QUICTransport gives each client connection its own QUIC connection carrying a single
+// bidirectional stream. Clients follow changes of their local route to the relay, e.g. from
+// wifi to cellular, by migrating the QUIC connection, so a transfer survives them.
+type QUICTransport struct {
+	// TLS verifies relays when dialing, nil for the system CAs. Listening needs one with a certificate.
+	TLS *tls.Config
+	// Config tunes QUIC, nil for defaults that keep idle connections alive
+	Config *quic.Config
+}
+
+func (t QUICTransport) tlsConfig(serverName string) *tls.Config {
+	var conf *tls.Config
+	if t.TLS != nil {
+		conf = t.TLS.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+	conf.NextProtos = []string{quicALPN}
+	if conf.ServerName == "" {
+		conf.ServerName = serverName
+	}
+	return conf
+}
+
+func (t QUICTransport) quicConfig() *quic.Config {
+	if t.Config != nil {
+		return t.Config
+	}
+	// Peers may wait a long time for each other without sending anything
+	return &quic.Config{KeepAlivePeriod: 15 * time.Second, MaxIncomingStreams: 1}
+}
+
+func (t QUICTransport) Dial(addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %q: %w", addr, err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", addr, err)
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening UDP socket: %w", err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	conn, err := tr.Dial(ctx, raddr, t.tlsConfig(host), t.quicConfig())
+	if err != nil {
+		tr.Close()
+		udp.Close()
+		return nil, fmt.Errorf("error dialing %s: %w", addr, err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		tr.Close()
+		udp.Close()
+		return nil, fmt.Errorf("error opening stream to %s: %w", addr, err)
+	}
+	c := &quicConn{Stream: stream, conn: conn, sockets: []*quic.Transport{tr}}
+	c.route, _ = routeTo(raddr)
+	go c.followRoute(raddr)
+	return c, nil
+}
+
+func (t QUICTransport) Listen(addr string) (net.Listener, error) {
+	if t.TLS == nil || (len(t.TLS.Certificates) == 0 && t.TLS.GetCertificate == nil) {
+		return nil, errors.New("listening on quic:// needs a TLS certificate")
+	}
+	ln, err := quic.ListenAddr(addr, t.tlsConfig(""), t.quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{ln: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// quicListener hands out the first stream of every QUIC connection as a net.Conn
+type quicListener struct {
+	ln    *quic.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *quicListener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		// Waiting for the stream happens per connection so a slow client never stalls the others
+		go l.acceptStream(conn)
+	}
+}
+
+func (l *quicListener) acceptStream(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicStreamTimeout)
+	defer cancel()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "no stream opened")
+		return
+	}
+	select {
+	case l.conns <- &quicConn{Stream: stream, conn: conn}:
+	case <-l.done:
+		conn.CloseWithError(0, "relay is shutting down")
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicConn is one QUIC stream used as a net.Conn. Closing it closes its QUIC connection.
+type quicConn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	closeOnce sync.Once
+
+	// Client side only: the sockets the connection has used and the local address of its route
+	mu      sync.Mutex
+	sockets []*quic.Transport
+	route   net.IP
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// CloseWrite sends the end of the stream, the peer still gets everything written before it
+func (c *quicConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *quicConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		c.Stream.Close()
+		go func() {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(quicLinger):
+			}
+			c.conn.CloseWithError(0, "")
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for _, tr := range c.sockets {
+				tr.Close()
+				tr.Conn.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+// followRoute migrates the connection whenever the local address used to reach raddr changes
+func (c *quicConn) followRoute(raddr *net.UDPAddr) {
+	ticker := time.NewTicker(routeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		ip, err := routeTo(raddr)
+		c.mu.Lock()
+		changed := err == nil && !ip.Equal(c.route)
+		c.mu.Unlock()
+		if !changed {
+			continue
+		}
+		// A route that fails is not retried until it changes again, the old one may still work
+		if err := c.migrate(ip); err != nil {
+			slog.Debug("Connection migration failed", "relay", raddr, "local", ip, "err", err)
+		} else {
+			slog.Debug("Connection migrated", "relay", raddr, "local", ip)
+		}
+	}
+}
+
+// migrate moves the connection to a new socket bound to ip, once the relay has answered on it
+func (c *quicConn) migrate(ip net.IP) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return fmt.Errorf("error opening UDP socket: %w", err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	// Once added, the socket knows some of the connection's ids and closing it would end the
+	// connection, so it is kept until the connection closes whether or not the path works out
+	c.mu.Lock()
+	c.sockets = append(c.sockets, tr)
+	c.route = ip
+	c.mu.Unlock()
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		return fmt.Errorf("error adding path: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(c.conn.Context(), migrateTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return fmt.Errorf("error probing path: %w", err)
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return fmt.Errorf("error switching path: %w", err)
+	}
+	return nil
+}
+
+// routeTo returns the local address the system would send packets to raddr from
+func routeTo(raddr *net.UDPAddr) (net.IP, error) {
+	// Connecting a UDP socket only picks a route, nothing is sent
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLS returns a server config with a self-signed certificate for 127.0.0.1 and a client
+// config that trusts it
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "qshare test relay"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestQUICListenNeedsCertificate(t *testing.T) {
+	if _, err := (QUICTransport{}).Listen("127.0.0.1:0"); err == nil {
+		t.Fatal("listening on quic:// without a certificate succeeded")
+	}
+}
+
+func TestQUICRelayTransfer(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	ln, err := QUICTransport{TLS: serverTLS}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(testConfig())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(time.Second) })
+	client := QUICTransport{TLS: clientTLS}
+	join := func(role string) net.Conn {
+		conn, err := client.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := ClientHandshake(conn, Handshake{Code: "6-date-7-moth", Role: role}); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	sender, receiver := join("sender"), join("receiver")
+	if _, err := io.WriteString(sender, "over quic"); err != nil {
+		t.Fatal(err)
+	}
+	sender.(interface{ CloseWrite() error }).CloseWrite()
+	r := bufio.NewReader(receiver)
+	got := make([]byte, len("over quic"))
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "over quic" {
+		t.Fatalf("receiver got %q, %v", got, err)
+	}
+	// The relay closes the sender's side once it has told the receiver, the notice must still arrive
+	if n := readNotice(t, receiver, r); n.Kind != NoticeDisconnect {
+		t.Fatalf("notice = %v, want %s", n, NoticeDisconnect)
+	}
+}
+
+func TestQUICMigration(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	ln, err := QUICTransport{TLS: serverTLS}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := QUICTransport{TLS: clientTLS}.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The stream only reaches the relay with its first bytes
+	if _, err := io.WriteString(conn, "before\n"); err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	defer server.Close()
+	r := bufio.NewReader(server)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := r.ReadString('\n'); err != nil || line != "before\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	before := server.RemoteAddr().String()
+
+	qc := conn.(*quicConn)
+	if err := qc.migrate(net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "after\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "after\n" {
+		t.Fatalf("read %q after migrating, %v", line, err)
+	}
+	if after := server.RemoteAddr().String(); after == before {
+		t.Fatalf("relay still sees the client at %s after it migrated", before)
+	}
+	// The relay answers on the new path too
+	if _, err := io.WriteString(server, "reply\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "reply\n" {
+		t.Fatalf("client read %q, %v", line, err)
+	}
+}
@@ -0,0 +1,303 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dailyUsage counts bytes per key, starting over at midnight UTC
+type dailyUsage struct {
+	clock Clock
+	mu    sync.Mutex
+	day   int64
+	used  map[string]int64
+}
+
+// get returns the bytes counted for key today. Caller holds d.mu.
+func (d *dailyUsage) get(key string) int64 {
+	if day := d.clock.Now().Unix() / 86400; day != d.day || d.used == nil {
+		d.day, d.used = day, make(map[string]int64)
+	}
+	return d.used[key]
+}
+
+// left returns how many bytes key may still use today under limit
+func (d *dailyUsage) left(key string, limit int64) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return limit - d.get(key)
+}
+
+func (d *dailyUsage) add(key string, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// get starts a new map at midnight, so it must run before d.used is indexed
+	v := d.get(key) + n
+	d.used[key] = v
+}
+
+// quotaError stops a transfer that ran out of the quota of scope
+type quotaError struct {
+	scope string
+	limit int64
+}
+
+func (e *quotaError) Error() string {
+	return (&NoticeError{Notice: e.notice()}).Error()
+}
+
+// notice is what both peers are told when the transfer is stopped
+func (e *quotaError) notice() Notice {
+	return QuotaNotice(e.scope, e.limit)
+}
+
+// endNotice is the notice for a transfer whose source failed with err
+func endNotice(err error) Notice {
+	var qerr *quotaError
+	if errors.As(err, &qerr) {
+		return qerr.notice()
+	}
+	return Notice{Kind: NoticeDisconnect}
+}
+
+// limitsFor returns what is left of each quota for a client at ip joining a room that has
+// relayed roomUsed bytes, or an error if one is used up already
+func (s *Server) limitsFor(ip string, roomUsed int64) (Limits, error) {
+	var l Limits
+	if q := s.cfg.RoomQuota; q > 0 {
+		if l.Room = q - roomUsed; l.Room <= 0 {
+			return l, &quotaError{scope: QuotaRoom, limit: q}
+		}
+	}
+	if q := s.cfg.IPQuota; q > 0 {
+		if l.IP = s.ipUsage.left(ip, q); l.IP <= 0 {
+			return l, &quotaError{scope: QuotaIP, limit: q}
+		}
+	}
+	if q := s.cfg.GlobalQuota; q > 0 {
+		if l.Global = s.globalUsage.left("", q); l.Global <= 0 {
+			return l, &quotaError{scope: QuotaGlobal, limit: q}
+		}
+	}
+	return l, nil
+}
+
+// meterQuota wraps src, read from a client at ip, so what it sends counts against the quotas.
+// relayed is the room's count, shared by everyone in it. Reads never go past a quota; once
+// one is used up they fail with a quotaError.
+func (s *Server) meterQuota(src io.Reader, ip string, relayed *atomic.Int64) io.Reader {
+	if s.cfg.RoomQuota == 0 && s.cfg.IPQuota == 0 && s.cfg.GlobalQuota == 0 {
+		return src
+	}
+	return &quotaReader{s: s, src: src, ip: ip, relayed: relayed}
+}
+
+type quotaReader struct {
+	s       *Server
+	src     io.Reader
+	ip      string
+	relayed *atomic.Int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	l, err := q.s.limitsFor(q.ip, q.relayed.Load())
+	if err != nil {
+		return 0, err
+	}
+	if max := l.Max(); max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := q.src.Read(p)
+	q.relayed.Add(int64(n))
+	if q.s.cfg.IPQuota > 0 {
+		q.s.ipUsage.add(q.ip, int64(n))
+	}
+	if q.s.cfg.GlobalQuota > 0 {
+		q.s.globalUsage.add("", int64(n))
+	}
+	return n, err
+}
+
+// tokenSyncBytes is how many bytes a connection counts locally before it adds them to its
+// token's usage in the store, so a busy transfer does not make a round trip per read
+const tokenSyncBytes = 1 << 20
+
+// tokenQuota is one connection's share of its token's usage. The usage is kept in
+// cfg.TokenUsage, so it outlives a restart and, with a networked store, every node of a
+// cluster counts against the same quotas.
+type tokenQuota struct {
+	store CounterStore
+	token Token
+	key   string // prefix of the token's counters
+	ttl   time.Duration
+	code  string
+	// inRoom is whether the connection was counted in the token's rooms
+	inRoom bool
+
+	mu      sync.Mutex
+	used    int64 // the token's bytes as of the last sync
+	pending int64 // bytes read since
+}
+
+var errQuotaBytes = errors.New("token byte quota used up")
+
+// authorize checks the token in hs and enters it into the code's room count. Returns a reason
+// if the client must be turned away. A nil quota means the server does not require tokens,
+// otherwise the caller must pair it with leave. Errors from the store are logged and let the
+// client in, as they are for rate limits.
+func (s *Server) authorize(hs Handshake) (*tokenQuota, string) {
+	if s.cfg.TokenKey == nil {
+		return nil, ""
+	}
+	str := hs.Options[OptToken]
+	if str == "" {
+		return nil, "this relay requires a token"
+	}
+	now := s.clock.Now()
+	t, err := VerifyToken(s.cfg.TokenKey, str, now)
+	if err != nil {
+		return nil, err.Error()
+	}
+	sum := sha256.Sum256([]byte(str))
+	q := &tokenQuota{
+		store: s.cfg.TokenUsage,
+		token: t,
+		// The token itself stays out of the store, its hash names the counters
+		key: "qshare:token:" + hex.EncodeToString(sum[:16]),
+		// Counters outlive the token just long enough for its last connections to settle
+		ttl:  max(time.Unix(t.Expires, 0).Sub(now), 0) + time.Hour,
+		code: hs.Code,
+	}
+	if t.MaxBytes > 0 {
+		if q.used, err = q.store.Get(q.key + ":bytes"); err != nil {
+			slog.Warn("Token usage store failed", "err", err)
+		}
+		if q.exhausted() {
+			return nil, errQuotaBytes.Error()
+		}
+	}
+	if t.MaxRooms > 0 {
+		if reason := q.enter(); reason != "" {
+			return nil, reason
+		}
+	}
+	return q, ""
+}
+
+// enter counts the connection in its code's room and, if it is the code's first, the code
+// against the token's rooms
+func (q *tokenQuota) enter() string {
+	room := q.key + ":room:" + q.code
+	n, err := q.store.Add(room, 1, q.ttl)
+	if err != nil {
+		slog.Warn("Token usage store failed", "err", err)
+		return ""
+	}
+	if n == 1 {
+		rooms, err := q.store.Add(q.key+":rooms", 1, q.ttl)
+		if err != nil {
+			slog.Warn("Token usage store failed", "err", err)
+			q.store.Add(room, -1, q.ttl)
+			return ""
+		}
+		if rooms > int64(q.token.MaxRooms) {
+			q.store.Add(q.key+":rooms", -1, q.ttl)
+			q.store.Add(room, -1, q.ttl)
+			return fmt.Sprintf("token may be in at most %d rooms at once", q.token.MaxRooms)
+		}
+	}
+	q.inRoom = true
+	return ""
+}
+
+// leave takes q's connection out of the room count and adds what it sent to the token's usage
+func (s *Server) leave(q *tokenQuota) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.sync()
+	q.mu.Unlock()
+	if !q.inRoom {
+		return
+	}
+	n, err := q.store.Add(q.key+":room:"+q.code, -1, q.ttl)
+	if err != nil {
+		slog.Warn("Token usage store failed", "err", err)
+		return
+	}
+	if n <= 0 {
+		if _, err := q.store.Add(q.key+":rooms", -1, q.ttl); err != nil {
+			slog.Warn("Token usage store failed", "err", err)
+		}
+	}
+}
+
+// exhausted reports whether the token has used up its bytes. Caller holds q.mu or owns q.
+func (q *tokenQuota) exhausted() bool {
+	return q.token.MaxBytes > 0 && q.used+q.pending >= q.token.MaxBytes
+}
+
+// sync adds the pending bytes to the token's usage and learns what its other connections
+// used meanwhile. Caller holds q.mu.
+func (q *tokenQuota) sync() {
+	if q.pending == 0 {
+		return
+	}
+	used, err := q.store.Add(q.key+":bytes", q.pending, q.ttl)
+	if err != nil {
+		// Kept pending, to try again with the next sync
+		slog.Warn("Token usage store failed", "err", err)
+		return
+	}
+	q.used, q.pending = used, 0
+}
+
+// meter counts the bytes the client sends through conn against the token, failing reads once
+// the quota is used up. Only reads count, so each relayed byte is charged once, to its sender.
+// Usage is synced every tokenSyncBytes, so a token's connections together may overshoot the
+// quota by that much each.
+func (q *tokenQuota) meter(conn net.Conn) net.Conn {
+	if q == nil || q.token.MaxBytes == 0 {
+		return conn
+	}
+	return &meteredConn{Conn: conn, q: q}
+}
+
+type meteredConn struct {
+	net.Conn
+	q *tokenQuota
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	c.q.mu.Lock()
+	exhausted := c.q.exhausted()
+	c.q.mu.Unlock()
+	if exhausted {
+		return 0, errQuotaBytes
+	}
+	n, err := c.Conn.Read(p)
+	c.q.mu.Lock()
+	c.q.pending += int64(n)
+	if c.q.pending >= tokenSyncBytes || c.q.exhausted() {
+		c.q.sync()
+	}
+	c.q.mu.Unlock()
+	return n, err
+}
+
+// CloseWrite keeps mailbox uploads and broadcasts able to half-close
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
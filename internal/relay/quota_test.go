@@ -0,0 +1,22 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDailyUsageStartsOverAtMidnight(t *testing.T) {
+	clock := newFakeClock()
+	d := &dailyUsage{clock: clock}
+	d.add("ip", 300)
+	d.add("ip", 200)
+	if left := d.left("ip", 1000); left != 500 {
+		t.Fatalf("left = %d, want 500", left)
+	}
+	clock.Advance(12 * time.Hour)
+	// The first add of a new day must land in the new day's counts
+	d.add("ip", 100)
+	if left := d.left("ip", 1000); left != 900 {
+		t.Fatalf("left after midnight = %d, want 900", left)
+	}
+}
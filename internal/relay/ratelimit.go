@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
@@ -14,113 +15,168 @@ const (
 	blockDuration   = 10 * time.Minute
 )
 
-var (
-	ipAttempts       = make(map[string][]time.Time)
-	codeAttempts     = make(map[string][]time.Time)
-	mu               sync.Mutex
-	failedHandshakes = make(map[string][]time.Time)
-	blockedCodes     = make(map[string]time.Time)
-)
+// Limiter decides whether another attempt for key is allowed, recording it if so.
+// Implementations must be safe for concurrent use.
+type Limiter interface {
+	Allow(key string) (bool, error)
+}
 
-// CheckAndRecordRateLimit checks and records an attempt for the given IP and code.
-// Returns (true, "") if allowed, (false, reason) if rate limited.
-func CheckAndRecordRateLimit(ip, code string) (bool, string) {
-	mu.Lock()
-	defer mu.Unlock()
-	now := time.Now()
-	// Clean up old entries
-	clean := func(attempts []time.Time) []time.Time {
-		cutoff := now.Add(-window)
-		for len(attempts) > 0 && attempts[0].Before(cutoff) {
-			attempts = attempts[1:]
-		}
-		return attempts
-	}
-	ipAttempts[ip] = clean(ipAttempts[ip])
-	codeAttempts[code] = clean(codeAttempts[code])
-	if len(ipAttempts[ip]) >= ipLimit {
-		return false, "rate limit exceeded for IP"
-	}
-	if len(codeAttempts[code]) >= codeLimit {
-		return false, "rate limit exceeded for code"
-	}
-	// Record this attempt
-	ipAttempts[ip] = append(ipAttempts[ip], now)
-	codeAttempts[code] = append(codeAttempts[code], now)
-	return true, ""
-}
-
-// CheckAndRecordFailedHandshake tracks failed handshakes per code. Returns (allowed, triesLeft, blocked, blockMsg)
-func CheckAndRecordFailedHandshake(code string) (bool, int, bool, string) {
-	mu.Lock()
-	defer mu.Unlock()
-	now := time.Now()
-	// Check if code is blocked
-	if until, ok := blockedCodes[code]; ok {
-		if now.Before(until) {
-			return false, 0, true, "Code temporarily blocked due to too many failed attempts. Try again later."
+// Cleaner is implemented by limiters and stores that keep per-key state in memory
+type Cleaner interface {
+	Cleanup()
+}
+
+// TokenBucket is an in-memory Limiter that allows burst attempts per key, refilled evenly over per.
+// Each key costs two numbers no matter how hard it is hammered.
+type TokenBucket struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a limiter allowing limit attempts per key in any period of length per
+func NewTokenBucket(limit int, per time.Duration) *TokenBucket {
+	return &TokenBucket{
+		rate:    float64(limit) / per.Seconds(),
+		burst:   float64(limit),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (t *TokenBucket) Allow(key string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+	b.tokens = min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// Cleanup drops buckets that have refilled completely, they behave the same as missing ones
+func (t *TokenBucket) Cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for key, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, key)
 		}
-		delete(blockedCodes, code)
-	}
-	// Clean up old failed attempts
-	cutoff := now.Add(-failedWindow)
-	attempts := failedHandshakes[code]
-	for len(attempts) > 0 && attempts[0].Before(cutoff) {
-		attempts = attempts[1:]
-	}
-	failedHandshakes[code] = attempts
-	// Record this failed attempt
-	attempts = append(attempts, now)
-	failedHandshakes[code] = attempts
-	triesLeft := failedThreshold - len(attempts)
-	if triesLeft <= 0 {
-		blockedCodes[code] = now.Add(blockDuration)
-		return false, 0, true, "Code temporarily blocked due to too many failed attempts. Try again later."
-	}
-	return true, triesLeft, false, ""
-}
-
-// Periodically clean up old entries to avoid memory leaks
-func StartRateLimitCleanup() {
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mu.Lock()
-			now := time.Now()
-			cutoff := now.Add(-window)
-			for ip, attempts := range ipAttempts {
-				ipAttempts[ip] = filterRecent(attempts, cutoff)
-				if len(ipAttempts[ip]) == 0 {
-					delete(ipAttempts, ip)
-				}
-			}
-			for code, attempts := range codeAttempts {
-				codeAttempts[code] = filterRecent(attempts, cutoff)
-				if len(codeAttempts[code]) == 0 {
-					delete(codeAttempts, code)
-				}
-			}
-			// Clean up failed handshakes and blocked codes
-			failedCutoff := now.Add(-failedWindow)
-			for code, attempts := range failedHandshakes {
-				failedHandshakes[code] = filterRecent(attempts, failedCutoff)
-				if len(failedHandshakes[code]) == 0 {
-					delete(failedHandshakes, code)
-				}
-			}
-			for code, until := range blockedCodes {
-				if now.After(until) {
-					delete(blockedCodes, code)
-				}
-			}
-			mu.Unlock()
+	}
+}
+
+// WindowLimiter is a fixed-window Limiter over a CounterStore. With a networked store
+// several relays behind a load balancer share the same limits.
+type WindowLimiter struct {
+	Store  CounterStore
+	Prefix string
+	Limit  int
+	Window time.Duration
+}
+
+func (w *WindowLimiter) Allow(key string) (bool, error) {
+	slot := time.Now().UnixNano() / int64(w.Window)
+	n, err := w.Store.Incr(fmt.Sprintf("%s:%s:%d", w.Prefix, key, slot), w.Window)
+	if err != nil {
+		return false, err
+	}
+	return n <= int64(w.Limit), nil
+}
+
+// RateLimit holds the per-IP and per-code limiters applied to every new connection
+type RateLimit struct {
+	IP   Limiter
+	Code Limiter
+}
+
+// NewMemoryRateLimit returns the default in-memory limits: 5 attempts per minute per IP and per code
+func NewMemoryRateLimit() *RateLimit {
+	return &RateLimit{
+		IP:   NewTokenBucket(ipLimit, window),
+		Code: NewTokenBucket(codeLimit, window),
+	}
+}
+
+// NewSharedRateLimit returns the default limits backed by store
+func NewSharedRateLimit(store CounterStore) *RateLimit {
+	return &RateLimit{
+		IP:   &WindowLimiter{Store: store, Prefix: "qshare:ip", Limit: ipLimit, Window: window},
+		Code: &WindowLimiter{Store: store, Prefix: "qshare:code", Limit: codeLimit, Window: window},
+	}
+}
+
+// Cleanup cleans up limiters that keep state in memory
+func (l *RateLimit) Cleanup() {
+	for _, lim := range []Limiter{l.IP, l.Code} {
+		if c, ok := lim.(Cleaner); ok {
+			c.Cleanup()
 		}
-	}()
+	}
+}
+
+// CheckAndRecord checks and records an attempt for the given IP and code.
+// Returns (true, "") if allowed, (false, reason) if rate limited. Backend errors are returned
+// with allowed=true so an unreachable store does not take the relay down.
+func (l *RateLimit) CheckAndRecord(ip, code string) (bool, string, error) {
+	ok, err := l.IP.Allow(ip)
+	if err != nil {
+		return true, "", fmt.Errorf("ip limiter: %w", err)
+	}
+	if !ok {
+		return false, "rate limit exceeded for IP", nil
+	}
+	ok, err = l.Code.Allow(code)
+	if err != nil {
+		return true, "", fmt.Errorf("code limiter: %w", err)
+	}
+	if !ok {
+		return false, "rate limit exceeded for code", nil
+	}
+	return true, "", nil
+}
+
+// HandshakeGuard tracks failed handshakes per code and blocks codes that fail too often
+type HandshakeGuard struct {
+	Store CounterStore
 }
 
-func filterRecent(attempts []time.Time, cutoff time.Time) []time.Time {
-	for len(attempts) > 0 && attempts[0].Before(cutoff) {
-		attempts = attempts[1:]
+const blockedMsg = "Code temporarily blocked due to too many failed attempts. Try again later."
+
+// CheckAndRecordFailedHandshake records a failed handshake for code. Returns (allowed, triesLeft, blocked, blockMsg)
+func (g *HandshakeGuard) CheckAndRecordFailedHandshake(code string) (bool, int, bool, string, error) {
+	blocked, err := g.Store.Get("qshare:blocked:" + code)
+	if err != nil {
+		return true, failedThreshold, false, "", err
+	}
+	if blocked > 0 {
+		return false, 0, true, blockedMsg, nil
+	}
+	n, err := g.Store.Incr("qshare:failed:"+code, failedWindow)
+	if err != nil {
+		return true, failedThreshold, false, "", err
+	}
+	triesLeft := failedThreshold - int(n)
+	if triesLeft <= 0 {
+		if _, err := g.Store.Incr("qshare:blocked:"+code, blockDuration); err != nil {
+			return false, 0, true, blockedMsg, err
+		}
+		return false, 0, true, blockedMsg, nil
 	}
-	return attempts
+	return true, triesLeft, false, "", nil
 }
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefills(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewTokenBucket(5, time.Minute)
+	b.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		if ok, _ := b.Allow("ip"); !ok {
+			t.Fatalf("attempt %d refused within the burst", i+1)
+		}
+	}
+	if ok, _ := b.Allow("ip"); ok {
+		t.Fatal("attempt beyond the burst allowed")
+	}
+	if ok, _ := b.Allow("other"); !ok {
+		t.Fatal("keys share a bucket")
+	}
+	// One token comes back every 12 seconds
+	now = now.Add(12 * time.Second)
+	if ok, _ := b.Allow("ip"); !ok {
+		t.Fatal("refilled token refused")
+	}
+	if ok, _ := b.Allow("ip"); ok {
+		t.Fatal("more than one token refilled")
+	}
+	now = now.Add(time.Minute)
+	b.Cleanup()
+	if len(b.buckets) != 0 {
+		t.Fatalf("Cleanup kept %d full buckets", len(b.buckets))
+	}
+}
+
+func TestWindowLimiterSharesStore(t *testing.T) {
+	store := NewMemoryStore()
+	// Two relays sharing one store enforce one limit between them
+	a := &WindowLimiter{Store: store, Prefix: "qshare:ip", Limit: 3, Window: time.Hour}
+	b := &WindowLimiter{Store: store, Prefix: "qshare:ip", Limit: 3, Window: time.Hour}
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		for _, l := range []*WindowLimiter{a, b} {
+			if ok, err := l.Allow("1.2.3.4"); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				allowed++
+			}
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d attempts, want 3", allowed)
+	}
+}
+
+func TestRateLimitReportsWhichLimitHit(t *testing.T) {
+	l := &RateLimit{IP: NewTokenBucket(2, time.Minute), Code: NewTokenBucket(1, time.Minute)}
+	if ok, reason, _ := l.CheckAndRecord("ip", "code"); !ok {
+		t.Fatalf("first attempt refused: %s", reason)
+	}
+	if ok, reason, _ := l.CheckAndRecord("ip", "code"); ok || reason != "rate limit exceeded for code" {
+		t.Fatalf("second attempt = %v, %q, want the code limit", ok, reason)
+	}
+	if ok, reason, _ := l.CheckAndRecord("ip", "other"); ok || reason != "rate limit exceeded for IP" {
+		t.Fatalf("third attempt = %v, %q, want the IP limit", ok, reason)
+	}
+}
+
+func TestHandshakeGuardBlocksAfterThreshold(t *testing.T) {
+	g := &HandshakeGuard{Store: NewMemoryStore()}
+	for want := failedThreshold - 1; want > 0; want-- {
+		allowed, triesLeft, blocked, _, err := g.CheckAndRecordFailedHandshake("code")
+		if err != nil || !allowed || blocked || triesLeft != want {
+			t.Fatalf("failure = %v, %d tries left, blocked %v, %v, want %d tries left", allowed, triesLeft, blocked, err, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if allowed, _, blocked, msg, _ := g.CheckAndRecordFailedHandshake("code"); allowed || !blocked || msg != blockedMsg {
+			t.Fatalf("failure past the threshold = %v, blocked %v, %q", allowed, blocked, msg)
+		}
+	}
+	if allowed, _, _, _, _ := g.CheckAndRecordFailedHandshake("another"); !allowed {
+		t.Fatal("blocking one code blocked another")
+	}
+}
@@ -1,36 +1,664 @@
 package relay
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Relay is a struct that contains a mutex and a map of rooms
-type Relay struct {
-	mu sync.Mutex
-	rooms map[string]chan []byte
+// Config configures a Server. Zero fields take the defaults noted; a zero limit or quota means none.
+type Config struct {
+	// MaxConns caps the open client connections, default 1000
+	MaxConns int
+	// MaxConnsPerIP caps the open connections from one IP, default 20
+	MaxConnsPerIP int
+	// MaxHandshakes caps the handshakes read concurrently, default 64
+	MaxHandshakes int
+	// HandshakeTimeout is how long a client has to send its handshake, default 10s
+	HandshakeTimeout time.Duration
+	// MaxReceivers caps the receivers a broadcast sender may ask for, default 32
+	MaxReceivers int
+	// BroadcastWait is how long a broadcast room waits for all its receivers before it starts
+	// with the ones that came, default 5 minutes
+	BroadcastWait time.Duration
+
+	// RoomThrottle, if set, makes the bandwidth cap both directions of a new room share
+	RoomThrottle func() Throttle
+	// Throttle, if set, caps everything the server relays, rooms and mailbox transfers together
+	Throttle Throttle
+
+	// RoomQuota caps the bytes one room relays, which bounds the size of a transfer
+	RoomQuota int64
+	// IPQuota caps the bytes relayed from one IP per UTC day
+	IPQuota int64
+	// GlobalQuota caps the bytes the whole server carries per UTC day
+	GlobalQuota int64
+
+	// TokenKey, if set, is the issuer key clients' tokens must be signed with
+	TokenKey []byte
+	// TokenUsage keeps what each token has used, default an in-memory store. A networked one
+	// shares token quotas across a cluster and keeps them over restarts.
+	TokenUsage CounterStore
+	// Mailbox, if set, stores uploads for offline receivers
+	Mailbox Mailbox
+	// MailboxAckTimeout is how long a receiver has to acknowledge a mailbox download after the
+	// last byte, default 1 minute
+	MailboxAckTimeout time.Duration
+	// RateLimit and HandshakeGuard default to in-memory ones the server cleans up itself
+	RateLimit      *RateLimit
+	HandshakeGuard *HandshakeGuard
+	// Audit, if set, receives a record of every session and rejection. Codes in it are hashed
+	// with AuditKey, a new random key by default.
+	Audit    AuditSink
+	AuditKey []byte
+
+	// AbandonAfter is how long a room waits for its other side, default 10 minutes
+	AbandonAfter time.Duration
+	// RetryWindow is how long a retryable room outlives a disconnect, default 2 minutes
+	RetryWindow time.Duration
+	// CleanupInterval is how often Serve sweeps abandoned rooms and expired entries, default 1 minute
+	CleanupInterval time.Duration
+	// Clock defaults to the system clock
+	Clock Clock
+
+	// Coordinator, if set, shares room registrations with the other nodes of a cluster. Peers of
+	// a code that reach different nodes are forwarded to the node that registered it first.
+	Coordinator Coordinator
+	// ClusterNode is the address other nodes reach this one's ServeCluster listener at
+	ClusterNode string
+	// ClusterKey signs forwarded connections and must be the same on every node
+	ClusterKey []byte
+}
+
+// Throttle wraps a reader so it reads no faster than a bandwidth cap, see transfer.LimitReader
+type Throttle func(io.Reader) io.Reader
+
+// Clock tells a Server the time, so tests can move it along instead of sleeping. Network
+// deadlines always use the system clock.
+type Clock interface {
+	Now() time.Time
+	// After is like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Server matches up the two sides of each code and relays between them
+type Server struct {
+	cfg   Config
+	clock Clock
+
+	mu    sync.Mutex
+	rooms map[string]*room
+	// conns tracks every handshaken connection that has not finished piping, so shutdown can
+	// notify them. Closing the channel releases the connection's handler.
+	conns map[net.Conn]chan struct{}
+	// sessions maps the code of every 1:1 room that is piping to its room, so the extra
+	// connections of a parallel transfer can only join while their session runs
+	sessions  map[string]*room
+	listeners []net.Listener
+
+	// draining is set once shutdown starts: no new rooms
+	draining atomic.Bool
+	// activePipes counts running pipes, broadcasts and mailbox transfers
+	activePipes sync.WaitGroup
+	startOnce   sync.Once
+	stopped     chan struct{}
+	// cleaners are the in-memory limiters the server made itself and sweeps with its rooms
+	cleaners []Cleaner
+
+	// connSlots and handshakeSlots are semaphores bounding connections and handshakes
+	connSlots      chan struct{}
+	handshakeSlots chan struct{}
+	ipMu           sync.Mutex
+	ipConns        map[string]int
+
+	ipUsage     *dailyUsage
+	globalUsage *dailyUsage
+}
+
+type room struct {
+	code                 string
+	sender               net.Conn
+	receiver             net.Conn
+	createdAt            time.Time
+	retryable            bool
+	lastActivity         time.Time
+	senderDisconnected   bool
+	receiverDisconnected bool
+	// maxReceivers > 1 makes this a broadcast room: the sender's stream is fanned out to receivers
+	maxReceivers int
+	receivers    []net.Conn
+	// waiting is set once the broadcast's BroadcastWait timer runs
+	waiting bool
+	// throttle caps what the server forwards for this room, nil for no cap
+	throttle Throttle
+	// relayed counts the bytes forwarded for the room quota, shared with its parallel connections
+	relayed *atomic.Int64
+	audit   sessionAudit
+}
+
+// maxParallelConns bounds the extra connections one transfer may open
+const maxParallelConns = 16
+
+// NewServer returns a server configured by cfg. It does nothing until given a listener.
+func NewServer(cfg Config) *Server {
+	s := &Server{
+		clock:    cfg.Clock,
+		rooms:    make(map[string]*room),
+		conns:    make(map[net.Conn]chan struct{}),
+		sessions: make(map[string]*room),
+		stopped:  make(chan struct{}),
+		ipConns:  make(map[string]int),
+	}
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 1000
+	}
+	if cfg.MaxConnsPerIP <= 0 {
+		cfg.MaxConnsPerIP = 20
+	}
+	if cfg.MaxHandshakes <= 0 {
+		cfg.MaxHandshakes = 64
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = 10 * time.Second
+	}
+	if cfg.MaxReceivers <= 0 {
+		cfg.MaxReceivers = 32
+	}
+	if cfg.BroadcastWait <= 0 {
+		cfg.BroadcastWait = 5 * time.Minute
+	}
+	if cfg.MailboxAckTimeout <= 0 {
+		cfg.MailboxAckTimeout = time.Minute
+	}
+	if cfg.AbandonAfter <= 0 {
+		cfg.AbandonAfter = 10 * time.Minute
+	}
+	if cfg.RetryWindow <= 0 {
+		cfg.RetryWindow = 2 * time.Minute
+	}
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = time.Minute
+	}
+	if cfg.RateLimit == nil {
+		cfg.RateLimit = NewMemoryRateLimit()
+		s.cleaners = append(s.cleaners, cfg.RateLimit)
+	}
+	if cfg.HandshakeGuard == nil {
+		store := NewMemoryStore()
+		cfg.HandshakeGuard = &HandshakeGuard{Store: store}
+		s.cleaners = append(s.cleaners, store)
+	}
+	if cfg.TokenUsage == nil {
+		store := NewMemoryStore()
+		cfg.TokenUsage = store
+		s.cleaners = append(s.cleaners, store)
+	}
+	if cfg.AuditKey == nil {
+		cfg.AuditKey = make([]byte, 32)
+		rand.Read(cfg.AuditKey)
+	}
+	s.cfg = cfg
+	s.connSlots = make(chan struct{}, cfg.MaxConns)
+	s.handshakeSlots = make(chan struct{}, cfg.MaxHandshakes)
+	s.ipUsage = &dailyUsage{clock: s.clock}
+	s.globalUsage = &dailyUsage{clock: s.clock}
+	return s
+}
+
+// Serve accepts connections on ln until Shutdown closes it. The first call also starts the
+// periodic cleanup.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.draining.Load() {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	s.startOnce.Do(func() { go s.cleanupLoop() })
+	// All admission work happens in the per-connection goroutine so a slow client never stalls Accept
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Draining reports whether Shutdown has started, so a health check can turn load balancers away
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	slog.Debug("New connection", "remote", conn.RemoteAddr())
+	ip := ipOf(conn)
+	if reason := s.admit(ip); reason != "" {
+		slog.Warn("Connection rejected", "ip", ip, "reason", reason)
+		reject(conn, reason)
+		s.auditReject(ip, "", OutcomeRejected, reason)
+		return
+	}
+	defer s.release(ip)
+
+	hs, bconn, err := s.readHandshake(conn)
+	if err != nil {
+		outcome := OutcomeRejected
+		// Track failures against the code if the client got that far
+		if code := hs.Code; code != "" {
+			allowed, triesLeft, blocked, blockMsg, guardErr := s.cfg.HandshakeGuard.CheckAndRecordFailedHandshake(code)
+			if guardErr != nil {
+				slog.Error("Failed handshake tracking error", "err", guardErr)
+			}
+			if !allowed {
+				if blocked {
+					reject(conn, blockMsg)
+					slog.Warn("Handshake failed, code blocked", "remote", conn.RemoteAddr(), "code", code, "err", err)
+					outcome = OutcomeBlocked
+				} else {
+					reject(conn, fmt.Sprintf("Invalid code or key. You have %d tries remaining before this code is blocked.", triesLeft))
+					slog.Warn("Handshake failed", "remote", conn.RemoteAddr(), "code", code, "tries_left", triesLeft, "err", err)
+				}
+			}
+		}
+		slog.Info("Handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		s.auditReject(ip, hs.Code, outcome, "handshake failed: "+err.Error())
+		return
+	}
+	quota, reason := s.authorize(hs)
+	if reason != "" {
+		slog.Warn("Connection rejected", "ip", ip, "code", hs.Code, "reason", reason)
+		reject(conn, reason)
+		s.auditReject(ip, hs.Code, OutcomeRejected, reason)
+		return
+	}
+	defer s.leave(quota)
+	if quota != nil {
+		slog.Info("Connection authorized", "ip", ip, "token_id", quota.token.ID)
+	}
+	conn = quota.meter(bconn)
+	// Extra connections of a parallel transfer skip the rate limit since their session already
+	// passed it, and so do receivers filling the slots of a broadcast the sender opened here
+	if _, extra := hs.Options[OptConn]; !extra && !s.broadcastHasRoom(hs) {
+		allowed, reason, err := s.cfg.RateLimit.CheckAndRecord(ip, hs.Code)
+		if err != nil {
+			slog.Error("Rate limit check failed, allowing connection", "err", err)
+		}
+		if !allowed {
+			slog.Warn("Connection rate limited", "ip", ip, "code", hs.Code, "reason", reason)
+			reject(conn, reason)
+			s.auditReject(ip, hs.Code, OutcomeRateLimited, reason)
+			return
+		}
+	}
+	if s.draining.Load() {
+		goAway(conn)
+		s.auditReject(ip, hs.Code, OutcomeShutdown, "relay is shutting down")
+		return
+	}
+	if node := s.owner(hs); node != "" {
+		s.forward(conn, hs, node)
+		return
+	}
+	s.join(conn, hs)
+}
+
+// join enters conn into the room for hs, once it has passed the checks of the node it
+// connected to. Returns when conn has finished piping or was closed by cleanup.
+func (s *Server) join(conn net.Conn, hs Handshake) {
+	ip := ipOf(conn)
+	code, role, retryable := hs.Code, hs.Role, hs.Retry
+	_, extra := hs.Options[OptConn]
+	if extra {
+		// Extra connections of a parallel transfer pair up in their own room
+		var reason string
+		if code, reason = s.parallelRoom(hs); reason != "" {
+			slog.Warn("Parallel connection rejected", "ip", ip, "code", hs.Code, "reason", reason)
+			reject(conn, reason)
+			s.auditReject(ip, hs.Code, OutcomeRejected, reason)
+			return
+		}
+		retryable = false
+	}
+	ttl, upload := hs.Options[OptMailbox]
+	if upload && s.cfg.Mailbox == nil {
+		reject(conn, "mailbox mode is not enabled on this relay")
+		s.auditReject(ip, code, OutcomeRejected, "mailbox mode is not enabled on this relay")
+		return
+	}
+	if n, err := strconv.Atoi(hs.Options[OptReceivers]); err == nil && role == "sender" && n > s.cfg.MaxReceivers {
+		reason := fmt.Sprintf("this relay allows at most %d receivers", s.cfg.MaxReceivers)
+		slog.Warn("Sender rejected", "ip", ip, "code", code, "receivers", n)
+		reject(conn, reason)
+		s.auditReject(ip, code, OutcomeRejected, reason)
+		return
+	}
+	// Tell the client what it may still relay, so a sender can refuse a file that would not fit
+	limits, err := s.limitsFor(ip, s.roomRelayed(code, hs.Code))
+	if err != nil {
+		slog.Warn("Connection over quota", "ip", ip, "code", code, "err", err)
+		reject(conn, err.Error())
+		s.auditReject(ip, code, OutcomeQuota, err.Error())
+		return
+	}
+	// A receiver with nobody in the room gets the stored upload, if there is one
+	var stored io.ReadCloser
+	if role == "receiver" && !extra && !s.roomExists(code) {
+		stored = s.openMailbox(code)
+	}
+	limits.Mailbox = stored != nil
+	reply := ReplyOK
+	if l := limits.String(); l != "" {
+		reply += " " + l
+	}
+	if _, err := io.WriteString(conn, reply+"\n"); err != nil {
+		if stored != nil {
+			stored.Close()
+		}
+		return
+	}
+	if upload && role == "sender" {
+		s.storeUpload(conn, code, ttl)
+		return
+	}
+	if stored != nil {
+		s.serveMailbox(conn, code, stored)
+		return
+	}
+	done := make(chan struct{})
+	now := s.clock.Now()
+	s.mu.Lock()
+	s.conns[conn] = done
+	r, ok := s.rooms[code]
+	if !ok {
+		r = &room{code: code, createdAt: now, retryable: retryable, lastActivity: now, relayed: new(atomic.Int64)}
+		if s.cfg.RoomThrottle != nil {
+			r.throttle = s.cfg.RoomThrottle()
+		}
+		if ss, ok := s.sessions[hs.Code]; ok && extra {
+			r.relayed = ss.relayed
+		}
+		s.rooms[code] = r
+		slog.Info("Room created", "code", code, "retryable", retryable)
+	}
+	if role == "sender" {
+		r.sender = conn
+		r.senderDisconnected = false
+		r.audit.senderJoined = now.UTC()
+		if n, err := strconv.Atoi(hs.Options[OptReceivers]); err == nil && n > 1 {
+			r.maxReceivers = n
+			// A receiver that beat the sender here becomes the first broadcast receiver
+			if r.receiver != nil {
+				r.receivers = append(r.receivers, r.receiver)
+				r.receiver = nil
+			}
+			if !r.waiting {
+				r.waiting = true
+				go s.startBroadcastAfter(r, s.cfg.BroadcastWait)
+			}
+		}
+		slog.Info("Sender joined room", "code", code, "remote", conn.RemoteAddr())
+	} else if r.maxReceivers > 1 {
+		if len(r.receivers) >= r.maxReceivers {
+			s.untrack(conn)
+			s.mu.Unlock()
+			slog.Warn("Receiver turned away, room is full", "code", code, "remote", conn.RemoteAddr())
+			// The reason keeps the notice longer than a frame header, so a mux reading one sees all of it
+			conn.Write([]byte(Notice{Kind: NoticeRoomFull, Reason: "all receiver slots are taken"}.String()))
+			s.auditReject(ip, code, OutcomeRejected, "room is full")
+			return
+		}
+		r.receivers = append(r.receivers, conn)
+		if r.audit.receiverJoined.IsZero() {
+			r.audit.receiverJoined = now.UTC()
+		}
+		slog.Info("Receiver joined broadcast room", "code", code, "receiver", len(r.receivers), "receivers", r.maxReceivers, "remote", conn.RemoteAddr())
+	} else {
+		r.receiver = conn
+		r.receiverDisconnected = false
+		r.audit.receiverJoined = now.UTC()
+		slog.Info("Receiver joined room", "code", code, "remote", conn.RemoteAddr())
+	}
+	r.lastActivity = now
+	if r.maxReceivers > 1 {
+		// Broadcast rooms start once every expected receiver is there, or after BroadcastWait
+		if r.sender != nil && len(r.receivers) == r.maxReceivers {
+			s.startBroadcastLocked(r)
+		}
+	} else if r.sender != nil && r.receiver != nil {
+		// If both sender and receiver are set, start the piping
+		s.activePipes.Add(2)
+		r.audit.pipes, r.audit.outcome = 2, OutcomeCompleted
+		go s.pipeWithNotify(r, "sender")
+		go s.pipeWithNotify(r, "receiver")
+		if !extra {
+			s.sessions[code] = r
+		}
+		if !r.retryable {
+			delete(s.rooms, code)
+			slog.Info("Room completed and deleted (not retryable)", "code", code)
+		}
+	}
+	s.mu.Unlock()
+	// Block here until the connection has finished piping or is closed by cleanup
+	<-done
+}
+
+func (s *Server) pipeWithNotify(r *room, who string) {
+	defer s.activePipes.Done()
+	var src, dst net.Conn
+	if who == "sender" {
+		src = r.sender
+		dst = r.receiver
+	} else {
+		src = r.receiver
+		dst = r.sender
+	}
+	if src == nil || dst == nil {
+		return
+	}
+	n, err := io.Copy(dst, s.limitRoom(r, s.meterQuota(src, ipOf(src), r.relayed)))
+	notice := endNotice(err)
+	if notice.Kind == NoticeQuota {
+		slog.Warn("Room stopped", "code", r.code, "err", err)
+		// The side that ran out is told too, it would otherwise only see the connection drop
+		src.Write([]byte(notice.String()))
+	} else if err != nil {
+		// A peer resetting its connection once done is routine, not worth a warning
+		level := slog.LevelWarn
+		if hungUp(err) {
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, "Pipe error", "code", r.code, "side", who, "err", err)
+	}
+	// Notify the other side
+	dst.Write([]byte(notice.String()))
+	s.mu.Lock()
+	s.untrack(src)
+	if notice.Kind == NoticeQuota {
+		s.untrack(dst)
+	}
+	if who == "sender" {
+		r.senderDisconnected = true
+	} else {
+		r.receiverDisconnected = true
+	}
+	r.lastActivity = s.clock.Now()
+	// Once either side leaves, the session takes no more parallel connections
+	if s.sessions[r.code] == r {
+		delete(s.sessions, r.code)
+	}
+	rec, ended := s.pipeEnded(r, who, n, err, notice)
+	kept := s.rooms[r.code] == r
+	s.mu.Unlock()
+	if ended {
+		s.audit(rec)
+		if !kept {
+			s.unclaim(r.code)
+		}
+	}
+}
+
+// limitRoom wraps src so data relayed for r respects the room and global bandwidth caps
+func (s *Server) limitRoom(r *room, src io.Reader) io.Reader {
+	if r.throttle != nil {
+		src = r.throttle(src)
+	}
+	return s.limitGlobal(src)
+}
+
+// limitGlobal wraps src so it respects the global bandwidth cap, for transfers without a room
+func (s *Server) limitGlobal(src io.Reader) io.Reader {
+	if s.cfg.Throttle == nil {
+		return src
+	}
+	return s.cfg.Throttle(src)
+}
+
+// parallelRoom checks an extra connection handshake (conn=n option) and returns the room code
+// it pairs in. Extra connections skip the rate limit since their session already passed it.
+func (s *Server) parallelRoom(hs Handshake) (string, string) {
+	n, err := strconv.Atoi(hs.Options[OptConn])
+	if err != nil || n < 1 || n >= maxParallelConns {
+		return "", "invalid parallel connection number"
+	}
+	if _, ok := hs.Options[OptMailbox]; ok {
+		return "", "parallel connections cannot use the mailbox"
+	}
+	s.mu.Lock()
+	_, ok := s.sessions[hs.Code]
+	s.mu.Unlock()
+	if !ok {
+		return "", "no running transfer for this code"
+	}
+	return hs.Code + "#" + strconv.Itoa(n), ""
+}
+
+// roomRelayed returns the bytes already relayed in the room for code, or by the running session
+// a parallel connection belongs to
+func (s *Server) roomRelayed(code, session string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.rooms[code]; ok {
+		return r.relayed.Load()
+	}
+	if r, ok := s.sessions[session]; ok {
+		return r.relayed.Load()
+	}
+	return 0
 }
 
-// NewRelay creates a new relay instance and returns a pointer to it
-// acts like constructors in other languages
-func NewRelay() *Relay {
-	return &Relay{
-		rooms: make(map[string]chan []byte),
+// broadcastHasRoom reports whether hs is a receiver for a broadcast room on this node that
+// still has free receiver slots
+func (s *Server) broadcastHasRoom(hs Handshake) bool {
+	if hs.Role != "receiver" {
+		return false
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[hs.Code]
+	return ok && r.sender != nil && len(r.receivers) < r.maxReceivers
 }
 
-// Sender calls this to create a room and get a channel
-func (r *Relay) CreateRoom(code string) chan []byte {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	ch := make(chan []byte)
-	r.rooms[code] = ch
-	return ch
+func (s *Server) roomExists(code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rooms[code]
+	return ok
 }
 
-// Receiver calls this to join a room by code
-func (r *Relay) JoinRoom(code string) (chan []byte, bool) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	ch, ok := r.rooms[code]
-	return ch, ok
-}
\ No newline at end of file
+// cleanupLoop runs Cleanup every CleanupInterval until Shutdown
+func (s *Server) cleanupLoop() {
+	for {
+		select {
+		case <-s.clock.After(s.cfg.CleanupInterval):
+			s.Cleanup()
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// Cleanup removes abandoned rooms, retryable rooms whose disconnect window has passed, and
+// expired tokens and mailbox entries. Serve runs it periodically.
+func (s *Server) Cleanup() {
+	var abandoned []AuditRecord
+	var gone, live []string
+	now := s.clock.Now()
+	s.mu.Lock()
+	for code, r := range s.rooms {
+		if r.sender == nil || r.receiver == nil {
+			if now.Sub(r.createdAt) > s.cfg.AbandonAfter {
+				slog.Info("Cleaning up abandoned room", "code", code, "created", r.createdAt)
+				abandoned = append(abandoned, s.auditRecord(r, AuditSession, OutcomeAbandoned))
+				s.untrack(r.sender)
+				s.untrack(r.receiver)
+				for _, rc := range r.receivers {
+					s.untrack(rc)
+				}
+				delete(s.rooms, code)
+				gone = append(gone, code)
+				continue
+			}
+		} else if r.retryable {
+			if r.senderDisconnected || r.receiverDisconnected {
+				if now.Sub(r.lastActivity) > s.cfg.RetryWindow {
+					slog.Info("Cleaning up retryable room after disconnect window", "code", code)
+					delete(s.rooms, code)
+					gone = append(gone, code)
+					continue
+				}
+			}
+		}
+		live = append(live, code)
+	}
+	for code := range s.sessions {
+		live = append(live, code)
+	}
+	s.mu.Unlock()
+	for _, rec := range abandoned {
+		s.audit(rec)
+	}
+	for _, code := range gone {
+		s.unclaim(code)
+	}
+	// Keep the cluster sending peers here for as long as rooms wait or pipe
+	for _, code := range live {
+		s.claim(code, s.cfg.AbandonAfter)
+	}
+	for _, c := range s.cleaners {
+		c.Cleanup()
+	}
+	if s.cfg.Mailbox != nil {
+		if err := s.cfg.Mailbox.Expire(now); err != nil {
+			slog.Error("Mailbox cleanup failed", "err", err)
+		}
+	}
+}
+
+// ipOf returns the IP address of the client at the other end of conn
+func ipOf(conn net.Conn) string {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return ip
+}
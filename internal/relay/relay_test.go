@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	os.Exit(m.Run())
+}
+
+// testConfig returns a Config whose rate limits do not get in the way of many connections from
+// one address
+func testConfig() Config {
+	return Config{RateLimit: &RateLimit{IP: NewTokenBucket(1000, time.Minute), Code: NewTokenBucket(1000, time.Minute)}}
+}
+
+// fakeClock is a Clock that only moves when the test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), c: ch})
+	}
+	return ch
+}
+
+// Advance moves the clock on by d and fires the timers that came due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+// waitUntil polls cond until it holds, failing the test after a few seconds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startServer serves cfg on a loopback listener until the test ends
+func startServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cfg)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(time.Second) })
+	return srv, ln.Addr().String()
+}
+
+// dialRoom connects to addr and sends hs, failing the test unless the relay accepts it
+func dialRoom(t *testing.T, addr string, hs Handshake) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := ClientHandshake(conn, hs); err != nil {
+		t.Fatalf("handshake %q: %v", hs.String(), err)
+	}
+	return conn
+}
+
+// readNotice reads the next line from r and parses it as a notice
+func readNotice(t *testing.T, conn net.Conn, r *bufio.Reader) Notice {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading notice: %v", err)
+	}
+	n, ok := ParseNotice(line)
+	if !ok {
+		t.Fatalf("expected a notice, got %q", line)
+	}
+	return n
+}
+
+func TestFullBroadcastRoomTurnsReceiverAway(t *testing.T) {
+	srv, addr := startServer(t, testConfig())
+	code := "2-pea-3-crow"
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	// Both receiver slots are taken and the sender has not started the broadcast yet
+	srv.mu.Lock()
+	srv.rooms[code] = &room{code: code, maxReceivers: 2, receivers: []net.Conn{a, b}, relayed: new(atomic.Int64)}
+	srv.mu.Unlock()
+
+	conn := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	r := bufio.NewReader(conn)
+	n := readNotice(t, conn, r)
+	if n.Kind != NoticeRoomFull {
+		t.Fatalf("notice = %v, want %s", n, NoticeRoomFull)
+	}
+	// A mux reads a whole frame header before it looks for a notice
+	if len(n.String()) < 10 {
+		t.Fatalf("notice %q is shorter than a frame header", n.String())
+	}
+	srv.mu.Lock()
+	tracked := len(srv.conns)
+	srv.mu.Unlock()
+	if tracked != 0 {
+		t.Fatalf("%d connections still tracked after the receiver was turned away", tracked)
+	}
+}
+
+func TestRoomPipesBothWays(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	code := "3-fern-8-moth"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	for _, pair := range [][2]net.Conn{{sender, receiver}, {receiver, sender}} {
+		if _, err := pair[0].Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		pair[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(pair[1], got); err != nil || string(got) != "ping" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+	sender.Close()
+	if n := readNotice(t, receiver, bufio.NewReader(receiver)); n.Kind != NoticeDisconnect {
+		t.Fatalf("notice = %v, want %s", n, NoticeDisconnect)
+	}
+}
+
+func TestCleanupAbandonsWaitingRoom(t *testing.T) {
+	clock := newFakeClock()
+	cfg := testConfig()
+	cfg.Clock, cfg.AbandonAfter = clock, 10*time.Minute
+	srv, addr := startServer(t, cfg)
+	code := "5-lark-1-pine"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender"})
+	waitUntil(t, "the room exists", func() bool { return srv.roomExists(code) })
+
+	clock.Advance(9 * time.Minute)
+	srv.Cleanup()
+	if !srv.roomExists(code) {
+		t.Fatal("room cleaned up before AbandonAfter")
+	}
+	clock.Advance(2 * time.Minute)
+	srv.Cleanup()
+	if srv.roomExists(code) {
+		t.Fatal("room kept after AbandonAfter")
+	}
+	// The waiting sender is let go
+	sender.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(sender); err != nil {
+		t.Fatalf("sender not disconnected: %v", err)
+	}
+}
+
+func TestRetryableRoomOutlivesDisconnectForRetryWindow(t *testing.T) {
+	clock := newFakeClock()
+	cfg := testConfig()
+	cfg.Clock, cfg.RetryWindow = clock, 2*time.Minute
+	srv, addr := startServer(t, cfg)
+	code := "6-reed-4-wren"
+	sender := dialRoom(t, addr, Handshake{Code: code, Role: "sender", Retry: true})
+	receiver := dialRoom(t, addr, Handshake{Code: code, Role: "receiver", Retry: true})
+	sender.Close()
+	if n := readNotice(t, receiver, bufio.NewReader(receiver)); n.Kind != NoticeDisconnect {
+		t.Fatalf("notice = %v, want %s", n, NoticeDisconnect)
+	}
+	waitUntil(t, "the sender's disconnect is recorded", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		r := srv.rooms[code]
+		return r != nil && r.senderDisconnected
+	})
+
+	clock.Advance(time.Minute)
+	srv.Cleanup()
+	if !srv.roomExists(code) {
+		t.Fatal("retryable room removed inside the retry window")
+	}
+	clock.Advance(2 * time.Minute)
+	srv.Cleanup()
+	if srv.roomExists(code) {
+		t.Fatal("retryable room kept after the retry window")
+	}
+}
+
+func TestServeCleansUpOnInterval(t *testing.T) {
+	clock := newFakeClock()
+	cfg := testConfig()
+	cfg.Clock, cfg.AbandonAfter, cfg.CleanupInterval = clock, time.Minute, 30*time.Second
+	srv, addr := startServer(t, cfg)
+	code := "7-moss-9-hare"
+	dialRoom(t, addr, Handshake{Code: code, Role: "receiver"})
+	waitUntil(t, "the room exists", func() bool { return srv.roomExists(code) })
+	// Step the clock one interval at a time, each once the cleanup loop waits on it again
+	for range 3 {
+		waitUntil(t, "the cleanup loop waits", func() bool {
+			clock.mu.Lock()
+			defer clock.mu.Unlock()
+			return len(clock.waiters) > 0
+		})
+		clock.Advance(30 * time.Second)
+	}
+	waitUntil(t, "the abandoned room is cleaned up", func() bool { return !srv.roomExists(code) })
+}
@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Rendezvous probes are single UDP datagrams sent to the relay's port. The relay answers with
+// the address the probe came from, which is the client's public endpoint when it is behind a NAT.
+//
+//	probe: qshare-probe <nonce>, zero padded to ProbeSize
+//	reply: qshare-addr <nonce> <ip:port>
+//
+// Probes are padded so a reply is never larger than the probe that caused it, which keeps the
+// rendezvous port useless for amplifying spoofed traffic.
+const ProbeSize = 96
+
+// MaxNonceLen bounds the nonce, so a reply with the longest IPv6 address still fits in ProbeSize
+const MaxNonceLen = 16
+
+const (
+	probePrefix = "qshare-probe "
+	addrPrefix  = "qshare-addr "
+)
+
+// ProbeRequest returns a probe datagram carrying nonce
+func ProbeRequest(nonce string) []byte {
+	b := make([]byte, ProbeSize)
+	copy(b, probePrefix+nonce)
+	return b
+}
+
+// ParseProbe returns the nonce of a probe datagram, or false if b is not a probe
+func ParseProbe(b []byte) (string, bool) {
+	if len(b) < ProbeSize || !bytes.HasPrefix(b, []byte(probePrefix)) {
+		return "", false
+	}
+	nonce := string(bytes.TrimRight(b[len(probePrefix):], "\x00"))
+	if nonce == "" || len(nonce) > MaxNonceLen {
+		return "", false
+	}
+	return nonce, true
+}
+
+// ProbeReply returns the relay's answer to a probe with nonce that came from addr
+func ProbeReply(nonce string, addr net.Addr) []byte {
+	return []byte(addrPrefix + nonce + " " + addr.String())
+}
+
+// ParseProbeReply returns the nonce and observed address in a reply, or false if b is not one
+func ParseProbeReply(b []byte) (nonce, addr string, ok bool) {
+	rest, found := strings.CutPrefix(string(b), addrPrefix)
+	if !found {
+		return "", "", false
+	}
+	nonce, addr, ok = strings.Cut(rest, " ")
+	return nonce, addr, ok && nonce != "" && addr != ""
+}
+
+// ServeRendezvous answers UDP probes with the address they came from, so clients behind a NAT
+// learn their public endpoint and can punch a direct connection to each other. It returns
+// once pc is closed.
+func ServeRendezvous(pc net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if nonce, ok := ParseProbe(buf[:n]); ok {
+			pc.WriteTo(ProbeReply(nonce, addr), addr)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CounterStore is a key/value store of expiring counters, the only thing the limiters need.
+// A networked implementation lets several relays share limits.
+type CounterStore interface {
+	// Incr adds one to key and returns the new value. A new key starts at 1 and expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Add adds n, which may be negative, to key and returns the new value. A new key starts at
+	// n and expires after ttl.
+	Add(key string, n int64, ttl time.Duration) (int64, error)
+	// Get returns the current value of key, or 0 if it does not exist or has expired
+	Get(key string) (int64, error)
+}
+
+// MemoryStore is an in-process CounterStore. It stands in for the networked store in tests
+// and single-relay deployments.
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	now      func() time.Time
+}
+
+type counter struct {
+	n       int64
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]*counter), now: time.Now}
+}
+
+func (m *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	return m.Add(key, 1, ttl)
+}
+
+func (m *MemoryStore) Add(key string, n int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	c, ok := m.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &counter{expires: now.Add(ttl)}
+		m.counters[key] = c
+	}
+	c.n += n
+	return c.n, nil
+}
+
+func (m *MemoryStore) Get(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok || m.now().After(c.expires) {
+		return 0, nil
+	}
+	return c.n, nil
+}
+
+// Cleanup removes expired counters
+func (m *MemoryStore) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for key, c := range m.counters {
+		if now.After(c.expires) {
+			delete(m.counters, key)
+		}
+	}
+}
+
+// RESPStore is a CounterStore backed by a Redis compatible server, spoken to with the RESP protocol.
+// It keeps one connection and redials after errors.
+type RESPStore struct {
+	Addr    string
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func NewRESPStore(addr string) *RESPStore {
+	return &RESPStore{Addr: addr, Timeout: 2 * time.Second}
+}
+
+// incrScript increments a counter and sets its TTL only when it creates it. A script keeps the
+// two atomic without PEXPIRE NX, which needs Redis 7.
+const incrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+func (s *RESPStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.do([]string{"EVAL", incrScript, "1", key, strconv.FormatInt(ttl.Milliseconds(), 10)})
+	if err != nil {
+		return 0, err
+	}
+	return replies[0], nil
+}
+
+// addScript adds to a counter and sets its TTL only when it creates it. A counter that has come
+// back to 0 still exists, so checking the TTL is what tells a new one apart.
+const addScript = `local n = redis.call('INCRBY', KEYS[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) == -1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+func (s *RESPStore) Add(key string, n int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.do([]string{"EVAL", addScript, "1", key, strconv.FormatInt(ttl.Milliseconds(), 10), strconv.FormatInt(n, 10)})
+	if err != nil {
+		return 0, err
+	}
+	return replies[0], nil
+}
+
+func (s *RESPStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.do([]string{"GET", key})
+	if err != nil {
+		return 0, err
+	}
+	return replies[0], nil
+}
+
+// Close closes the connection to the server
+func (s *RESPStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// do sends the commands and reads one integer (or nil) reply per command. Caller holds s.mu.
+func (s *RESPStore) do(cmds ...[]string) ([]int64, error) {
+	replies, err := s.exec(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	ns := make([]int64, len(replies))
+	for i, r := range replies {
+		if r == "" {
+			continue // nil reply: key does not exist
+		}
+		if ns[i], err = strconv.ParseInt(r, 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected reply from store: %q", r)
+		}
+	}
+	return ns, nil
+}
+
+// exec sends the commands and reads one reply per command, "" for nil. Caller holds s.mu.
+func (s *RESPStore) exec(cmds ...[]string) ([]string, error) {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to store: %w", err)
+		}
+		s.conn = conn
+		s.r = bufio.NewReader(conn)
+	}
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	replies := make([]string, 0, len(cmds))
+	_, err := s.conn.Write([]byte(b.String()))
+	for i := 0; err == nil && i < len(cmds); i++ {
+		var r string
+		r, err = readRESP(s.r)
+		replies = append(replies, r)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	return replies, nil
+}
+
+// readRESP reads an integer, simple string, bulk string or nil reply, returning "" for nil
+func readRESP(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty reply from store")
+	}
+	switch line[0] {
+	case ':', '+':
+		return line[1:], nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return "", err // nil bulk string: key does not exist
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	case '-':
+		return "", fmt.Errorf("store error: %s", line[1:])
+	}
+	return "", fmt.Errorf("unexpected reply from store: %q", line)
+}
@@ -0,0 +1,232 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRESP is an in-process stand-in for a Redis compatible server. It understands GET and the
+// scripts RESPStore evaluates, run here in Go instead of Lua. Keys never expire.
+type fakeRESP struct {
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+	calls  []string
+}
+
+func startFakeRESP(t *testing.T) (*fakeRESP, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRESP{values: map[string]string{}, ttls: map[string]time.Duration{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRESP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		reply := f.run(args)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRESP) run(args []string) string {
+	f.calls = append(f.calls, args[0])
+	switch {
+	case args[0] == "GET" && len(args) == 2:
+		return bulk(f.values[args[1]], f.has(args[1]))
+	case args[0] == "EVAL" && len(args) >= 4:
+		script, keys := args[1], args[3:]
+		switch script {
+		case incrScript:
+			n, _ := strconv.ParseInt(f.values[keys[0]], 10, 64)
+			n++
+			f.values[keys[0]] = strconv.FormatInt(n, 10)
+			if n == 1 {
+				ms, _ := strconv.Atoi(keys[1])
+				f.ttls[keys[0]] = time.Duration(ms) * time.Millisecond
+			}
+			return fmt.Sprintf(":%d\r\n", n)
+		case addScript:
+			n, _ := strconv.ParseInt(f.values[keys[0]], 10, 64)
+			delta, _ := strconv.ParseInt(keys[2], 10, 64)
+			n += delta
+			f.values[keys[0]] = strconv.FormatInt(n, 10)
+			if _, ok := f.ttls[keys[0]]; !ok {
+				ms, _ := strconv.Atoi(keys[1])
+				f.ttls[keys[0]] = time.Duration(ms) * time.Millisecond
+			}
+			return fmt.Sprintf(":%d\r\n", n)
+		case claimScript:
+			if v, ok := f.values[keys[0]]; ok && v != keys[1] {
+				return bulk(v, true)
+			}
+			f.values[keys[0]] = keys[1]
+			ms, _ := strconv.Atoi(keys[2])
+			f.ttls[keys[0]] = time.Duration(ms) * time.Millisecond
+			return bulk(keys[1], true)
+		case releaseScript:
+			if v, ok := f.values[keys[0]]; ok && v == keys[1] {
+				delete(f.values, keys[0])
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		}
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRESP) has(key string) bool {
+	_, ok := f.values[key]
+	return ok
+}
+
+func bulk(s string, ok bool) string {
+	if !ok {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// readCommand reads one RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestMemoryStoreExpires(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewMemoryStore()
+	m.now = func() time.Time { return now }
+	for want := int64(1); want <= 3; want++ {
+		if n, _ := m.Incr("k", time.Minute); n != want {
+			t.Fatalf("Incr = %d, want %d", n, want)
+		}
+	}
+	// Increments do not push the expiry back
+	now = now.Add(61 * time.Second)
+	if n, _ := m.Get("k"); n != 0 {
+		t.Fatalf("Get after expiry = %d, want 0", n)
+	}
+	if n, _ := m.Incr("k", time.Minute); n != 1 {
+		t.Fatalf("Incr after expiry = %d, want 1", n)
+	}
+	now = now.Add(2 * time.Minute)
+	m.Cleanup()
+	if len(m.counters) != 0 {
+		t.Fatalf("Cleanup left %d expired counters", len(m.counters))
+	}
+}
+
+func TestRESPStoreIncrSetsTTLOnCreate(t *testing.T) {
+	fake, addr := startFakeRESP(t)
+	s := NewRESPStore(addr)
+	defer s.Close()
+	for want := int64(1); want <= 2; want++ {
+		n, err := s.Incr("qshare:ip:1.2.3.4", 1500*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("Incr = %d, want %d", n, want)
+		}
+	}
+	if n, err := s.Get("qshare:ip:1.2.3.4"); err != nil || n != 2 {
+		t.Fatalf("Get = %d, %v, want 2", n, err)
+	}
+	if n, err := s.Get("missing"); err != nil || n != 0 {
+		t.Fatalf("Get of a missing key = %d, %v, want 0", n, err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if ttl := fake.ttls["qshare:ip:1.2.3.4"]; ttl != 1500*time.Millisecond {
+		t.Fatalf("TTL = %v, want 1.5s", ttl)
+	}
+	for _, c := range fake.calls {
+		if c != "EVAL" && c != "GET" {
+			t.Fatalf("store sent %s, only EVAL and GET work on every server version", c)
+		}
+	}
+}
+
+func TestRESPStoreAdd(t *testing.T) {
+	fake, addr := startFakeRESP(t)
+	s := NewRESPStore(addr)
+	defer s.Close()
+	for _, step := range []struct{ add, want int64 }{{5, 5}, {-5, 0}, {3, 3}} {
+		if n, err := s.Add("qshare:token:t:bytes", step.add, time.Hour); err != nil || n != step.want {
+			t.Fatalf("Add(%d) = %d, %v, want %d", step.add, n, err, step.want)
+		}
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if ttl := fake.ttls["qshare:token:t:bytes"]; ttl != time.Hour {
+		t.Fatalf("TTL = %v, want 1h", ttl)
+	}
+}
+
+func TestRESPStoreRedialsAfterError(t *testing.T) {
+	_, addr := startFakeRESP(t)
+	s := NewRESPStore(addr)
+	defer s.Close()
+	if _, err := s.Incr("k", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	if _, err := s.Incr("k", time.Minute); err == nil {
+		t.Fatal("Incr on a closed connection succeeded")
+	}
+	if n, err := s.Incr("k", time.Minute); err != nil || n != 2 {
+		t.Fatalf("Incr after redial = %d, %v, want 2", n, err)
+	}
+}
@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenPrefix versions the token format
+const tokenPrefix = "qst1"
+
+// MinKeyLen is the shortest issuer or audit key accepted, in bytes
+const MinKeyLen = 16
+
+// Token grants a client use of a private relay. It is signed with the relay's issuer key and
+// expires, so whoever holds the key can hand tokens out without telling the relay.
+type Token struct {
+	// ID names the holder in relay logs
+	ID string `json:"id"`
+	// Expires is when the relay stops accepting the token, in unix seconds
+	Expires int64 `json:"exp"`
+	// MaxBytes caps the bytes the token's connections send through the relay, 0 for no cap
+	MaxBytes int64 `json:"bytes,omitempty"`
+	// MaxRooms caps how many codes the token may be in at once, 0 for no cap
+	MaxRooms int `json:"rooms,omitempty"`
+}
+
+var (
+	ErrTokenInvalid = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// IssueToken signs t with key. The result is safe to put in a handshake.
+func IssueToken(key []byte, t Token) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("error encoding token: %w", err)
+	}
+	body := tokenPrefix + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(signToken(key, body)), nil
+}
+
+// VerifyToken checks the signature and expiry of s and returns its claims
+func VerifyToken(key []byte, s string, now time.Time) (Token, error) {
+	body, sig, ok := cutLast(s, ".")
+	if !ok || !strings.HasPrefix(body, tokenPrefix+".") {
+		return Token{}, ErrTokenInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signToken(key, body)) {
+		return Token{}, ErrTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body[len(tokenPrefix)+1:])
+	if err != nil {
+		return Token{}, ErrTokenInvalid
+	}
+	var t Token
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return Token{}, ErrTokenInvalid
+	}
+	if now.Unix() >= t.Expires {
+		return t, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// ReadKeyFile reads a hex encoded key of at least MinKeyLen bytes from path
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("key in %s is not hex: %w", path, err)
+	}
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("key in %s is shorter than %d bytes", path, MinKeyLen)
+	}
+	return key, nil
+}
+
+func signToken(key []byte, body string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTokenKey = []byte("0123456789abcdef0123456789abcdef")
+
+// issue signs t with testTokenKey
+func issue(t *testing.T, tok Token) string {
+	t.Helper()
+	str, err := IssueToken(testTokenKey, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return str
+}
+
+// tokenServer starts a relay that requires tokens signed with testTokenKey and keeps their
+// usage in usage
+func tokenServer(t *testing.T, usage CounterStore) (*Server, string) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.TokenKey, cfg.TokenUsage = testTokenKey, usage
+	return startServer(t, cfg)
+}
+
+// join connects to addr as role under code with token, returning the relay's refusal if any
+func join(t *testing.T, addr, code, role, token string) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientHandshake(conn, Handshake{Code: code, Role: role, Options: map[string]string{OptToken: token}}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, nil
+}
+
+// wantRefused fails unless joining is refused with an error containing reason
+func wantRefused(t *testing.T, addr, code, role, token, reason string) {
+	t.Helper()
+	if conn, err := join(t, addr, code, role, token); err == nil || !strings.Contains(err.Error(), reason) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("join = %v, want it refused with %q", err, reason)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	good := issue(t, Token{ID: "ci", Expires: now.Unix() + 60, MaxBytes: 10})
+	if tok, err := VerifyToken(testTokenKey, good, now); err != nil || tok.ID != "ci" || tok.MaxBytes != 10 {
+		t.Fatalf("VerifyToken = %+v, %v", tok, err)
+	}
+
+	other, err := IssueToken([]byte("another issuer's key, not ours.."), Token{ID: "ci", Expires: now.Unix() + 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig, _ := cutLast(good, ".")
+	// The same signature over claims that grant more
+	raised, err := IssueToken(testTokenKey, Token{ID: "ci", Expires: now.Unix() + 60, MaxBytes: 1 << 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raisedBody, _, _ := cutLast(raised, ".")
+	for name, str := range map[string]string{
+		"other key":      other,
+		"claims changed": raisedBody + "." + sig,
+		"no signature":   body,
+		"bad base64":     body + ".!!!",
+		"wrong prefix":   "qst0" + good[len(tokenPrefix):],
+		"empty":          "",
+	} {
+		if _, err := VerifyToken(testTokenKey, str, now); !errors.Is(err, ErrTokenInvalid) {
+			t.Errorf("%s: VerifyToken = %v, want ErrTokenInvalid", name, err)
+		}
+	}
+
+	if _, err := VerifyToken(testTokenKey, good, now.Add(time.Minute)); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("VerifyToken at expiry = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestServerRefusesBadTokens(t *testing.T) {
+	_, addr := tokenServer(t, nil)
+	code := "4-oak-8-hare"
+	wantRefused(t, addr, code, "sender", "", "requires a token")
+	other, err := IssueToken([]byte("another issuer's key, not ours.."), Token{Expires: time.Now().Unix() + 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRefused(t, addr, code, "sender", other, ErrTokenInvalid.Error())
+	wantRefused(t, addr, code, "sender", issue(t, Token{Expires: time.Now().Unix() - 1}), ErrTokenExpired.Error())
+}
+
+func TestTokenRoomsCapped(t *testing.T) {
+	_, addr := tokenServer(t, nil)
+	token := issue(t, Token{Expires: time.Now().Add(time.Hour).Unix(), MaxRooms: 1})
+	sender, err := join(t, addr, "1-elm-2-mole", "sender", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Its own room is in scope, any other is not
+	receiver, err := join(t, addr, "1-elm-2-mole", "receiver", token)
+	if err != nil {
+		t.Fatalf("second side of the token's room: %v", err)
+	}
+	wantRefused(t, addr, "3-ash-4-vole", "sender", token, "at most 1 rooms")
+
+	// Once the room ends the token may go elsewhere
+	sender.Close()
+	receiver.Close()
+	waitUntil(t, "the token may join another room", func() bool {
+		conn, err := join(t, addr, "3-ash-4-vole", "sender", token)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+}
+
+// useBytes sends n bytes from a sender with token to a receiver with token through addr
+func useBytes(t *testing.T, addr, code, token string, n int) {
+	t.Helper()
+	sender, err := join(t, addr, code, "sender", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := join(t, addr, code, "receiver", token); err != nil {
+		t.Fatal(err)
+	}
+	sender.Write(bytes.Repeat([]byte("x"), n))
+}
+
+// waitRefused waits until joining with token is refused with an error containing reason
+func waitRefused(t *testing.T, addr, code, token, reason string) {
+	t.Helper()
+	waitUntil(t, "the token is refused", func() bool {
+		conn, err := join(t, addr, code, "sender", token)
+		if conn != nil {
+			conn.Close()
+		}
+		return err != nil && strings.Contains(err.Error(), reason)
+	})
+}
+
+func TestTokenByteQuota(t *testing.T) {
+	_, addr := tokenServer(t, nil)
+	token := issue(t, Token{ID: "used", Expires: time.Now().Add(time.Hour).Unix(), MaxBytes: 1000})
+	useBytes(t, addr, "5-fir-6-wolf", token, 4000)
+	waitRefused(t, addr, "7-yew-8-lynx", token, errQuotaBytes.Error())
+	// Tokens are counted apart
+	if _, err := join(t, addr, "7-yew-8-lynx", "sender", issue(t, Token{ID: "fresh", Expires: time.Now().Add(time.Hour).Unix(), MaxBytes: 1000})); err != nil {
+		t.Fatalf("fresh token: %v", err)
+	}
+}
+
+func TestTokenQuotasSharedThroughStore(t *testing.T) {
+	// Two relays on one Redis compatible store, as in a cluster or across a restart
+	_, storeAddr := startFakeRESP(t)
+	storeA, storeB := NewRESPStore(storeAddr), NewRESPStore(storeAddr)
+	defer storeA.Close()
+	defer storeB.Close()
+	srvA, addrA := tokenServer(t, storeA)
+	_, addrB := tokenServer(t, storeB)
+
+	rooms := issue(t, Token{ID: "rooms", Expires: time.Now().Add(time.Hour).Unix(), MaxRooms: 1})
+	if _, err := join(t, addrA, "2-bay-9-toad", "sender", rooms); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the room exists", func() bool { return srvA.roomExists("2-bay-9-toad") })
+	wantRefused(t, addrB, "6-box-1-crab", "sender", rooms, "at most 1 rooms")
+
+	usage := issue(t, Token{ID: "bytes", Expires: time.Now().Add(time.Hour).Unix(), MaxBytes: 1000})
+	useBytes(t, addrA, "8-fig-3-seal", usage, 4000)
+	waitRefused(t, addrB, "9-elm-5-orca", usage, errQuotaBytes.Error())
+}
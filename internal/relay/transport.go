@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Transport carries client connections to and from a relay. Every transport hands out plain
+// net.Conn and net.Listener values, so room matching and piping work the same over all of
+// them. A transport whose connections support half-closing exposes CloseWrite() error.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"tcp":  tcpTransport{},
+		"tls":  TLSTransport{},
+		"quic": QUICTransport{},
+	}
+)
+
+// RegisterTransport makes t available for relay URLs with the given scheme
+func RegisterTransport(scheme string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[scheme] = t
+}
+
+// ParseRelayURL splits a relay URL like quic://relay.example.com:4000 into its scheme and
+// address. A bare host:port means tcp.
+func ParseRelayURL(url string) (scheme, addr string, err error) {
+	scheme, addr, ok := strings.Cut(url, "://")
+	if !ok {
+		scheme, addr = "tcp", url
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("invalid relay address %q", url)
+	}
+	return scheme, addr, nil
+}
+
+func transportFor(url string) (Transport, string, error) {
+	scheme, addr, err := ParseRelayURL(url)
+	if err != nil {
+		return nil, "", err
+	}
+	transportsMu.RLock()
+	t, ok := transports[scheme]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("unknown relay transport %q", scheme)
+	}
+	return t, addr, nil
+}
+
+// Dial connects to the relay at url using the transport named by its scheme
+func Dial(url string) (net.Conn, error) {
+	t, addr, err := transportFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(addr)
+}
+
+// Listen listens on url using the transport named by its scheme, e.g. tcp://:4000
+func Listen(url string) (net.Listener, error) {
+	t, addr, err := transportFor(url)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(addr)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// TLSTransport carries connections over TLS, e.g. to a relay behind a TLS terminating proxy.
+// A nil Config verifies relays against the system CAs; listening needs one with a certificate.
+type TLSTransport struct {
+	Config *tls.Config
+}
+
+func (t TLSTransport) Dial(addr string) (net.Conn, error) {
+	return tls.Dial("tcp", addr, t.Config)
+}
+
+func (t TLSTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.Config)
+}
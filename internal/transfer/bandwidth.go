@@ -0,0 +1,229 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+// Bandwidth is a token bucket limiting throughput to a number of bytes per second.
+// It is safe for concurrent use, so one Bandwidth can cap several streams together.
+// A nil *Bandwidth does not limit anything.
+type Bandwidth struct {
+	rate  float64 // bytes per second
+	burst float64 // largest amount that may pass without waiting
+	chunk int     // largest single read or write, so waits stay short and smooth
+
+	clock clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// clock is where a Bandwidth tells and waits out time, so tests can fake it
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewBandwidth returns a limiter for bytesPerSec, or nil for no limit if bytesPerSec <= 0
+func NewBandwidth(bytesPerSec int64) *Bandwidth {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSec)
+	// Allow a tenth of a second of burst, but never less than a few frames
+	burst := max(rate/10, 16*1024)
+	return &Bandwidth{rate: rate, burst: burst, chunk: int(burst), clock: systemClock{}, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes may pass. Bytes beyond the burst are borrowed from the future,
+// so callers should keep n at or below the chunk size.
+func (b *Bandwidth) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	b.clock.Sleep(wait)
+}
+
+func (b *Bandwidth) chunkSize(n int) int {
+	if b == nil {
+		return n
+	}
+	return min(n, b.chunk)
+}
+
+// LimitReader returns a reader that reads from r no faster than all of limits allow
+func LimitReader(r io.Reader, limits ...*Bandwidth) io.Reader {
+	return &limitedReader{r: r, limits: limits}
+}
+
+type limitedReader struct {
+	r      io.Reader
+	limits []*Bandwidth
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	for _, b := range l.limits {
+		p = p[:b.chunkSize(len(p))]
+	}
+	n, err := l.r.Read(p)
+	for _, b := range l.limits {
+		b.Wait(n)
+	}
+	return n, err
+}
+
+// LimitWriter returns a writer that writes to w no faster than all of limits allow
+func LimitWriter(w io.Writer, limits ...*Bandwidth) io.Writer {
+	return &limitedWriter{w: w, limits: limits}
+}
+
+type limitedWriter struct {
+	w      io.Writer
+	limits []*Bandwidth
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, b := range l.limits {
+			n = b.chunkSize(n)
+		}
+		for _, b := range l.limits {
+			b.Wait(n)
+		}
+		n, err := l.w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// LimitConn limits reads on conn by read and writes by write. Limiters may be shared between
+// connections to cap them together. Returns conn unchanged if both are nil.
+func LimitConn(conn net.Conn, read, write *Bandwidth) net.Conn {
+	if read == nil && write == nil {
+		return conn
+	}
+	return &limitedConn{
+		Conn: conn,
+		r:    LimitReader(conn, read),
+		w:    LimitWriter(conn, write),
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *limitedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *limitedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ParseRate parses a bandwidth like "5MB/s", "500KB/s", "1.5MiB" or "1000000" in bytes per second,
+// or like "100Mbps" or "20kbit/s" in bits per second, with a lowercase b.
+// KB, MB, GB and TB are powers of 1000, KiB, MiB, GiB and TiB powers of 1024. "" and "0" mean no limit.
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	bits := false
+	for _, suffix := range []string{"bps", "bit/s"} {
+		if strings.HasSuffix(v, suffix) {
+			v, bits = strings.TrimSuffix(v, suffix), true
+			break
+		}
+	}
+	if !bits {
+		v = strings.TrimSuffix(strings.TrimSuffix(v, "/s"), "ps")
+	}
+	n, err := ParseSize(v)
+	if err != nil || bits && strings.HasSuffix(strings.ToLower(strings.TrimSpace(v)), "b") {
+		return 0, fmt.Errorf("invalid rate %q (e.g. 5MB/s or 40Mbps)", s)
+	}
+	if bits {
+		if n > 0 && n < 8 {
+			return 0, fmt.Errorf("invalid rate %q: less than a byte per second", s)
+		}
+		n /= 8
+	}
+	return n, nil
+}
+
+// ParseSize parses a byte count like "10GB", "500MiB" or "1000000", with the units of ParseRate.
+// "" is 0.
+func ParseSize(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	if v == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+		{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"t", 1e12},
+		{"b", 1},
+	}
+	mult := 1.0
+	lower := strings.ToLower(v)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			mult = u.mult
+			v = strings.TrimSpace(v[:len(v)-len(u.suffix)])
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	// ParseFloat accepts "inf" and "nan", and a product past MaxInt64 would wrap when converted
+	if err != nil || n < 0 || math.IsNaN(n) || n*mult >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 10GB)", s)
+	}
+	return int64(n * mult), nil
+}
+
+// RelayUnits lets a relay parse its limit flags and throttle with this package, see relay.Flags
+var RelayUnits = relay.Units{
+	ParseRate: ParseRate,
+	ParseSize: ParseSize,
+	Throttle: func(rate int64) relay.Throttle {
+		b := NewBandwidth(rate)
+		return func(r io.Reader) io.Reader { return LimitReader(r, b) }
+	},
+}
@@ -0,0 +1,189 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		bad  bool
+	}{
+		{in: "", want: 0},
+		{in: "1000000", want: 1000000},
+		{in: "10GB", want: 10e9},
+		{in: "500MiB", want: 500 << 20},
+		{in: "1.5k", want: 1500},
+		{in: " 2 tb ", want: 2e12},
+		{in: "3TiB", want: 3 << 40},
+		{in: "1t", want: 1e12},
+		{in: "-1MB", bad: true},
+		{in: "ten", bad: true},
+		{in: "inf", bad: true},
+		{in: "+InfGB", bad: true},
+		{in: "NaN", bad: true},
+		{in: "1e30TB", bad: true},
+	} {
+		got, err := ParseSize(tt.in)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for in, want := range map[string]int64{
+		"5MB/s":    5e6,
+		"1TBps":    1e12,
+		"2MiBps":   2 << 20,
+		"0":        0,
+		"5Mbps":    625e3,
+		"100 Mbps": 125e5,
+		"8bps":     1,
+		"20kbit/s": 2500,
+		"1Mbit/s":  125e3,
+		"0bps":     0,
+	} {
+		if got, err := ParseRate(in); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"fast", "5MBbps", "4bps", "-1Mbps"} {
+		if got, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+// fakeClock only moves when something sleeps on it
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// elapsed is how far the clock has moved since start
+func (c *fakeClock) elapsed(start time.Time) time.Duration {
+	return c.Now().Sub(start)
+}
+
+// fakeBandwidth returns a limiter for bytesPerSec that waits on clock
+func fakeBandwidth(bytesPerSec int64, clock *fakeClock) *Bandwidth {
+	b := NewBandwidth(bytesPerSec)
+	b.clock, b.last = clock, clock.Now()
+	return b
+}
+
+// checkElapsed fails unless got is within a millisecond of want
+func checkElapsed(t *testing.T, got, want time.Duration) {
+	t.Helper()
+	if got < want-time.Millisecond || got > want+time.Millisecond {
+		t.Fatalf("took %v, want %v", got, want)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	start := clock.Now()
+	// A tenth of a second of burst: 100kB
+	b := fakeBandwidth(1e6, clock)
+	b.Wait(100e3)
+	checkElapsed(t, clock.elapsed(start), 0)
+	b.Wait(50e3)
+	checkElapsed(t, clock.elapsed(start), 50*time.Millisecond)
+	for range 19 {
+		b.Wait(50e3)
+	}
+	checkElapsed(t, clock.elapsed(start), time.Second)
+
+	// Idle time refills the bucket, but only up to the burst
+	clock.Sleep(time.Hour)
+	start = clock.Now()
+	b.Wait(100e3)
+	checkElapsed(t, clock.elapsed(start), 0)
+	b.Wait(100e3)
+	checkElapsed(t, clock.elapsed(start), 100*time.Millisecond)
+
+	var none *Bandwidth
+	none.Wait(1 << 30)
+	if none.chunkSize(1<<30) != 1<<30 {
+		t.Fatal("nil Bandwidth limits the chunk size")
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	start := clock.Now()
+	data := bytes.Repeat([]byte("x"), 3e6)
+	b := fakeBandwidth(1e6, clock)
+	r := LimitReader(bytes.NewReader(data), b)
+	buf := make([]byte, 1<<20)
+	total := 0
+	for {
+		n, err := r.Read(buf)
+		if n > b.chunk {
+			t.Fatalf("read %d bytes at once, more than the %d chunk", n, b.chunk)
+		}
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != len(data) {
+		t.Fatalf("read %d bytes, want %d", total, len(data))
+	}
+	// Everything past the burst goes at the rate
+	checkElapsed(t, clock.elapsed(start), 2900*time.Millisecond)
+}
+
+func TestLimitWriter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	start := clock.Now()
+	fast := fakeBandwidth(4e6, clock)
+	slow := fakeBandwidth(1e6, clock)
+	var got bytes.Buffer
+	// The slower of the two limits wins
+	w := LimitWriter(&got, fast, slow)
+	if n, err := w.Write(make([]byte, 2e6)); err != nil || n != 2e6 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if got.Len() != 2e6 {
+		t.Fatalf("wrote %d bytes through", got.Len())
+	}
+	checkElapsed(t, clock.elapsed(start), 1900*time.Millisecond)
+
+	// Writers sharing a limit are capped together
+	clock.Sleep(time.Hour)
+	start = clock.Now()
+	a, b := LimitWriter(io.Discard, slow), LimitWriter(io.Discard, slow)
+	for range 10 {
+		a.Write(make([]byte, 100e3))
+		b.Write(make([]byte, 100e3))
+	}
+	checkElapsed(t, clock.elapsed(start), 1900*time.Millisecond)
+}
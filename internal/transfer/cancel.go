@@ -0,0 +1,52 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCancelled is returned when the local side cancelled the transfer
+var ErrCancelled = errors.New("transfer cancelled")
+
+// cancelReason is the reset reason sent in-band when a user cancels, so the peer can tell
+// a deliberate cancel apart from a broken connection
+const cancelReason = "cancelled"
+
+// cancelLinger is how long a side that cancelled waits for the peer to hang up, so the reset
+// reaches the peer before the connection closes under it
+const cancelLinger = 2 * time.Second
+
+// cancelOnDone resets s with the cancel reason if ctx is cancelled before the returned stop is called
+func cancelOnDone(ctx context.Context, s *Stream) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { s.Reset(cancelReason) })
+}
+
+// describeCancel turns stream errors caused by a cancel into clear messages.
+// peer names the other side ("sender" or "receiver").
+func describeCancel(ctx context.Context, err error, peer string) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ErrCancelled
+	}
+	var reset *StreamResetError
+	if errors.As(err, &reset) && reset.Reason == cancelReason {
+		return fmt.Errorf("%s cancelled the transfer", peer)
+	}
+	return err
+}
+
+// lingerAfterCancel waits for the peer to hang up on m if err is this side's cancel
+func lingerAfterCancel(m *Mux, err error) {
+	// Nobody reads a write-only stream's resets, and a read-only one cannot send any
+	if !errors.Is(err, ErrCancelled) || m.cfg.WriteOnly || m.cfg.ReadOnly {
+		return
+	}
+	select {
+	case <-m.Done():
+	case <-time.After(cancelLinger):
+	}
+}
@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+)
+
+// waitPartial waits until some of the file has reached the partial file in dir
+func waitPartial(t *testing.T, dir string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.qshare-partial"))
+		if len(matches) == 1 {
+			if info, err := os.Stat(matches[0]); err == nil && info.Size() > 0 {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transfer did not get under way")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCancelPartway(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload")
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		// cancel stops the transfer from one side, given the contexts and connections of both.
+		// Each side then fails with ErrCancelled or an error containing sendErr or recvErr.
+		cancel        func(sendCancel, recvCancel context.CancelFunc, sconn, rconn net.Conn)
+		sendErr       string
+		recvErr       string
+		sendCancelled bool
+		recvCancelled bool
+	}{
+		{
+			name:          "sender cancels",
+			cancel:        func(sc, rc context.CancelFunc, s, r net.Conn) { sc() },
+			sendCancelled: true,
+			recvErr:       "sender cancelled the transfer",
+		},
+		{
+			name:          "receiver cancels",
+			cancel:        func(sc, rc context.CancelFunc, s, r net.Conn) { rc() },
+			sendErr:       "receiver cancelled the transfer",
+			recvCancelled: true,
+		},
+		{
+			// Neither side may take that for a cancel
+			name:   "connection drops",
+			cancel: func(sc, rc context.CancelFunc, s, r net.Conn) { s.Close() },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := crypto.DeriveKey("2-date-6-vole", "")
+			sconn, rconn := net.Pipe()
+			// Slow enough to be caught partway
+			slow := LimitConn(sconn, nil, NewBandwidth(2<<20))
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+			rctx, rcancel := context.WithCancel(context.Background())
+			defer rcancel()
+			out := t.TempDir()
+			received := make(chan error, 1)
+			go func() {
+				m := NewMux(rconn, key, false, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+				defer m.Close()
+				_, _, err := ReceiveAndDecryptFile(rctx, m, filepath.Join(out, "payload"), ReceiveOptions{}, nil)
+				received <- err
+			}()
+			sent := make(chan error, 1)
+			go func() {
+				m := NewMux(slow, key, true, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+				defer m.Close()
+				_, err := SendEncryptedFile(sctx, m, path, SendOptions{Compression: CompressNone}, nil)
+				sent <- err
+			}()
+			waitPartial(t, out)
+			tt.cancel(scancel, rcancel, sconn, rconn)
+
+			for _, side := range []struct {
+				name      string
+				errs      chan error
+				cancelled bool
+				want      string
+			}{{"sender", sent, tt.sendCancelled, tt.sendErr}, {"receiver", received, tt.recvCancelled, tt.recvErr}} {
+				select {
+				case err := <-side.errs:
+					switch {
+					case side.cancelled && !errors.Is(err, ErrCancelled):
+						t.Errorf("%s: %v, want ErrCancelled", side.name, err)
+					case !side.cancelled && (err == nil || !strings.Contains(err.Error(), side.want)):
+						t.Errorf("%s: %v, want an error containing %q", side.name, err, side.want)
+					case !side.cancelled && side.want == "" && strings.Contains(err.Error(), "cancel"):
+						t.Errorf("%s: %v, want an error that is not a cancel", side.name, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s did not stop", side.name)
+				}
+			}
+			if left, _ := os.ReadDir(out); len(left) != 0 {
+				t.Fatalf("%d files left in the output dir, first %s", len(left), left[0].Name())
+			}
+		})
+	}
+}
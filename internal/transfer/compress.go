@@ -0,0 +1,322 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression modes for --compress. Data is compressed before encryption, since ciphertext
+// does not compress.
+const (
+	CompressAuto = "auto"
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// decoders lists the algorithms this build can decompress, advertised to senders with CtrlCaps.
+// Auto mode picks the first one the receiver also has.
+var decoders = []string{CompressZstd, CompressGzip}
+
+const (
+	// compressSample is how much of a file auto mode compresses to decide if it is worth it
+	compressSample = 128 * 1024
+	// compressMinSize skips compression for files too small to benefit
+	compressMinSize = 1024
+	// compressMaxRatio is the compressed/original ratio of the sample above which auto gives up
+	compressMaxRatio = 0.9
+	// zstdMaxWindow bounds the memory a zstd stream from the peer can make the receiver allocate
+	zstdMaxWindow = 64 << 20
+)
+
+// CheckCompression validates a --compress value before connecting
+func CheckCompression(mode string) error {
+	switch mode {
+	case CompressAuto, CompressNone, CompressGzip, CompressZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (want auto, none, zstd or gzip)", mode)
+}
+
+// chooseCompression picks the algorithm for a file of size bytes given the requested mode
+// and the algorithms the receiver can decode.
+func chooseCompression(mode string, file io.ReaderAt, size int64, supported []string) (string, error) {
+	if mode == "" {
+		return CompressNone, nil
+	}
+	if err := CheckCompression(mode); err != nil {
+		return "", err
+	}
+	switch mode {
+	case CompressGzip, CompressZstd:
+		if !contains(supported, mode) {
+			return "", fmt.Errorf("receiver cannot decompress %s", mode)
+		}
+		return mode, nil
+	case CompressAuto:
+		algo := CompressNone
+		for _, d := range decoders {
+			if contains(supported, d) {
+				algo = d
+				break
+			}
+		}
+		if algo == CompressNone || size < compressMinSize || !compressible(file, size) {
+			return CompressNone, nil
+		}
+		return algo, nil
+	}
+	return CompressNone, nil
+}
+
+// compressible compresses a sample from the start of the file and reports whether it shrank
+// enough, so already compressed media and archives are sent as is.
+func compressible(file io.ReaderAt, size int64) bool {
+	sample := make([]byte, min(size, compressSample))
+	n, err := file.ReadAt(sample, 0)
+	if n == 0 || (err != nil && err != io.EOF) {
+		return false
+	}
+	var out bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&out, gzip.BestSpeed)
+	zw.Write(sample[:n])
+	zw.Close()
+	return float64(out.Len()) < float64(n)*compressMaxRatio
+}
+
+// compressWriter wraps w so the file body is compressed with algo. Close must be called
+// after the body to flush it, before anything else is written to w.
+func compressWriter(w io.Writer, algo string) (io.WriteCloser, error) {
+	switch algo {
+	case "", CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		zw, err := zstd.NewWriter(chunkWriter{w})
+		if err != nil {
+			return nil, fmt.Errorf("error starting compression: %w", err)
+		}
+		return &zstdWriter{Encoder: zw, w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algo)
+}
+
+// decompressReader returns a reader for a file body compressed with algo. r must be a
+// bufio.Reader so the decompressor does not read past the body into the trailer.
+// The returned func reads the rest of the compressed body so r is left at the trailer.
+func decompressReader(r *bufio.Reader, algo string) (io.Reader, func() error, error) {
+	switch algo {
+	case "", CompressNone:
+		return r, func() error { return nil }, nil
+	case CompressGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading compressed data: %w", err)
+		}
+		zr.Multistream(false)
+		finish := func() error {
+			if _, err := io.Copy(io.Discard, zr); err != nil {
+				return fmt.Errorf("error reading compressed data: %w", err)
+			}
+			return nil
+		}
+		return zr, finish, nil
+	case CompressZstd:
+		// Decoding on the caller's goroutine means nothing is left running if the body is abandoned
+		zr, err := zstd.NewReader(&chunkReader{r: r}, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading compressed data: %w", err)
+		}
+		finish := func() error {
+			defer zr.Close()
+			if _, err := io.Copy(io.Discard, zr); err != nil {
+				return fmt.Errorf("error reading compressed data: %w", err)
+			}
+			return nil
+		}
+		return zr, finish, nil
+	}
+	return nil, nil, fmt.Errorf("unknown compression %q", algo)
+}
+
+// maxStripeWire bounds a compressed stripe from the peer, well above what a stripe compresses to
+// even when it does not compress at all
+const maxStripeWire = 2 * stripeSize
+
+var (
+	stripeCodecOnce sync.Once
+	stripeEncoder   *zstd.Encoder
+	stripeDecoder   *zstd.Decoder
+)
+
+// stripeCodec returns the zstd encoder and decoder shared by all stripes, both are safe for
+// concurrent use by whole-buffer calls
+func stripeCodec() (*zstd.Encoder, *zstd.Decoder) {
+	stripeCodecOnce.Do(func() {
+		stripeEncoder, _ = zstd.NewWriter(nil)
+		stripeDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(stripeSize), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+	})
+	return stripeEncoder, stripeDecoder
+}
+
+// compressStripe compresses one stripe on its own with algo, so stripes can be decompressed in
+// any order
+func compressStripe(algo string, data []byte) ([]byte, error) {
+	switch algo {
+	case "", CompressNone:
+		return data, nil
+	case CompressGzip:
+		var out bytes.Buffer
+		zw := gzip.NewWriter(&out)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing chunk: %w", err)
+		}
+		return out.Bytes(), nil
+	case CompressZstd:
+		enc, _ := stripeCodec()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algo)
+}
+
+// decompressStripe undoes compressStripe, failing if the result would be larger than a stripe
+func decompressStripe(algo string, data []byte) ([]byte, error) {
+	switch algo {
+	case "", CompressNone:
+		return data, nil
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error reading compressed chunk: %w", err)
+		}
+		zr.Multistream(false)
+		plain, err := io.ReadAll(io.LimitReader(zr, stripeSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("error reading compressed chunk: %w", err)
+		}
+		if len(plain) > stripeSize {
+			return nil, fmt.Errorf("compressed chunk expands past %d bytes", stripeSize)
+		}
+		return plain, nil
+	case CompressZstd:
+		_, dec := stripeCodec()
+		plain, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading compressed chunk: %w", err)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algo)
+}
+
+// parseCaps reads the algorithm list from a CtrlCaps body
+func parseCaps(body []byte) []string {
+	if len(body) == 0 {
+		return nil
+	}
+	return strings.Split(string(body), ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// zstdWriter compresses into length prefixed chunks. The zstd decoder reads on past the end of a
+// frame looking for the next one, so the body is chunked and ends with an empty chunk, which
+// lets the receiver stop exactly at the trailer.
+type zstdWriter struct {
+	*zstd.Encoder
+	w io.Writer
+}
+
+func (z *zstdWriter) Close() error {
+	if err := z.Encoder.Close(); err != nil {
+		return err
+	}
+	_, err := z.w.Write(make([]byte, 4))
+	return err
+}
+
+// chunkWriter writes each buffer as a 4 byte big endian length followed by the data
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// chunkReader reads what chunkWriter wrote, returning io.EOF at the empty chunk
+type chunkReader struct {
+	r    io.Reader
+	left uint32
+	done bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		if c.left = binary.BigEndian.Uint32(hdr[:]); c.left == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+	n, err := c.r.Read(p[:min(len(p), int(c.left))])
+	c.left -= uint32(n)
+	return n, noEOF(err)
+}
+
+// noEOF turns a plain io.EOF into io.ErrUnexpectedEOF, for streams that end before their terminator
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTripStopsAtTrailer(t *testing.T) {
+	body := []byte(strings.Repeat("qshare compresses before it encrypts. ", 4096))
+	for _, algo := range []string{CompressNone, CompressGzip, CompressZstd} {
+		t.Run(algo, func(t *testing.T) {
+			var wire bytes.Buffer
+			w, err := compressWriter(&wire, algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(body); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if algo != CompressNone && wire.Len() >= len(body) {
+				t.Fatalf("%d bytes compressed to %d", len(body), wire.Len())
+			}
+			wire.WriteString("TRAILER")
+			r := bufio.NewReader(&wire)
+			zr, finish, err := decompressReader(r, algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(body))
+			if _, err := io.ReadFull(zr, got); err != nil || !bytes.Equal(got, body) {
+				t.Fatalf("body did not round trip: %v", err)
+			}
+			if algo == CompressNone {
+				return
+			}
+			if err := finish(); err != nil {
+				t.Fatal(err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "TRAILER" {
+				t.Fatalf("left %q after the body, want the trailer", rest)
+			}
+		})
+	}
+}
+
+func TestZstdTruncatedBody(t *testing.T) {
+	var wire bytes.Buffer
+	w, _ := compressWriter(&wire, CompressZstd)
+	w.Write(bytes.Repeat([]byte("abc"), 10000))
+	w.Close()
+	cut := wire.Bytes()[:wire.Len()/2]
+	zr, _, err := decompressReader(bufio.NewReader(bytes.NewReader(cut)), CompressZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(zr); err == nil {
+		t.Fatal("truncated body read without error")
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	text := strings.NewReader(strings.Repeat("a", 64*1024))
+	for _, tt := range []struct {
+		mode      string
+		supported []string
+		want      string
+	}{
+		{CompressAuto, []string{CompressZstd, CompressGzip}, CompressZstd},
+		// Receivers from before zstd only announce gzip
+		{CompressAuto, []string{CompressGzip}, CompressGzip},
+		{CompressAuto, nil, CompressNone},
+		{CompressGzip, []string{CompressZstd, CompressGzip}, CompressGzip},
+		{CompressZstd, []string{CompressGzip}, ""},
+		{CompressNone, []string{CompressZstd}, CompressNone},
+	} {
+		got, err := chooseCompression(tt.mode, text, text.Size(), tt.supported)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("chooseCompression(%s, %v) = %s, want an error", tt.mode, tt.supported, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("chooseCompression(%s, %v) = %s, %v, want %s", tt.mode, tt.supported, got, err, tt.want)
+		}
+	}
+}
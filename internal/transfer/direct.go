@@ -0,0 +1,118 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Direct opens a connection straight to the peer that bypasses the relay, see internal/direct
+type Direct interface {
+	// Candidates lists the addresses the peer can try to reach this side at
+	Candidates() []string
+	// Connect punches through to the peer at one of its candidates. Both sides call it at about
+	// the same time, the sender as initiator.
+	Connect(peer []string, initiator bool) (io.ReadWriteCloser, error)
+}
+
+// openDirect connects to the peer and multiplexes the connection under its own key
+func openDirect(m *Mux, direct Direct, peer []string, initiator bool) (*Mux, error) {
+	conn, err := direct.Connect(peer, initiator)
+	if err != nil {
+		return nil, err
+	}
+	// Extra connections are numbered from 1, so 0 is free for the direct one
+	return NewMux(conn, connKey(m.key, 0), initiator, m.encrypt, m.decrypt, MuxConfig{Window: m.cfg.Window}), nil
+}
+
+// sendDirect sends file as stripes over a direct connection to the receiver, or over s if hole
+// punching fails. Each stripe is compressed on its own with an algorithm from supported. The
+// header, trailer and ack always travel on s. Waits for the receiver's ack.
+func sendDirect(m *Mux, s *Stream, file *os.File, name string, size int64, opts SendOptions, peer, supported []string, progress func(int), onPause func(bool)) (SendResult, error) {
+	res := SendResult{Size: size}
+	algo, err := chooseCompression(opts.Compression, file, size, supported)
+	if err != nil {
+		s.Reset("sender could not agree on compression")
+		return res, err
+	}
+	res.Compression = algo
+	if err := writeHeader(s, fileHeader{Name: name, Size: size, Compression: algo, Direct: opts.Direct.Candidates()}); err != nil {
+		return res, err
+	}
+	hasher, hashed := hashFile(file, size)
+	finished := make(chan struct{})
+	defer close(finished)
+	data := s
+	if dm, err := openDirect(m, opts.Direct, peer, true); err == nil {
+		go closeWith(s, finished, []*Mux{dm})
+		if ds, err := dm.OpenStream(); err == nil {
+			data = ds
+			res.Direct = true
+		} else {
+			slog.Info("Direct stream failed, sending through the relay", "err", err)
+		}
+	} else {
+		slog.Info("Direct connection failed, sending through the relay", "err", err)
+	}
+	res.WireSize, err = sendStripes(data, file, size, 0, 1, algo, opts.Pause, progress, onPause)
+	if err != nil {
+		if s.Err() == nil {
+			s.Reset("sender could not send every chunk")
+		}
+		return res, err
+	}
+	if data != s {
+		if err := data.Close(); err != nil {
+			return res, fmt.Errorf("error finishing stream: %w", err)
+		}
+	}
+	res.Digest, err = finishStripes(s, hasher, hashed)
+	return res, err
+}
+
+// receiveDirect receives the stripes of a direct transfer described by hdr into out, over the
+// direct connection if the sender reached it and over s if not, then verifies the whole file
+// against the trailer on s.
+func receiveDirect(m *Mux, s *Stream, out *partialFile, hdr fileHeader, direct Direct, hasher *MerkleHasher, progress func(int)) error {
+	if err := out.Truncate(hdr.Size); err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	chunks := newStripeSet(hdr.Size)
+	finished := make(chan struct{})
+	defer close(finished)
+	viaDirect := make(chan error, 1)
+	if direct == nil {
+		viaDirect <- errors.New("receiver did not offer a direct connection")
+	} else {
+		go func() {
+			dm, err := openDirect(m, direct, hdr.Direct, false)
+			if err != nil {
+				viaDirect <- err
+				return
+			}
+			go closeWith(s, finished, []*Mux{dm})
+			ds, err := dm.AcceptStream()
+			if err != nil {
+				viaDirect <- err
+				return
+			}
+			viaDirect <- receiveStripes(ds, out.File, chunks, false, hdr.Compression, progress)
+		}()
+	}
+	if err := receiveStripes(s, out.File, chunks, true, hdr.Compression, progress); err != nil {
+		if s.Err() == nil {
+			s.Reset("receiver could not receive every chunk")
+		}
+		return err
+	}
+	// Unless the sender fell back to the relay, the data is still arriving over the direct connection
+	if chunks.missing() >= 0 {
+		if err := <-viaDirect; err != nil {
+			s.Reset("receiver could not receive every chunk")
+			return fmt.Errorf("error receiving over direct connection: %w", err)
+		}
+	}
+	return verifyStripes(s, out, hdr, chunks, hasher)
+}
@@ -0,0 +1,108 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+)
+
+// pipeDirect stands in for a direct connection. Both sides get an end of the same pipe, or
+// an error if punching is to fail.
+type pipeDirect struct {
+	conn net.Conn
+	fail bool
+}
+
+func (d pipeDirect) Candidates() []string { return []string{"192.0.2.1:9"} }
+
+func (d pipeDirect) Connect(peer []string, initiator bool) (io.ReadWriteCloser, error) {
+	if d.fail {
+		return nil, errors.New("punching failed")
+	}
+	return d.conn, nil
+}
+
+func TestDirectTransferCompresses(t *testing.T) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "payload")
+	// Compressible and not a whole number of stripes
+	data := []byte(strings.Repeat("direct stripes are compressed one at a time. ", 3*stripeSize/40))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		mode string
+		want string
+		fail bool
+	}{
+		{"none", CompressNone, CompressNone, false},
+		{"gzip", CompressGzip, CompressGzip, false},
+		{"auto", CompressAuto, CompressZstd, false},
+		{"auto over the relay", CompressAuto, CompressZstd, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key := crypto.DeriveKey("7-walrus-2-fig", "")
+			sconn, rconn := net.Pipe()
+			sdirect, rdirect := net.Pipe()
+			out := filepath.Join(t.TempDir(), "out")
+			received := make(chan error, 1)
+			go func() {
+				m := NewMux(rconn, key, false, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+				defer m.Close()
+				opts := ReceiveOptions{Exists: Overwrite, Direct: pipeDirect{conn: rdirect, fail: tt.fail}}
+				_, _, err := ReceiveAndDecryptFile(context.Background(), m, out, opts, nil)
+				received <- err
+			}()
+			m := NewMux(sconn, key, true, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+			defer m.Close()
+			opts := SendOptions{Compression: tt.mode, Direct: pipeDirect{conn: sdirect, fail: tt.fail}}
+			res, err := SendEncryptedFile(context.Background(), m, path, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-received; err != nil {
+				t.Fatal(err)
+			}
+			if res.Direct == tt.fail {
+				t.Fatalf("Direct = %v with punching failing = %v", res.Direct, tt.fail)
+			}
+			if res.Compression != tt.want {
+				t.Fatalf("compressed with %s, want %s", res.Compression, tt.want)
+			}
+			if tt.want != CompressNone && res.WireSize >= res.Size {
+				t.Fatalf("%d bytes went out as %d", res.Size, res.WireSize)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("received file differs from the one sent")
+			}
+		})
+	}
+}
+
+func TestDecompressStripeBoundsOutput(t *testing.T) {
+	big := make([]byte, stripeSize+1)
+	for _, algo := range []string{CompressGzip, CompressZstd} {
+		wire, err := compressStripe(algo, big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decompressStripe(algo, wire); err == nil {
+			t.Fatalf("%s: chunk larger than a stripe decompressed", algo)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// MerkleChunkSize is the size of the plaintext chunks hashed into the Merkle tree.
+// It is independent of how the data is framed on the wire.
+const MerkleChunkSize = 1 << 20
+
+// Leaves and inner nodes are hashed with different prefixes so one cannot pass for the other
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// Digest identifies the content of a transferred file
+type Digest struct {
+	SHA256     string // hex SHA-256 of the whole file, for comparing out-of-band
+	MerkleRoot string // hex Merkle root over MerkleChunkSize chunks
+}
+
+// MerkleHasher hashes everything written to it into MerkleChunkSize leaves and a whole-file SHA-256
+type MerkleHasher struct {
+	leaves [][]byte
+	chunk  hash.Hash
+	n      int // bytes in the current chunk
+	file   hash.Hash
+}
+
+func NewMerkleHasher() *MerkleHasher {
+	return &MerkleHasher{chunk: newLeafHash(), file: sha256.New()}
+}
+
+func newLeafHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	return h
+}
+
+func (h *MerkleHasher) Write(p []byte) (int, error) {
+	h.file.Write(p)
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), MerkleChunkSize-h.n)
+		h.chunk.Write(p[:n])
+		h.n += n
+		p = p[n:]
+		if h.n == MerkleChunkSize {
+			h.endChunk()
+		}
+	}
+	return written, nil
+}
+
+func (h *MerkleHasher) endChunk() {
+	h.leaves = append(h.leaves, h.chunk.Sum(nil))
+	h.chunk = newLeafHash()
+	h.n = 0
+}
+
+// Leaves returns the hash of every chunk written so far, including a final short chunk
+func (h *MerkleHasher) Leaves() [][]byte {
+	if h.n > 0 || len(h.leaves) == 0 {
+		return append(h.leaves[:len(h.leaves):len(h.leaves)], h.chunk.Sum(nil))
+	}
+	return h.leaves
+}
+
+// Digest returns the whole-file SHA-256 and Merkle root of everything written so far
+func (h *MerkleHasher) Digest() Digest {
+	return Digest{
+		SHA256:     hex.EncodeToString(h.file.Sum(nil)),
+		MerkleRoot: hex.EncodeToString(MerkleRoot(h.Leaves())),
+	}
+}
+
+// MerkleRoot combines leaf hashes pairwise up to a single root. An odd node is carried up unchanged.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{merkleNodePrefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// leafWriter writes file data on to w with the leaf hash of each chunk after the chunk, so the
+// receiver can check every chunk as it arrives instead of only once the trailer is in. h hashes
+// the data.
+type leafWriter struct {
+	w io.Writer
+	h *MerkleHasher
+}
+
+func (lw *leafWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), MerkleChunkSize-lw.h.n)
+		if _, err := lw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		lw.h.Write(p[:n])
+		written += n
+		p = p[n:]
+		if lw.h.n == 0 {
+			// The chunk just filled up
+			if _, err := lw.w.Write(lw.h.leaves[len(lw.h.leaves)-1]); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the leaf hash of the final short chunk, or of the single empty chunk of an
+// empty file
+func (lw *leafWriter) Close() error {
+	if lw.h.n == 0 && len(lw.h.leaves) > 0 {
+		return nil
+	}
+	_, err := lw.w.Write(lw.h.chunk.Sum(nil))
+	return err
+}
+
+// readVerified copies size bytes of file data written by a leafWriter from r to dst. Each chunk
+// is checked against the leaf hash after it before it is passed on, so nothing that fails the
+// check reaches dst. hasher hashes the data.
+func readVerified(dst io.Writer, r io.Reader, size int64, hasher *MerkleHasher) error {
+	buf := make([]byte, min(size, MerkleChunkSize))
+	want := make([]byte, sha256.Size)
+	for i := 0; ; i++ {
+		chunk := buf[:min(size, MerkleChunkSize)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("error receiving file: %w", unexpectedEOF(err))
+		}
+		hasher.Write(chunk)
+		if _, err := io.ReadFull(r, want); err != nil {
+			return fmt.Errorf("error receiving file: %w", unexpectedEOF(err))
+		}
+		if !bytes.Equal(want, hasher.Leaves()[i]) {
+			return fmt.Errorf("integrity check failed: chunk %d does not match", i)
+		}
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+		size -= int64(len(chunk))
+		if size == 0 {
+			return nil
+		}
+	}
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for data that ended too soon
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// The trailer follows the file data in every file stream:
+// [u32 leaf count][leaf hashes][merkle root][file sha256], all hashes 32 bytes
+func writeTrailer(w io.Writer, h *MerkleHasher) error {
+	leaves := h.Leaves()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(leaves)))
+	for _, leaf := range leaves {
+		buf.Write(leaf)
+	}
+	buf.Write(MerkleRoot(leaves))
+	buf.Write(h.file.Sum(nil))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing file trailer: %w", err)
+	}
+	return nil
+}
+
+// verifyTrailer reads the sender's trailer from r and checks it against what the receiver hashed.
+// Reports the first chunk that differs, so a corrupted transfer says where it went wrong.
+func verifyTrailer(r io.Reader, h *MerkleHasher) error {
+	leaves := h.Leaves()
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("error reading file trailer: %w", err)
+	}
+	if int(count) != len(leaves) {
+		return fmt.Errorf("integrity check failed: sender hashed %d chunks, received %d", count, len(leaves))
+	}
+	want := make([]byte, sha256.Size)
+	for i, leaf := range leaves {
+		if _, err := io.ReadFull(r, want); err != nil {
+			return fmt.Errorf("error reading file trailer: %w", err)
+		}
+		if !bytes.Equal(want, leaf) {
+			return fmt.Errorf("integrity check failed: chunk %d does not match", i)
+		}
+	}
+	if _, err := io.ReadFull(r, want); err != nil {
+		return fmt.Errorf("error reading file trailer: %w", err)
+	}
+	if !bytes.Equal(want, MerkleRoot(leaves)) {
+		return fmt.Errorf("integrity check failed: merkle root does not match")
+	}
+	if _, err := io.ReadFull(r, want); err != nil {
+		return fmt.Errorf("error reading file trailer: %w", err)
+	}
+	if !bytes.Equal(want, h.file.Sum(nil)) {
+		return fmt.Errorf("integrity check failed: file hash does not match")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// leafStream returns data as a leafWriter sends it, followed by the trailer
+func leafStream(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	hasher := NewMerkleHasher()
+	lw := &leafWriter{w: &buf, h: hasher}
+	// Odd-sized writes, so chunk boundaries fall inside them
+	for len(data) > 0 {
+		n := min(len(data), 100_003)
+		if _, err := lw.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTrailer(&buf, hasher); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMerkleStreamVerifies(t *testing.T) {
+	for _, size := range []int{0, 1, MerkleChunkSize, 3*MerkleChunkSize + 12345} {
+		data := make([]byte, size)
+		rand.Read(data)
+		r := bytes.NewReader(leafStream(t, data))
+		var got bytes.Buffer
+		hasher := NewMerkleHasher()
+		if err := readVerified(&got, r, int64(size), hasher); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if err := verifyTrailer(r, hasher); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("%d bytes: received data differs", size)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("%d bytes: %d bytes left after the trailer", size, r.Len())
+		}
+	}
+}
+
+func TestMerkleStreamRejectsFlippedByte(t *testing.T) {
+	data := make([]byte, 3*MerkleChunkSize+12345)
+	rand.Read(data)
+	stream := leafStream(t, data)
+	// A byte in the third chunk, past the two chunks and leaf hashes before it
+	stream[2*(MerkleChunkSize+32)+7] ^= 1
+	var got bytes.Buffer
+	err := readVerified(&got, bytes.NewReader(stream), int64(len(data)), NewMerkleHasher())
+	if err == nil || !strings.Contains(err.Error(), "chunk 2 does not match") {
+		t.Fatalf("readVerified = %v, want chunk 2 rejected", err)
+	}
+	// Only the chunks that checked out were passed on
+	if !bytes.Equal(got.Bytes(), data[:2*MerkleChunkSize]) {
+		t.Fatalf("%d bytes passed on, want the %d before the bad chunk", got.Len(), 2*MerkleChunkSize)
+	}
+}
+
+func TestMerkleStreamRejectsTruncation(t *testing.T) {
+	data := make([]byte, 2*MerkleChunkSize+100)
+	rand.Read(data)
+	stream := leafStream(t, data)
+	for _, cut := range []int{
+		MerkleChunkSize / 2,         // inside a chunk
+		MerkleChunkSize + 10,        // inside a leaf hash
+		2*(MerkleChunkSize+32) + 50, // inside the short final chunk
+	} {
+		var got bytes.Buffer
+		err := readVerified(&got, bytes.NewReader(stream[:cut]), int64(len(data)), NewMerkleHasher())
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("cut at %d: readVerified = %v, want io.ErrUnexpectedEOF", cut, err)
+		}
+		if got.Len()%MerkleChunkSize != 0 {
+			t.Fatalf("cut at %d: %d bytes of an unchecked chunk passed on", cut, got.Len())
+		}
+	}
+}
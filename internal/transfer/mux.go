@@ -0,0 +1,588 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+// ChunkFunc encrypts or decrypts one chunk with key, e.g. crypto.Encrypt and crypto.Decrypt
+type ChunkFunc func(key, data []byte) ([]byte, error)
+
+// Frame types. Every frame starts with a plaintext header
+//
+//	[type uint8][flags uint8][stream id uint32][length uint32]
+//
+// followed by length bytes of payload. Every payload is encrypted with a key derived for the
+// stream and the direction it travels in, and starts with a sequence number and a copy of the
+// type, flags and stream id, which the receiver checks against the header. So frames cannot be
+// moved between streams, reflected back to their sender, replayed, reordered or have their
+// header changed without the receiver noticing.
+const (
+	frameData    byte = iota + 1 // payload: encrypted seq|header|data
+	frameWindow                  // payload: encrypted seq|header|window increment uint32
+	frameControl                 // payload: encrypted seq|header|control kind|body
+)
+
+// Frame flags
+const (
+	flagSYN byte = 1 << iota // first frame of a new stream
+	flagFIN                  // sender will write no more data on this stream
+	flagRST                  // stream aborted, payload is the encrypted reason
+)
+
+// Control message kinds that travel alongside data on a stream
+const (
+	CtrlAck    byte = iota + 1
+	CtrlPause       // sender paused, repeated while paused as a keepalive
+	CtrlResume      // sender resumed after CtrlPause
+	CtrlCaps        // body lists the compression algorithms the receiver can decode, comma separated
+	CtrlDirect      // sent before CtrlCaps, body lists the addresses the receiver can be reached at directly
+)
+
+const (
+	frameHeaderSize = 10
+	// sealedHeaderSize is the sequence number, type, flags and stream id sealed into each payload
+	sealedHeaderSize = 8 + 1 + 1 + 4
+	// maxFramePayload bounds the plaintext carried by one data frame
+	maxFramePayload = 64 * 1024
+	// maxFrameSize bounds a frame read from the wire so a bad length cannot exhaust memory
+	maxFrameSize  = maxFramePayload + 1024
+	defaultWindow = 256 * 1024
+)
+
+var (
+	ErrMuxClosed     = errors.New("connection closed")
+	ErrStreamClosed  = errors.New("stream closed for writing")
+	ErrWriteOnlyMux  = errors.New("write-only connection cannot receive")
+	errFrameSequence = errors.New("frame out of sequence")
+	errFrameHeader   = errors.New("frame header does not match its payload")
+)
+
+// Control is a control message received on a stream
+type Control struct {
+	Kind byte
+	Body []byte
+}
+
+// MuxConfig configures a Mux. The zero value is a normal two-way connection.
+type MuxConfig struct {
+	// WriteOnly never reads from the connection: no flow control, no control messages.
+	// Used when nobody answers, e.g. mailbox uploads and broadcasts fanned out by the relay.
+	WriteOnly bool
+	// ReadOnly never writes to the connection: window updates and control messages are dropped.
+	// Used to download a mailbox entry, where the relay plays back a write-only stream.
+	ReadOnly bool
+	// Window is the number of unacknowledged bytes a stream may have in flight
+	Window uint32
+}
+
+// Mux carries independent, flow controlled, encrypted streams over a single connection
+type Mux struct {
+	conn    io.ReadWriter
+	key     []byte
+	client  bool
+	encrypt ChunkFunc
+	decrypt ChunkFunc
+	cfg     MuxConfig
+
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accept  chan *Stream
+	done    chan struct{}
+	err     error
+}
+
+// NewMux starts multiplexing over conn. The client side opens odd stream ids and the other side
+// even ones so ids never collide.
+func NewMux(conn io.ReadWriter, key []byte, client bool, encrypt, decrypt ChunkFunc, cfg MuxConfig) *Mux {
+	if cfg.Window == 0 {
+		cfg.Window = defaultWindow
+	}
+	m := &Mux{
+		conn:    conn,
+		key:     key,
+		client:  client,
+		encrypt: encrypt,
+		decrypt: decrypt,
+		cfg:     cfg,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, 16),
+		done:    make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+	if !cfg.WriteOnly {
+		go m.readLoop()
+	}
+	return m
+}
+
+// OpenStream opens a new stream to the other side
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := m.newStream(m.nextID)
+	m.nextID += 2
+	m.mu.Unlock()
+	if err := s.send(frameData, flagSYN, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for the other side to open a stream
+func (m *Mux) AcceptStream() (*Stream, error) {
+	if m.cfg.WriteOnly {
+		return nil, ErrWriteOnlyMux
+	}
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Close closes the underlying connection (if it can be closed) and fails all streams
+func (m *Mux) Close() error {
+	var err error
+	if c, ok := m.conn.(io.Closer); ok {
+		err = c.Close()
+	}
+	m.fail(ErrMuxClosed)
+	return err
+}
+
+// Done is closed when the connection has ended
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the connection ended, or nil while it is running
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// newStream registers a stream. Caller holds m.mu.
+func (m *Mux) newStream(id uint32) *Stream {
+	s := &Stream{
+		id:         id,
+		m:          m,
+		sendKey:    streamKey(m.key, id, m.client),
+		recvKey:    streamKey(m.key, id, !m.client),
+		sendWindow: m.cfg.Window,
+		controls:   make(chan Control, 64),
+		done:       make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	m.streams[id] = s
+	return s
+}
+
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	close(m.done)
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, s := range m.streams {
+		streams = append(streams, s)
+	}
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+func (m *Mux) readLoop() {
+	for {
+		if err := m.readFrame(); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) readFrame() error {
+	var hdr [frameHeaderSize]byte
+	if n, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+		// A notice shorter than a header arrives as a truncated one
+		if notice, ok := relay.TrailingNotice(hdr[:n]); ok {
+			return &relay.NoticeError{Notice: notice}
+		}
+		return err
+	}
+	// The relay may interrupt the stream with a plain text notice (peer gone, shutting down)
+	if relay.IsNoticePrefix(hdr[:]) {
+		return relay.ReadNotice(m.conn, hdr[:])
+	}
+	typ, flags := hdr[0], hdr[1]
+	id := binary.BigEndian.Uint32(hdr[2:6])
+	length := binary.BigEndian.Uint32(hdr[6:10])
+	if length > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(m.conn, payload); err != nil {
+		// A relay that cuts the stream mid-frame leaves its notice as the tail of the frame
+		if notice, ok := relay.TrailingNotice(payload[:n]); ok {
+			return &relay.NoticeError{Notice: notice}
+		}
+		return fmt.Errorf("error reading frame: %w", err)
+	}
+	s := m.stream(id, typ == frameData && flags&flagSYN != 0)
+	if s == nil {
+		return nil // frame for a stream we already forgot
+	}
+	plain, err := s.open(typ, flags, payload)
+	if err != nil {
+		return err
+	}
+	switch {
+	case typ == frameWindow:
+		if len(plain) != 4 {
+			return fmt.Errorf("invalid window frame")
+		}
+		s.addWindow(binary.BigEndian.Uint32(plain))
+	case flags&flagRST != 0:
+		s.fail(&StreamResetError{Reason: string(plain)})
+		m.forget(id)
+	case typ == frameControl:
+		if len(plain) == 0 {
+			return fmt.Errorf("empty control frame")
+		}
+		s.deliver(Control{Kind: plain[0], Body: append([]byte(nil), plain[1:]...)})
+	case typ == frameData:
+		s.push(plain, flags&flagFIN != 0)
+	}
+	return nil
+}
+
+// stream returns the stream for id, creating it for a SYN frame
+func (m *Mux) stream(id uint32, syn bool) *Stream {
+	m.mu.Lock()
+	if s, ok := m.streams[id]; ok || !syn {
+		m.mu.Unlock()
+		return s
+	}
+	s := m.newStream(id)
+	m.mu.Unlock()
+	m.accept <- s
+	return s
+}
+
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) writeFrame(typ, flags byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0], frame[1] = typ, flags
+	binary.BigEndian.PutUint32(frame[2:6], id)
+	binary.BigEndian.PutUint32(frame[6:10], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	return m.write(frame)
+}
+
+func (m *Mux) write(frame []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if m.cfg.ReadOnly {
+		return nil
+	}
+	if _, err := m.conn.Write(frame); err != nil {
+		m.fail(err)
+		return fmt.Errorf("error sending frame: %w", err)
+	}
+	return nil
+}
+
+// streamKey derives the key for one direction of a stream from the session key, fromClient
+// picking the frames the client side sends
+func streamKey(key []byte, id uint32, fromClient bool) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("qshare-stream"))
+	binary.Write(h, binary.BigEndian, id)
+	if fromClient {
+		h.Write([]byte("client"))
+	} else {
+		h.Write([]byte("server"))
+	}
+	return h.Sum(nil)
+}
+
+// StreamResetError is returned by a stream the other side aborted
+type StreamResetError struct {
+	Reason string
+}
+
+func (e *StreamResetError) Error() string {
+	return "stream reset by peer: " + e.Reason
+}
+
+// Stream is one logical, ordered byte stream within a Mux
+type Stream struct {
+	id      uint32
+	m       *Mux
+	sendKey []byte
+	recvKey []byte
+	// sendMu keeps sealing and writing a frame together, so sequence numbers hit the wire in order
+	sendMu sync.Mutex
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	buf         bytes.Buffer
+	recvFin     bool
+	err         error
+	writeClosed bool
+	sendWindow  uint32
+	consumed    uint32
+	sendSeq     uint64
+	recvSeq     uint64
+	controls    chan Control
+	done        chan struct{}
+}
+
+// ID returns the stream id
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads data sent by the other side. Returns io.EOF once the other side closed the stream.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.recvFin && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		defer s.mu.Unlock()
+		if s.recvFin {
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	var update uint32
+	if s.consumed >= s.m.cfg.Window/2 {
+		update, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+	if update > 0 {
+		s.writeWindow(update)
+	}
+	return n, nil
+}
+
+// Write sends p to the other side, waiting for flow control window as needed
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for !s.m.cfg.WriteOnly && s.sendWindow == 0 && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil || s.writeClosed {
+			err := s.err
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), maxFramePayload)
+		if !s.m.cfg.WriteOnly {
+			n = min(n, int(s.sendWindow))
+			s.sendWindow -= uint32(n)
+		}
+		s.mu.Unlock()
+		if err := s.send(frameData, 0, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close tells the other side no more data will be written. Reading continues to work.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.writeClosed || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	s.mu.Unlock()
+	return s.send(frameData, flagFIN, nil)
+}
+
+// Reset aborts the stream in both directions, sending reason to the other side
+func (s *Stream) Reset(reason string) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	err := s.send(frameData, flagRST, []byte(reason))
+	if reason == cancelReason {
+		s.fail(ErrCancelled)
+	} else {
+		s.fail(fmt.Errorf("stream reset: %s", reason))
+	}
+	s.m.forget(s.id)
+	return err
+}
+
+// SendControl sends a control message on the stream, delivered alongside data
+func (s *Stream) SendControl(kind byte, body []byte) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.mu.Unlock()
+	return s.send(frameControl, 0, append([]byte{kind}, body...))
+}
+
+// Controls delivers control messages from the other side. Closed when the stream fails.
+func (s *Stream) Controls() <-chan Control {
+	return s.controls
+}
+
+// Done is closed when the stream fails or is reset
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that ended the stream, if any
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// writeWindow grants the other side n more bytes of window on the stream
+func (s *Stream) writeWindow(n uint32) error {
+	return s.send(frameWindow, 0, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// send seals data and writes it as one frame
+func (s *Stream) send(typ, flags byte, data []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	payload, err := s.seal(typ, flags, data)
+	if err != nil {
+		return err
+	}
+	return s.m.writeFrame(typ, flags, s.id, payload)
+}
+
+// seal prefixes data with the next send sequence number and the frame header, and encrypts it.
+// Caller holds s.sendMu.
+func (s *Stream) seal(typ, flags byte, data []byte) ([]byte, error) {
+	plain := make([]byte, sealedHeaderSize+len(data))
+	binary.BigEndian.PutUint64(plain, s.sendSeq)
+	plain[8], plain[9] = typ, flags
+	binary.BigEndian.PutUint32(plain[10:14], s.id)
+	copy(plain[sealedHeaderSize:], data)
+	s.sendSeq++
+	enc, err := s.m.encrypt(s.sendKey, plain)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting frame: %w", err)
+	}
+	return enc, nil
+}
+
+// open decrypts the payload of a frame with header typ and flags, and checks the header sealed
+// in it and its sequence number
+func (s *Stream) open(typ, flags byte, payload []byte) ([]byte, error) {
+	plain, err := s.m.decrypt(s.recvKey, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting frame: %w", err)
+	}
+	if len(plain) < sealedHeaderSize {
+		return nil, fmt.Errorf("frame too short")
+	}
+	if plain[8] != typ || plain[9] != flags || binary.BigEndian.Uint32(plain[10:14]) != s.id {
+		return nil, errFrameHeader
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if binary.BigEndian.Uint64(plain) != s.recvSeq {
+		return nil, errFrameSequence
+	}
+	s.recvSeq++
+	return plain[sealedHeaderSize:], nil
+}
+
+func (s *Stream) push(data []byte, fin bool) {
+	s.mu.Lock()
+	s.buf.Write(data)
+	if fin {
+		s.recvFin = true
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *Stream) addWindow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// deliver queues a control message for Controls, dropping it if the consumer fell far behind
+func (s *Stream) deliver(c Control) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	select {
+	case s.controls <- c:
+	default:
+	}
+}
+
+func (s *Stream) fail(err error) {
+	if err == io.EOF {
+		// The connection ended before the other side closed this stream
+		err = io.ErrUnexpectedEOF
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		close(s.controls)
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+)
+
+// relayedMuxes connects a client and a server mux through the test, which plays the relay:
+// each frame the client writes is read from client and has to be passed on to server by hand
+func relayedMuxes(t *testing.T) (cm, sm *Mux, client, server net.Conn) {
+	t.Helper()
+	key := crypto.DeriveKey("9-yam-4-kite", "")
+	a, client := net.Pipe()
+	server, b := net.Pipe()
+	cm = NewMux(a, key, true, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+	sm = NewMux(b, key, false, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+	t.Cleanup(func() {
+		cm.Close()
+		sm.Close()
+		client.Close()
+		server.Close()
+	})
+	return cm, sm, client, server
+}
+
+// readRawFrame reads one whole frame, header and payload, off conn
+func readRawFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	frame = append(frame, make([]byte, binary.BigEndian.Uint32(frame[6:10]))...)
+	if _, err := io.ReadFull(conn, frame[frameHeaderSize:]); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// writeRaw writes frame to conn, where the mux's read loop takes it
+func writeRaw(t *testing.T, conn net.Conn, frame []byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFailed waits for m to fail and returns why
+func waitFailed(t *testing.T, m *Mux) error {
+	t.Helper()
+	select {
+	case <-m.Done():
+		return m.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux accepted the frame")
+		return nil
+	}
+}
+
+func TestMuxRejectsTamperedHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		tamper func(frame []byte) []byte
+		want   string
+	}{
+		{"set FIN", func(f []byte) []byte { f[1] |= flagFIN; return f }, errFrameHeader.Error()},
+		{"set RST", func(f []byte) []byte { f[1] |= flagRST; return f }, errFrameHeader.Error()},
+		{"data as control", func(f []byte) []byte { f[0] = frameControl; return f }, errFrameHeader.Error()},
+		{"data as window", func(f []byte) []byte { f[0] = frameWindow; return f }, errFrameHeader.Error()},
+		{"forged window", func(f []byte) []byte {
+			// The old unauthenticated form, with the increment in the length field
+			forged := make([]byte, frameHeaderSize)
+			forged[0] = frameWindow
+			copy(forged[2:6], f[2:6])
+			return forged
+		}, "decrypting"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cm, sm, client, server := relayedMuxes(t)
+			go func() {
+				if s, err := cm.OpenStream(); err == nil {
+					s.Write([]byte("hello"))
+				}
+			}()
+			// Pass the stream's SYN on untouched, then tamper with its first data frame
+			writeRaw(t, server, readRawFrame(t, client))
+			writeRaw(t, server, tt.tamper(readRawFrame(t, client)))
+			if err := waitFailed(t, sm); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("mux failed with %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMuxRejectsReflectedFrame(t *testing.T) {
+	cm, _, client, _ := relayedMuxes(t)
+	go func() {
+		if s, err := cm.OpenStream(); err == nil {
+			s.Write([]byte("hello"))
+		}
+	}()
+	readRawFrame(t, client)
+	// The client's own data frame, sent back to it as though the server had written it
+	writeRaw(t, client, readRawFrame(t, client))
+	if err := waitFailed(t, cm); err == nil || !strings.Contains(err.Error(), "decrypting") {
+		t.Fatalf("mux failed with %v, want a decryption error", err)
+	}
+}
+
+func TestMuxRejectsReplayedFrame(t *testing.T) {
+	cm, sm, client, server := relayedMuxes(t)
+	go func() {
+		if s, err := cm.OpenStream(); err == nil {
+			s.Write([]byte("hello"))
+		}
+	}()
+	writeRaw(t, server, readRawFrame(t, client))
+	data := readRawFrame(t, client)
+	writeRaw(t, server, data)
+	s, err := sm.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(s, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	writeRaw(t, server, data)
+	if err := waitFailed(t, sm); !errors.Is(err, errFrameSequence) {
+		t.Fatalf("mux failed with %v, want errFrameSequence", err)
+	}
+}
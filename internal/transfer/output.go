@@ -0,0 +1,126 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ExistsPolicy decides what happens when the output file already exists
+type ExistsPolicy int
+
+const (
+	// AutoSuffix saves as "name (1).ext", "name (2).ext"... next to the existing file
+	AutoSuffix ExistsPolicy = iota
+	// Overwrite replaces the existing file once the transfer has completed
+	Overwrite
+	// NoClobber fails the transfer and leaves the existing file alone
+	NoClobber
+)
+
+var ErrOutputExists = errors.New("output file already exists")
+
+// ReceiveOptions controls how a received file is saved
+type ReceiveOptions struct {
+	Exists ExistsPolicy
+	// Dial opens the extra connections of a parallel transfer, nil to refuse them
+	Dial DialFunc
+	// Direct, if not nil, is offered to the sender for a connection that bypasses the relay
+	Direct Direct
+}
+
+// partialFile is written under a temporary name next to its target and only moved into
+// place once complete, so a failed transfer never leaves a half written file at the target.
+type partialFile struct {
+	*os.File
+	target string
+	policy ExistsPolicy
+}
+
+func createPartial(target string, policy ExistsPolicy) (*partialFile, error) {
+	if policy == NoClobber {
+		if _, err := os.Lstat(target); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrOutputExists, target)
+		}
+	}
+	dir, base := filepath.Split(target)
+	if dir == "" {
+		dir = "."
+	}
+	// Unlike os.CreateTemp's 0600, the file gets the mode the umask gives any new file, which
+	// it keeps when it is moved into place
+	for tries := 0; ; tries++ {
+		name := filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".qshare-partial")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && tries < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error creating output file: %w", err)
+		}
+		return &partialFile{File: f, target: target, policy: policy}, nil
+	}
+}
+
+// Abort closes and removes the partial file
+func (p *partialFile) Abort() {
+	p.Close()
+	os.Remove(p.Name())
+}
+
+// Commit flushes the partial file to disk and moves it into place. Returns the final path,
+// which differs from the target when AutoSuffix picked a new name.
+func (p *partialFile) Commit() (string, error) {
+	if err := p.Sync(); err != nil {
+		p.Abort()
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	if err := p.Close(); err != nil {
+		os.Remove(p.Name())
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	path, err := p.place()
+	if err != nil {
+		os.Remove(p.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+func (p *partialFile) place() (string, error) {
+	if p.policy == Overwrite {
+		if err := os.Rename(p.Name(), p.target); err != nil {
+			return "", fmt.Errorf("error saving file: %w", err)
+		}
+		return p.target, nil
+	}
+	ext := filepath.Ext(p.target)
+	base := p.target[:len(p.target)-len(ext)]
+	candidate := p.target
+	for i := 1; ; i++ {
+		// A hard link fails if candidate exists, so nothing that appeared meanwhile is replaced
+		err := os.Link(p.Name(), candidate)
+		if err == nil {
+			os.Remove(p.Name())
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			// No hard links on this filesystem, check then rename instead
+			if _, serr := os.Lstat(candidate); os.IsNotExist(serr) {
+				if err := os.Rename(p.Name(), candidate); err != nil {
+					return "", fmt.Errorf("error saving file: %w", err)
+				}
+				return candidate, nil
+			} else if serr != nil {
+				return "", fmt.Errorf("error saving file: %w", serr)
+			}
+		}
+		if p.policy == NoClobber {
+			return "", fmt.Errorf("%w: %s", ErrOutputExists, p.target)
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
@@ -0,0 +1,120 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePartial creates a partial file for target under policy and writes data to it
+func writePartial(t *testing.T, target string, policy ExistsPolicy, data string) *partialFile {
+	t.Helper()
+	f, err := createPartial(target, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// checkFiles fails unless dir holds exactly the files in want, with those contents
+func checkFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("dir holds %q, want %d files", names, len(want))
+	}
+	for name, data := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != data {
+			t.Fatalf("%s = %q, %v, want %q", name, got, err, data)
+		}
+	}
+}
+
+func TestPartialFilePolicies(t *testing.T) {
+	t.Run("overwrite", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "notes.txt")
+		os.WriteFile(target, []byte("old"), 0644)
+		path, err := writePartial(t, target, Overwrite, "new").Commit()
+		if err != nil || path != target {
+			t.Fatalf("Commit = %q, %v", path, err)
+		}
+		checkFiles(t, dir, map[string]string{"notes.txt": "new"})
+	})
+	t.Run("auto suffix", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "notes.txt")
+		os.WriteFile(target, []byte("old"), 0644)
+		for i, want := range []string{"notes (1).txt", "notes (2).txt"} {
+			path, err := writePartial(t, target, AutoSuffix, want).Commit()
+			if err != nil || path != filepath.Join(dir, want) {
+				t.Fatalf("Commit %d = %q, %v, want %s", i, path, err, want)
+			}
+		}
+		checkFiles(t, dir, map[string]string{"notes.txt": "old", "notes (1).txt": "notes (1).txt", "notes (2).txt": "notes (2).txt"})
+	})
+	t.Run("no clobber", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "notes.txt")
+		os.WriteFile(target, []byte("old"), 0644)
+		if _, err := createPartial(target, NoClobber); !errors.Is(err, ErrOutputExists) {
+			t.Fatalf("createPartial over an existing file = %v, want ErrOutputExists", err)
+		}
+		checkFiles(t, dir, map[string]string{"notes.txt": "old"})
+	})
+	t.Run("no clobber when the target appears meanwhile", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "notes.txt")
+		f := writePartial(t, target, NoClobber, "new")
+		os.WriteFile(target, []byte("raced"), 0644)
+		if _, err := f.Commit(); !errors.Is(err, ErrOutputExists) {
+			t.Fatalf("Commit = %v, want ErrOutputExists", err)
+		}
+		checkFiles(t, dir, map[string]string{"notes.txt": "raced"})
+	})
+}
+
+func TestPartialFileAbortRemovesIt(t *testing.T) {
+	dir := t.TempDir()
+	f := writePartial(t, filepath.Join(dir, "notes.txt"), AutoSuffix, "half of it")
+	checkFiles(t, dir, map[string]string{filepath.Base(f.Name()): "half of it"})
+	f.Abort()
+	checkFiles(t, dir, nil)
+}
+
+func TestPartialFileGetsUsualMode(t *testing.T) {
+	dir := t.TempDir()
+	// Any file created as usual gets 0666 less the umask
+	ref, err := os.OpenFile(filepath.Join(dir, "ref"), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Close()
+	want, err := os.Stat(ref.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := writePartial(t, filepath.Join(dir, "notes.txt"), AutoSuffix, "x").Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode() != want.Mode() {
+		t.Fatalf("saved with mode %v, want %v", got.Mode(), want.Mode())
+	}
+}
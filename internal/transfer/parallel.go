@@ -0,0 +1,373 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// MaxConnections bounds how many parallel connections one transfer may use
+const MaxConnections = 16
+
+// stripeSize is the unit a parallel transfer is split into. Stripes are dealt round-robin to
+// the connections and line up with Merkle chunks.
+const stripeSize = MerkleChunkSize
+
+// stripeEnd marks the end of the stripes on the first connection, before the trailer
+const stripeEnd = ^uint64(0)
+
+// DialFunc opens extra connection i (1 to n-1) of a parallel transfer, already handshaken
+// with the relay so it is paired with the other side's connection i.
+type DialFunc func(i int) (io.ReadWriteCloser, error)
+
+// connKey derives the key for extra connection i from the session key, so streams on
+// different connections never share a key
+func connKey(key []byte, i int) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("qshare-conn"))
+	binary.Write(h, binary.BigEndian, uint32(i))
+	return h.Sum(nil)
+}
+
+// stripe frames are [u64 offset][u32 length] followed by the data, inside an encrypted stream
+func writeStripe(w io.Writer, off uint64, data []byte) error {
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:8], off)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("error sending chunk: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error sending chunk: %w", err)
+	}
+	return nil
+}
+
+func readStripeHeader(r io.Reader) (uint64, uint32, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(hdr[:8]), binary.BigEndian.Uint32(hdr[8:]), nil
+}
+
+// openExtra dials extra connection i and returns its mux and the stream carrying its stripes
+func openExtra(m *Mux, dial DialFunc, i int, client bool) (*Mux, *Stream, error) {
+	conn, err := dial(i)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening connection %d: %w", i+1, err)
+	}
+	extra := NewMux(conn, connKey(m.key, i), client, m.encrypt, m.decrypt, MuxConfig{Window: m.cfg.Window})
+	var s *Stream
+	if client {
+		s, err = extra.OpenStream()
+	} else {
+		s, err = extra.AcceptStream()
+	}
+	if err != nil {
+		extra.Close()
+		return nil, nil, fmt.Errorf("error opening connection %d: %w", i+1, err)
+	}
+	return extra, s, nil
+}
+
+// closeWith closes muxes once s ends or finished is closed, so a cancel or failure on the
+// first connection also stops the extra ones
+func closeWith(s *Stream, finished <-chan struct{}, muxes []*Mux) {
+	select {
+	case <-s.Done():
+	case <-finished:
+	}
+	for _, m := range muxes {
+		m.Close()
+	}
+}
+
+// sendParallel sends file over s and n-1 extra connections. The header and trailer travel on
+// s, which also carries its share of the stripes. Waits for the receiver's ack.
+func sendParallel(m *Mux, s *Stream, file *os.File, name string, size int64, n int, opts SendOptions, dial DialFunc, progress func(int), onPause func(bool)) (SendResult, error) {
+	res := SendResult{Size: size, Compression: CompressNone, WireSize: size}
+	// The receiver answers with its caps once it is there, only then can the relay pair extra connections
+	if _, err := waitCaps(s); err != nil {
+		return res, err
+	}
+	if err := writeHeader(s, fileHeader{Name: name, Size: size, Connections: n}); err != nil {
+		return res, err
+	}
+	muxes := make([]*Mux, 0, n-1)
+	streams := []*Stream{s}
+	finished := make(chan struct{})
+	defer close(finished)
+	for i := 1; i < n; i++ {
+		extra, es, err := openExtra(m, dial, i, true)
+		if err != nil {
+			s.Reset("sender could not open parallel connections")
+			for _, em := range muxes {
+				em.Close()
+			}
+			return res, err
+		}
+		muxes = append(muxes, extra)
+		streams = append(streams, es)
+	}
+	go closeWith(s, finished, muxes)
+
+	hasher, hashed := hashFile(file, size)
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for w, ws := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pause := onPause
+			if w > 0 {
+				pause = nil // only the first connection drives the progress display
+			}
+			_, errs[w] = sendStripes(ws, file, size, w, n, CompressNone, opts.Pause, progress, pause)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		if s.Err() == nil {
+			s.Reset("sender could not send every chunk")
+		}
+		return res, err
+	}
+	var err error
+	res.Digest, err = finishStripes(s, hasher, hashed)
+	return res, err
+}
+
+// finishStripes waits for the file to be hashed, ends the stripes on s and sends the trailer,
+// then waits for the receiver's ack
+func finishStripes(s *Stream, hasher *MerkleHasher, hashed <-chan error) (Digest, error) {
+	if err := <-hashed; err != nil {
+		s.Reset("sender could not read the file")
+		return Digest{}, fmt.Errorf("error reading file: %w", err)
+	}
+	digest := hasher.Digest()
+	if err := writeStripe(s, stripeEnd, nil); err != nil {
+		return digest, err
+	}
+	if err := writeTrailer(s, hasher); err != nil {
+		return digest, err
+	}
+	if err := s.Close(); err != nil {
+		return digest, fmt.Errorf("error finishing stream: %w", err)
+	}
+	return digest, waitAck(s)
+}
+
+// hashFile hashes file in one sequential pass in the background while stripes go out in any
+// order. The result is ready once the returned channel delivers.
+func hashFile(file *os.File, size int64) (*MerkleHasher, <-chan error) {
+	hasher := NewMerkleHasher()
+	hashed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(hasher, io.NewSectionReader(file, 0, size))
+		hashed <- err
+	}()
+	return hasher, hashed
+}
+
+// sendStripes sends every n-th stripe starting at stripe w, read with ReadAt and compressed
+// with algo, and returns how many bytes of stripe data went out.
+// Extra connections are closed when done, the first one is finished by the caller.
+func sendStripes(s *Stream, file *os.File, size int64, w, n int, algo string, pauser *Pauser, progress func(int), onPause func(bool)) (int64, error) {
+	buf := make([]byte, stripeSize)
+	var wire int64
+	for off := int64(w) * stripeSize; off < size; off += int64(n) * stripeSize {
+		if err := holdWhilePaused(s, pauser, onPause); err != nil {
+			return wire, err
+		}
+		chunk := buf[:min(stripeSize, size-off)]
+		if _, err := file.ReadAt(chunk, off); err != nil {
+			return wire, fmt.Errorf("error reading file: %w", err)
+		}
+		data, err := compressStripe(algo, chunk)
+		if err != nil {
+			return wire, err
+		}
+		if err := writeStripe(s, uint64(off), data); err != nil {
+			return wire, err
+		}
+		wire += int64(len(data))
+		if progress != nil {
+			progress(len(chunk))
+		}
+	}
+	if w > 0 {
+		return wire, s.Close()
+	}
+	return wire, nil
+}
+
+// receiveParallel receives the stripes of a parallel transfer described by hdr into out,
+// then verifies the whole file against the trailer on s.
+func receiveParallel(m *Mux, s *Stream, out *partialFile, hdr fileHeader, dial DialFunc, hasher *MerkleHasher, progress func(int)) error {
+	n := hdr.Connections
+	if n > MaxConnections {
+		s.Reset("too many parallel connections")
+		return fmt.Errorf("sender asked for %d parallel connections, at most %d are allowed", n, MaxConnections)
+	}
+	if dial == nil {
+		s.Reset("receiver cannot open parallel connections")
+		return fmt.Errorf("sender asked for %d parallel connections", n)
+	}
+	if err := out.Truncate(hdr.Size); err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	muxes := make([]*Mux, 0, n-1)
+	streams := []*Stream{s}
+	finished := make(chan struct{})
+	defer close(finished)
+	for i := 1; i < n; i++ {
+		extra, es, err := openExtra(m, dial, i, false)
+		if err != nil {
+			s.Reset("receiver could not open parallel connections")
+			for _, em := range muxes {
+				em.Close()
+			}
+			return err
+		}
+		muxes = append(muxes, extra)
+		streams = append(streams, es)
+	}
+	go closeWith(s, finished, muxes)
+
+	chunks := newStripeSet(hdr.Size)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for w, ws := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[w] = receiveStripes(ws, out.File, chunks, w == 0, hdr.Compression, progress)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		if s.Err() == nil {
+			s.Reset("receiver could not receive every chunk")
+		}
+		return err
+	}
+	return verifyStripes(s, out, hdr, chunks, hasher)
+}
+
+// verifyStripes checks every stripe arrived, then hashes the assembled file in one pass since
+// stripes arrive out of order, and checks it against the trailer on s
+func verifyStripes(s *Stream, out *partialFile, hdr fileHeader, chunks *stripeSet, hasher *MerkleHasher) error {
+	if missing := chunks.missing(); missing >= 0 {
+		s.Reset("receiver is missing chunks")
+		return fmt.Errorf("incomplete file: chunk %d never arrived", missing)
+	}
+	if _, err := io.Copy(hasher, io.NewSectionReader(out.File, 0, hdr.Size)); err != nil {
+		return fmt.Errorf("error verifying file: %w", err)
+	}
+	return verifyRest(s, s, hasher)
+}
+
+// receiveStripes writes stripes compressed with algo from s into f until the stream ends, or
+// until the end marker on the first connection
+func receiveStripes(s *Stream, f *os.File, chunks *stripeSet, first bool, algo string, progress func(int)) error {
+	buf := make([]byte, stripeSize)
+	for {
+		off, length, err := readStripeHeader(s)
+		if err == io.EOF && !first {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error receiving file: %w", err)
+		}
+		if first && off == stripeEnd {
+			return nil
+		}
+		compressed := algo != "" && algo != CompressNone
+		if !compressed {
+			// The length is checked before reading so a bad one never makes us read far
+			if err := chunks.claim(off, length); err != nil {
+				return err
+			}
+		} else if length > maxStripeWire {
+			return fmt.Errorf("invalid compressed chunk length %d at offset %d", length, off)
+		}
+		if int(length) > len(buf) {
+			buf = make([]byte, length)
+		}
+		data := buf[:length]
+		if _, err := io.ReadFull(s, data); err != nil {
+			return fmt.Errorf("error receiving file: %w", err)
+		}
+		if compressed {
+			if data, err = decompressStripe(algo, data); err != nil {
+				return err
+			}
+			if err := chunks.claim(off, uint32(len(data))); err != nil {
+				return err
+			}
+		}
+		if _, err := f.WriteAt(data, int64(off)); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+		chunks.wrote(off)
+		if progress != nil {
+			progress(len(data))
+		}
+	}
+}
+
+// stripeSet tracks which stripes have arrived, so each must come exactly once and in bounds
+type stripeSet struct {
+	mu   sync.Mutex
+	seen []bool
+	// written is set once a stripe's data is in the file, which may be well after it was claimed
+	written []bool
+	size    int64
+}
+
+func newStripeSet(size int64) *stripeSet {
+	n := (size + stripeSize - 1) / stripeSize
+	return &stripeSet{seen: make([]bool, n), written: make([]bool, n), size: size}
+}
+
+func (c *stripeSet) claim(off uint64, length uint32) error {
+	if off%stripeSize != 0 || off >= uint64(c.size) {
+		return fmt.Errorf("invalid chunk offset %d", off)
+	}
+	if int64(length) != min(stripeSize, c.size-int64(off)) {
+		return fmt.Errorf("invalid chunk length %d at offset %d", length, off)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := off / stripeSize
+	if c.seen[i] {
+		return fmt.Errorf("chunk %d received twice", i)
+	}
+	c.seen[i] = true
+	return nil
+}
+
+func (c *stripeSet) wrote(off uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written[off/stripeSize] = true
+}
+
+// missing returns the first stripe not yet written, or -1
+func (c *stripeSet) missing() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ok := range c.written {
+		if !ok {
+			return i
+		}
+	}
+	return -1
+}
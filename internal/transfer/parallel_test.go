@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+// delayedListener adds a fixed one-way delay to everything the relay writes, so every
+// connection through it sees a round trip of twice the delay, like a distant relay
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &delayedConn{Conn: conn, delay: l.delay, queue: make(chan delayedWrite, 4096)}
+	go c.deliver()
+	return c, nil
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+// delayedConn holds each write back for delay without limiting how much can be in flight.
+// Closing it lets what is already queued arrive first, as a FIN would.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan delayedWrite
+}
+
+func (c *delayedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.queue <- delayedWrite{due: time.Now().Add(c.delay), data: append([]byte(nil), p...)}
+	return len(p), nil
+}
+
+func (c *delayedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	return nil
+}
+
+func (c *delayedConn) deliver() {
+	defer c.Conn.Close()
+	for w := range c.queue {
+		time.Sleep(time.Until(w.due))
+		if _, err := c.Conn.Write(w.data); err != nil {
+			return
+		}
+	}
+}
+
+// startDelayedRelay runs an in-process relay whose connections see a round trip of 2*delay
+func startDelayedRelay(tb testing.TB, delay time.Duration) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := relay.NewServer(relay.Config{
+		MaxConnsPerIP: 1000,
+		RateLimit:     &relay.RateLimit{IP: relay.NewTokenBucket(1<<20, time.Minute), Code: relay.NewTokenBucket(1<<20, time.Minute)},
+	})
+	go srv.Serve(delayedListener{Listener: ln, delay: delay})
+	tb.Cleanup(func() { srv.Shutdown(time.Second) })
+	return ln.Addr().String()
+}
+
+// joinRoom connects to the relay at addr as role under code
+func joinRoom(addr, code, role string, opts map[string]string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := relay.ClientHandshake(conn, relay.Handshake{Code: code, Role: role, Options: opts}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func roomDialer(addr, code, role string) DialFunc {
+	return func(i int) (io.ReadWriteCloser, error) {
+		return joinRoom(addr, code, role, map[string]string{relay.OptConn: strconv.Itoa(i)})
+	}
+}
+
+// transferOnce sends path to a receiver through the relay at addr over conns connections
+func transferOnce(addr, code, path, out string, conns int) error {
+	key := crypto.DeriveKey(code, "")
+	sconn, err := joinRoom(addr, code, "sender", nil)
+	if err != nil {
+		return err
+	}
+	defer sconn.Close()
+	rconn, err := joinRoom(addr, code, "receiver", nil)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	received := make(chan error, 1)
+	go func() {
+		m := NewMux(rconn, key, false, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+		_, _, err := ReceiveAndDecryptFile(context.Background(), m, out, ReceiveOptions{Exists: Overwrite, Dial: roomDialer(addr, code, "receiver")}, nil)
+		received <- err
+	}()
+	m := NewMux(sconn, key, true, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+	opts := SendOptions{Compression: CompressNone, Connections: conns, Dial: roomDialer(addr, code, "sender")}
+	if _, err := SendEncryptedFile(context.Background(), m, path, opts, nil); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	if err := <-received; err != nil {
+		return fmt.Errorf("receive: %w", err)
+	}
+	return nil
+}
+
+func TestParallelTransferThroughRelay(t *testing.T) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "payload")
+	// Not a whole number of stripes, so the last one is short
+	data := make([]byte, 5*stripeSize+12345)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startDelayedRelay(t, time.Millisecond)
+	out := filepath.Join(dir, "out")
+	if err := transferOnce(addr, "4-quince-5-yak", path, out, 4); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received file differs from the one sent")
+	}
+}
+
+// BenchmarkParallelDelayedRelay sends a file through a relay with a 20ms round trip. A single
+// connection is bound by its flow control window per round trip, more connections multiply that.
+func BenchmarkParallelDelayedRelay(b *testing.B) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	const size = 8 << 20
+	dir := b.TempDir()
+	path := filepath.Join(dir, "payload")
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		b.Fatal(err)
+	}
+	addr := startDelayedRelay(b, 10*time.Millisecond)
+	for _, conns := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("conns=%d", conns), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				code := fmt.Sprintf("%d-bench-%d-run", conns, i)
+				if err := transferOnce(addr, code, path, filepath.Join(dir, "out"), conns); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+// pauseKeepalive is how often a paused sender repeats CtrlPause, so the relay and any NAT in
+// between keep seeing traffic on an otherwise idle connection
+const pauseKeepalive = 15 * time.Second
+
+// pauseRefresh is how often onPause(true) is repeated while paused, so a progress display
+// that skipped a render still ends up showing the pause
+const pauseRefresh = time.Second
+
+// Pauser pauses and resumes a running send. The zero value is ready to use and not paused.
+type Pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	// keepalive overrides pauseKeepalive if not 0
+	keepalive time.Duration
+}
+
+// Pause stops the sender before its next read from disk
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets a paused sender continue
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resumed)
+	}
+}
+
+// Paused reports whether the send is paused
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+func (p *Pauser) keepaliveEvery() time.Duration {
+	if p.keepalive > 0 {
+		return p.keepalive
+	}
+	return pauseKeepalive
+}
+
+// waitResumed returns a channel closed on Resume, or nil if not paused
+func (p *Pauser) waitResumed() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return nil
+	}
+	return p.resumed
+}
+
+// holdWhilePaused blocks while p is paused, telling the receiver with CtrlPause and CtrlResume.
+// onPause, if not nil, is called when the pause starts, every pauseRefresh while paused and
+// when it ends.
+func holdWhilePaused(s *Stream, p *Pauser, onPause func(paused bool)) error {
+	resumed := p.waitResumed()
+	if resumed == nil {
+		return nil
+	}
+	if err := s.SendControl(CtrlPause, nil); err != nil {
+		return err
+	}
+	if onPause != nil {
+		onPause(true)
+		defer onPause(false)
+	}
+	keepalive := time.NewTicker(p.keepaliveEvery())
+	defer keepalive.Stop()
+	refresh := time.NewTicker(pauseRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-resumed:
+			return s.SendControl(CtrlResume, nil)
+		case <-refresh.C:
+			if onPause != nil {
+				onPause(true)
+			}
+		case <-keepalive.C:
+			if err := s.SendControl(CtrlPause, nil); err != nil {
+				return err
+			}
+		case <-s.Done():
+			return s.Err()
+		}
+	}
+}
+
+// watchPause calls onPause for every CtrlPause and CtrlResume from the sender, until stop is
+// closed or s ends
+func watchPause(s *Stream, onPause func(paused bool), stop <-chan struct{}) {
+	paused := false
+	for {
+		select {
+		case c, ok := <-s.Controls():
+			if !ok {
+				return
+			}
+			if c.Kind == CtrlPause {
+				paused = true
+				onPause(true)
+			} else if c.Kind == CtrlResume && paused {
+				paused = false
+				onPause(false)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
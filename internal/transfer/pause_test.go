@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+)
+
+func TestPauser(t *testing.T) {
+	var none *Pauser
+	if none.waitResumed() != nil {
+		t.Fatal("nil Pauser is paused")
+	}
+	p := &Pauser{}
+	if p.Paused() || p.waitResumed() != nil {
+		t.Fatal("zero Pauser is paused")
+	}
+	p.Pause()
+	resumed := p.waitResumed()
+	// Pausing again keeps the same pause
+	p.Pause()
+	if !p.Paused() || p.waitResumed() != resumed {
+		t.Fatal("second Pause started a new pause")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("resumed while paused")
+	default:
+	}
+	p.Resume()
+	p.Resume()
+	if p.Paused() || p.waitResumed() != nil {
+		t.Fatal("still paused after Resume")
+	}
+	select {
+	case <-resumed:
+	default:
+		t.Fatal("Resume did not wake the sender")
+	}
+}
+
+// idleConn hangs up when nothing arrives for timeout, the way a relay drops idle connections
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// pausedTransfer sends path to a receiver whose connection drops after idle without traffic,
+// holding the send paused for pause before resuming it. Returns the received file and the
+// errors of both sides.
+func pausedTransfer(t *testing.T, path string, pauser *Pauser, idle, pause time.Duration) ([]byte, error, error) {
+	t.Helper()
+	key := crypto.DeriveKey("7-fig-3-wren", "")
+	sconn, rconn := net.Pipe()
+	out := filepath.Join(t.TempDir(), "payload")
+	received := make(chan error, 1)
+	go func() {
+		m := NewMux(&idleConn{Conn: rconn, timeout: idle}, key, false, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+		defer m.Close()
+		_, _, err := ReceiveAndDecryptFile(context.Background(), m, out, ReceiveOptions{}, nil)
+		received <- err
+	}()
+	pauser.Pause()
+	sent := make(chan error, 1)
+	go func() {
+		m := NewMux(sconn, key, true, crypto.Encrypt, crypto.Decrypt, MuxConfig{})
+		defer m.Close()
+		_, err := SendEncryptedFile(context.Background(), m, path, SendOptions{Compression: CompressNone, Pause: pauser}, nil)
+		sent <- err
+	}()
+	time.Sleep(pause)
+	pauser.Resume()
+	var sendErr, recvErr error
+	for _, errs := range []struct {
+		err *error
+		c   chan error
+	}{{&sendErr, sent}, {&recvErr, received}} {
+		select {
+		case *errs.err = <-errs.c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer did not finish")
+		}
+	}
+	got, _ := os.ReadFile(out)
+	return got, sendErr, recvErr
+}
+
+func TestPauseOutlastsIdleTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload")
+	data := make([]byte, 3*MerkleChunkSize)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	idle := 100 * time.Millisecond
+
+	t.Run("keepalive", func(t *testing.T) {
+		got, sendErr, recvErr := pausedTransfer(t, path, &Pauser{keepalive: idle / 4}, idle, 10*idle)
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+		}
+	})
+	t.Run("no keepalive", func(t *testing.T) {
+		// Shows the pause really is longer than the idle timeout
+		_, sendErr, recvErr := pausedTransfer(t, path, &Pauser{keepalive: time.Hour}, idle, 10*idle)
+		if sendErr == nil || recvErr == nil {
+			t.Fatalf("send: %v, receive: %v, want both to fail", sendErr, recvErr)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+// ErrBadFileName is returned when the peer offers a file under a name that cannot be saved
+var ErrBadFileName = errors.New("invalid file name")
+
+// TransferInfo describes one transfer in a Peer session
+type TransferInfo struct {
+	ID       uint32
+	Name     string
+	Size     int64
+	Bytes    int64
+	Incoming bool
+	Path     string // where an incoming file was saved, once done
+	SHA256   string // hex SHA-256 of the file, once done
+	State    string // "active", "done" or "failed: reason"
+}
+
+// Peer is one side of a bidirectional session: both peers can send files at any time and
+// every transfer is its own stream on the shared encrypted connection.
+type Peer struct {
+	m   *Mux
+	dir string
+	// OnEvent is called with a human readable line when a transfer starts, finishes or fails
+	OnEvent func(string)
+
+	mu        sync.Mutex
+	transfers map[uint32]*TransferInfo
+	active    map[uint32]*Stream
+}
+
+// NewPeer creates a session over m. Incoming files are saved in dir.
+func NewPeer(m *Mux, dir string) *Peer {
+	return &Peer{
+		m:         m,
+		dir:       dir,
+		OnEvent:   func(string) {},
+		transfers: make(map[uint32]*TransferInfo),
+		active:    make(map[uint32]*Stream),
+	}
+}
+
+// Send starts sending the file at path in the background and returns its transfer id
+func (p *Peer) Send(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return 0, fmt.Errorf("%s is not a regular file", path)
+	}
+	s, err := p.m.OpenStream()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	t := p.track(s, filepath.Base(path), info.Size(), false)
+	go func() {
+		defer f.Close()
+		p.finish(t.ID, describeCancel(context.Background(), p.sendStream(s, f, t), "peer"))
+	}()
+	return t.ID, nil
+}
+
+func (p *Peer) sendStream(s *Stream, f *os.File, t *TransferInfo) error {
+	caps, err := waitCaps(s)
+	if err != nil {
+		return err
+	}
+	res, err := sendFile(s, f, t.Name, t.Size, SendOptions{Compression: CompressAuto}, caps.decoders, func(n int) { p.addBytes(t.ID, n) }, nil)
+	if err != nil {
+		return err
+	}
+	p.setDigest(t.ID, res.Digest)
+	return waitAck(s)
+}
+
+// Cancel aborts an active transfer in either direction, telling the other side it was cancelled
+func (p *Peer) Cancel(id uint32) error {
+	p.mu.Lock()
+	s := p.active[id]
+	p.mu.Unlock()
+	if s == nil {
+		return fmt.Errorf("no active transfer #%d", id)
+	}
+	return s.Reset(cancelReason)
+}
+
+// CancelAll aborts every active transfer
+func (p *Peer) CancelAll() {
+	p.mu.Lock()
+	streams := make([]*Stream, 0, len(p.active))
+	for _, s := range p.active {
+		streams = append(streams, s)
+	}
+	p.mu.Unlock()
+	for _, s := range streams {
+		s.Reset(cancelReason)
+	}
+}
+
+// Transfers returns all transfers of this session ordered by id
+func (p *Peer) Transfers() []TransferInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]TransferInfo, 0, len(p.transfers))
+	for _, t := range p.transfers {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Run accepts transfers from the peer until the connection ends. Returns nil if the peer left cleanly.
+func (p *Peer) Run() error {
+	for {
+		s, err := p.m.AcceptStream()
+		if err != nil {
+			var notice *relay.NoticeError
+			if err == io.EOF || (errors.As(err, &notice) && notice.Notice.Kind == relay.NoticeDisconnect) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			id := s.ID()
+			err := p.receiveStream(s)
+			if err != nil && s.Err() == nil {
+				s.Reset(err.Error())
+			}
+			p.finish(id, describeCancel(context.Background(), err, "peer"))
+		}()
+	}
+}
+
+func (p *Peer) receiveStream(s *Stream) error {
+	if err := sendCaps(s, nil); err != nil {
+		return err
+	}
+	hdr, err := readHeader(s)
+	if err != nil {
+		return err
+	}
+	t := p.track(s, hdr.Name, hdr.Size, true)
+	name, err := sessionFileName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	// Never overwrite anything in the session dir, existing names get a suffix
+	f, err := createPartial(filepath.Join(p.dir, name), AutoSuffix)
+	if err != nil {
+		return err
+	}
+	p.OnEvent(fmt.Sprintf("receiving %s (%d bytes)", hdr.Name, hdr.Size))
+	hasher := NewMerkleHasher()
+	if err := receiveVerified(s, &progressWriter{w: f, p: p, id: t.ID}, hdr, hasher); err != nil {
+		f.Abort()
+		return err
+	}
+	path, err := f.Commit()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	t.Path = path
+	p.mu.Unlock()
+	p.setDigest(t.ID, hasher.Digest())
+	return s.SendControl(CtrlAck, nil)
+}
+
+// sessionFileName returns the name a file from the peer is saved under in the session dir.
+// Only the last element of the peer's name is kept, and it must name a file in that dir.
+func sessionFileName(name string) (string, error) {
+	base := filepath.Base(name)
+	if name == "" || base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("%w: %q", ErrBadFileName, name)
+	}
+	return base, nil
+}
+
+func (p *Peer) setDigest(id uint32, d Digest) {
+	p.mu.Lock()
+	if t, ok := p.transfers[id]; ok {
+		t.SHA256 = d.SHA256
+	}
+	p.mu.Unlock()
+}
+
+func (p *Peer) track(s *Stream, name string, size int64, incoming bool) *TransferInfo {
+	t := &TransferInfo{ID: s.ID(), Name: name, Size: size, Incoming: incoming, State: "active"}
+	p.mu.Lock()
+	p.transfers[t.ID] = t
+	p.active[t.ID] = s
+	p.mu.Unlock()
+	return t
+}
+
+func (p *Peer) finish(id uint32, err error) {
+	p.mu.Lock()
+	delete(p.active, id)
+	t, ok := p.transfers[id]
+	if !ok || t.State != "active" {
+		p.mu.Unlock()
+		return
+	}
+	t.State = "done"
+	if err != nil {
+		t.State = "failed: " + err.Error()
+	}
+	info := *t
+	p.mu.Unlock()
+	dir := "sent"
+	if info.Incoming {
+		dir = "received"
+	}
+	if err != nil {
+		p.OnEvent(fmt.Sprintf("#%d %s failed: %v", info.ID, info.Name, err))
+		return
+	}
+	if info.Incoming {
+		p.OnEvent(fmt.Sprintf("#%d %s %s (%d bytes) as %s, sha256 %s", info.ID, info.Name, dir, info.Bytes, info.Path, info.SHA256))
+		return
+	}
+	p.OnEvent(fmt.Sprintf("#%d %s %s (%d bytes), sha256 %s", info.ID, info.Name, dir, info.Bytes, info.SHA256))
+}
+
+// progressWriter counts bytes written for a transfer
+type progressWriter struct {
+	w  io.Writer
+	p  *Peer
+	id uint32
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.addBytes(pw.id, n)
+	return n, err
+}
+
+func (p *Peer) addBytes(id uint32, n int) {
+	p.mu.Lock()
+	if t, ok := p.transfers[id]; ok {
+		t.Bytes += int64(n)
+	}
+	p.mu.Unlock()
+}
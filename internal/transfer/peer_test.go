@@ -0,0 +1,34 @@
+package transfer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSessionFileName(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"dir/report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/abs/path.txt", "path.txt"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"a/..", ""},
+		{"/", ""},
+		{"///", ""},
+	} {
+		got, err := sessionFileName(tt.name)
+		if tt.want == "" {
+			if !errors.Is(err, ErrBadFileName) {
+				t.Errorf("sessionFileName(%q) = %q, %v, want ErrBadFileName", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sessionFileName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package transfer
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"archive/zip"
 	"io/fs"
@@ -13,83 +17,394 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
-// SendEncryptedFile reads the file at filePath, encrypts each chunk with key, and sends it over conn.
-// If bar is not nil, it updates the progress bar after each chunk.
-func SendEncryptedFile(conn io.Writer, filePath string, key []byte, encryptChunk func([]byte, []byte) ([]byte, error), bar *progressbar.ProgressBar) error {
+// fileHeader is written at the start of every file stream
+type fileHeader struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Compression of the file body, empty for none
+	Compression string `json:"compression,omitempty"`
+	// Connections > 1 means the body is split into stripes sent over that many connections
+	Connections int `json:"connections,omitempty"`
+	// Direct lists the sender's addresses for a direct connection. The body is sent as stripes,
+	// over the direct connection if hole punching works and on this stream if not.
+	Direct []string `json:"direct,omitempty"`
+}
+
+// maxHeaderSize bounds the encoded fileHeader read from a peer
+const maxHeaderSize = 64 * 1024
+
+func writeHeader(w io.Writer, hdr fileHeader) error {
+	data, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("error writing file header: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error writing file header: %w", err)
+	}
+	return nil
+}
+
+func readHeader(r io.Reader) (fileHeader, error) {
+	var hdr fileHeader
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return hdr, fmt.Errorf("error reading file header: %w", err)
+	}
+	if size > maxHeaderSize {
+		return hdr, fmt.Errorf("file header too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return hdr, fmt.Errorf("error reading file header: %w", err)
+	}
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return hdr, fmt.Errorf("invalid file header: %w", err)
+	}
+	return hdr, nil
+}
+
+// SendOptions controls how a file is sent
+type SendOptions struct {
+	// Compression is one of CompressAuto, CompressNone, CompressGzip or CompressZstd
+	Compression string
+	// Pause, if not nil, lets the caller pause and resume the send while it runs
+	Pause *Pauser
+	// Connections > 1 splits the file over that many parallel connections, opened with Dial.
+	// Data is not compressed in that case.
+	Connections int
+	Dial        DialFunc
+	// Direct, if not nil, tries a direct connection to the receiver and falls back to the relay.
+	// Data is then compressed one stripe at a time.
+	Direct Direct
+}
+
+// SendResult describes a completed send
+type SendResult struct {
+	Digest
+	Compression string // algorithm actually used, CompressNone if the data was sent as is
+	Size        int64  // file size
+	WireSize    int64  // size of the file body after compression
+	Direct      bool   // the body bypassed the relay over a direct connection
+}
+
+// SendEncryptedFile sends the file at filePath as one encrypted stream over m.
+// The data is compressed first if opts ask for it and the receiver can decompress it, and is
+// followed by chunk hashes and a Merkle root so the receiver can verify it.
+// Unless m is write-only, it waits for the receiver to acknowledge the complete file.
+// Cancelling ctx aborts the transfer and tells the receiver it was cancelled.
+// If bar is not nil, it updates the progress bar after each chunk and shows when it is paused.
+func SendEncryptedFile(ctx context.Context, m *Mux, filePath string, opts SendOptions, bar *progressbar.ProgressBar) (SendResult, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+		return SendResult{}, fmt.Errorf("error opening file: %w", err)
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return SendResult{}, fmt.Errorf("error reading file info: %w", err)
+	}
 
+	s, err := m.OpenStream()
+	if err != nil {
+		return SendResult{}, fmt.Errorf("error opening stream: %w", err)
+	}
+	stop := cancelOnDone(ctx, s)
+	defer stop()
+	var progress func(int)
+	var onPause func(bool)
+	if bar != nil {
+		progress = func(n int) { bar.Add(n) }
+		onPause = func(paused bool) { describePaused(bar, paused) }
+	}
+	var res SendResult
+	if opts.Connections > 1 {
+		if m.cfg.WriteOnly {
+			s.Reset("sender cannot use parallel connections here")
+			return res, fmt.Errorf("parallel connections need a receiver on the other end")
+		}
+		res, err = sendParallel(m, s, file, info.Name(), info.Size(), min(opts.Connections, MaxConnections), opts, opts.Dial, progress, onPause)
+	} else {
+		res, err = sendSingle(m, s, file, info.Name(), info.Size(), opts, progress, onPause)
+	}
+	err = describeCancel(ctx, err, "receiver")
+	lingerAfterCancel(m, err)
+	return res, err
+}
+
+// sendSingle sends file over the single stream s, or directly if both sides can
+func sendSingle(m *Mux, s *Stream, file *os.File, name string, size int64, opts SendOptions, progress func(int), onPause func(bool)) (SendResult, error) {
+	// A write-only stream cannot hear the receiver, so it assumes a receiver from this build
+	if m.cfg.WriteOnly {
+		return sendFile(s, file, name, size, opts, decoders, progress, onPause)
+	}
+	caps, err := waitCaps(s)
+	if err != nil {
+		return SendResult{Size: size}, err
+	}
+	if opts.Direct != nil && len(caps.direct) > 0 {
+		return sendDirect(m, s, file, name, size, opts, caps.direct, caps.decoders, progress, onPause)
+	}
+	res, err := sendFile(s, file, name, size, opts, caps.decoders, progress, onPause)
+	if err != nil {
+		return res, err
+	}
+	return res, waitAck(s)
+}
+
+// sendFile picks a compression algorithm the receiver supports and writes one file stream:
+// header, body, trailer, FIN. progress, if not nil, is called with the number of plaintext
+// bytes sent, and onPause when opts.Pause pauses or resumes the send.
+func sendFile(s *Stream, file *os.File, name string, size int64, opts SendOptions, supported []string, progress func(int), onPause func(bool)) (SendResult, error) {
+	res := SendResult{Size: size}
+	algo, err := chooseCompression(opts.Compression, file, size, supported)
+	if err != nil {
+		s.Reset("sender could not agree on compression")
+		return res, err
+	}
+	res.Compression = algo
+	if err := writeHeader(s, fileHeader{Name: name, Size: size, Compression: algo}); err != nil {
+		return res, err
+	}
+	wire := &countingWriter{w: s}
+	body, err := compressWriter(wire, algo)
+	if err != nil {
+		return res, err
+	}
+	hasher := NewMerkleHasher()
+	chunks := &leafWriter{w: body, h: hasher}
+	// Send exactly the size announced in the header, even if the file grows meanwhile
+	src := io.LimitReader(file, size)
 	buf := make([]byte, 64*1024) // 64KB buffer
+	var sent int64
 	for {
-		n, err := file.Read(buf)
+		// Stop reading from disk while paused
+		if err := holdWhilePaused(s, opts.Pause, onPause); err != nil {
+			return res, err
+		}
+		n, err := src.Read(buf)
 		if n > 0 {
-			chunk := buf[:n]
-			encryptedChunk, err := encryptChunk(key, chunk)
-			if err != nil {
-				return fmt.Errorf("error encrypting chunk: %w", err)
-			}
-			if err := binary.Write(conn, binary.BigEndian, uint32(len(encryptedChunk))); err != nil {
-				return fmt.Errorf("error writing chunk length: %w", err)
+			if _, err := chunks.Write(buf[:n]); err != nil {
+				return res, fmt.Errorf("error sending chunk: %w", err)
 			}
-			if _, err := conn.Write(encryptedChunk); err != nil {
-				return fmt.Errorf("error sending chunk: %w", err)
-			}
-			if bar != nil {
-				bar.Add(n)
+			sent += int64(n)
+			if progress != nil {
+				progress(n)
 			}
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading file: %w", err)
+			s.Reset("sender could not read the file")
+			return res, fmt.Errorf("error reading file: %w", err)
 		}
 	}
-	binary.Write(conn, binary.BigEndian, uint32(0)) // signal EOF
-	return nil
+	if sent != size {
+		s.Reset("sender's file changed during the transfer")
+		return res, fmt.Errorf("file shrank from %d to %d bytes while sending", size, sent)
+	}
+	if err := chunks.Close(); err != nil {
+		return res, fmt.Errorf("error sending chunk: %w", err)
+	}
+	if err := body.Close(); err != nil {
+		return res, fmt.Errorf("error sending chunk: %w", err)
+	}
+	res.WireSize = wire.n
+	res.Digest = hasher.Digest()
+	if err := writeTrailer(s, hasher); err != nil {
+		return res, err
+	}
+	if err := s.Close(); err != nil {
+		return res, fmt.Errorf("error finishing stream: %w", err)
+	}
+	return res, nil
+}
+
+// peerCaps is what the receiver announces before the file is sent
+type peerCaps struct {
+	decoders []string // compression algorithms it can decode
+	direct   []string // addresses it can be reached at directly, empty if it cannot
 }
 
-// ReceiveAndDecryptFile receives encrypted chunks from conn, decrypts them with key, and writes to outputPath.
-// If bar is not nil, it updates the progress bar after each chunk.
-func ReceiveAndDecryptFile(conn io.Reader, outputPath string, key []byte, decryptChunk func([]byte, []byte) ([]byte, error), bar *progressbar.ProgressBar) error {
-	out, err := os.Create(outputPath)
+// waitCaps waits for the receiver to say what it supports
+func waitCaps(s *Stream) (peerCaps, error) {
+	var caps peerCaps
+	for c := range s.Controls() {
+		switch c.Kind {
+		case CtrlDirect:
+			caps.direct = parseCaps(c.Body)
+		case CtrlCaps:
+			caps.decoders = parseCaps(c.Body)
+			return caps, nil
+		}
+	}
+	return caps, fmt.Errorf("receiver did not answer: %w", s.Err())
+}
+
+// sendCaps tells the sender which compression algorithms this side can decode and, if direct
+// is not nil, where it can be reached directly
+func sendCaps(s *Stream, direct Direct) error {
+	if direct != nil {
+		if err := s.SendControl(CtrlDirect, []byte(strings.Join(direct.Candidates(), ","))); err != nil {
+			return err
+		}
+	}
+	return s.SendControl(CtrlCaps, []byte(strings.Join(decoders, ",")))
+}
+
+// waitAck waits for the receiver to confirm it has written everything
+func waitAck(s *Stream) error {
+	for c := range s.Controls() {
+		if c.Kind == CtrlAck {
+			return nil
+		}
+	}
+	return fmt.Errorf("receiver did not confirm the transfer: %w", s.Err())
+}
+
+// ReceiveAndDecryptFile receives one file stream from m and saves it to outputPath.
+// The file is written to a temporary file next to outputPath and only moved into place once
+// every byte has arrived and matches the sender's chunk hashes, following opts.Exists if
+// outputPath is already taken. Returns the path the file was saved as and its digest.
+// Cancelling ctx aborts the transfer and tells the sender it was cancelled.
+// If bar is not nil, its maximum is set to the file size, it is updated after each chunk and
+// shows when the sender has paused.
+func ReceiveAndDecryptFile(ctx context.Context, m *Mux, outputPath string, opts ReceiveOptions, bar *progressbar.ProgressBar) (string, Digest, error) {
+	// Nothing to tell the sender yet, just stop waiting
+	stopAccept := context.AfterFunc(ctx, func() { m.Close() })
+	s, err := m.AcceptStream()
+	stopAccept()
+	if ctx.Err() != nil {
+		return "", Digest{}, ErrCancelled
+	}
+	if err != nil {
+		return "", Digest{}, fmt.Errorf("error waiting for sender: %w", err)
+	}
+	stop := cancelOnDone(ctx, s)
+	defer stop()
+	if err := sendCaps(s, opts.Direct); err != nil {
+		return "", Digest{}, describeCancel(ctx, err, "sender")
+	}
+	if bar != nil {
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go watchPause(s, func(paused bool) { describePaused(bar, paused) }, stopWatch)
+	}
+	hasher := NewMerkleHasher()
+	path, err := receiveStream(m, s, outputPath, opts, hasher, bar)
 	if err != nil {
-		return fmt.Errorf("error creating output file: %w", err)
+		err = describeCancel(ctx, err, "sender")
+		lingerAfterCancel(m, err)
+		return "", Digest{}, err
 	}
-	defer out.Close()
+	return path, hasher.Digest(), nil
+}
 
-	for {
-		var chunkLen uint32
-		if err := binary.Read(conn, binary.BigEndian, &chunkLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading chunk length: %w", err)
+func receiveStream(m *Mux, s *Stream, outputPath string, opts ReceiveOptions, hasher *MerkleHasher, bar *progressbar.ProgressBar) (string, error) {
+	hdr, err := readHeader(s)
+	if err != nil {
+		return "", err
+	}
+	if bar != nil {
+		bar.ChangeMax64(hdr.Size)
+	}
+	out, err := createPartial(outputPath, opts.Exists)
+	if err != nil {
+		s.Reset("receiver could not create output file")
+		return "", err
+	}
+
+	if hdr.Connections > 1 {
+		var progress func(int)
+		if bar != nil {
+			progress = func(n int) { bar.Add(n) }
 		}
-		if chunkLen == 0 {
-			break // End of file
+		err = receiveParallel(m, s, out, hdr, opts.Dial, hasher, progress)
+	} else if len(hdr.Direct) > 0 {
+		var progress func(int)
+		if bar != nil {
+			progress = func(n int) { bar.Add(n) }
 		}
-		encryptedChunk := make([]byte, chunkLen)
-		if _, err := io.ReadFull(conn, encryptedChunk); err != nil {
-			return fmt.Errorf("error reading chunk: %w", err)
+		err = receiveDirect(m, s, out, hdr, opts.Direct, hasher, progress)
+	} else {
+		var dst io.Writer = out
+		if bar != nil {
+			dst = io.MultiWriter(out, bar)
 		}
-		chunk, err := decryptChunk(key, encryptedChunk)
-		if err != nil {
-			return fmt.Errorf("error decrypting chunk: %w", err)
+		err = receiveVerified(s, dst, hdr, hasher)
+	}
+	if err != nil {
+		out.Abort()
+		return "", err
+	}
+	path, err := out.Commit()
+	if err != nil {
+		s.Reset("receiver could not save the file")
+		return "", err
+	}
+	s.SendControl(CtrlAck, nil)
+	return path, nil
+}
+
+// receiveVerified decompresses the file body described by hdr from s into dst, checking each
+// chunk as it arrives, then checks the sender's trailer. hasher hashes the data. The stream
+// is reset if verification fails.
+func receiveVerified(s *Stream, dst io.Writer, hdr fileHeader, hasher *MerkleHasher) error {
+	if hdr.Connections > 1 {
+		s.Reset("parallel connections are not supported here")
+		return fmt.Errorf("sender asked for %d parallel connections", hdr.Connections)
+	}
+	if len(hdr.Direct) > 0 {
+		s.Reset("direct connections are not supported here")
+		return fmt.Errorf("sender asked for a direct connection")
+	}
+	r := bufio.NewReader(s)
+	body, finish, err := decompressReader(r, hdr.Compression)
+	if err != nil {
+		if s.Err() == nil {
+			s.Reset("receiver cannot decompress " + hdr.Compression)
 		}
-		if _, err := out.Write(chunk); err != nil {
-			return fmt.Errorf("error writing chunk to file: %w", err)
+		return err
+	}
+	if err := readVerified(dst, body, hdr.Size, hasher); err != nil {
+		if s.Err() == nil {
+			s.Reset("receiver could not verify the file")
 		}
-		if bar != nil {
-			bar.Add(len(chunk))
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	return verifyRest(r, s, hasher)
+}
+
+// verifyRest checks the trailer read from r, the rest of stream s, against hasher
+func verifyRest(r io.Reader, s *Stream, hasher *MerkleHasher) error {
+	if err := verifyTrailer(r, hasher); err != nil {
+		if s.Err() == nil {
+			s.Reset("receiver could not verify the file")
 		}
+		return err
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		s.Reset("unexpected data after the file")
+		return fmt.Errorf("unexpected data after the file")
 	}
 	return nil
 }
 
+// describePaused labels bar while the transfer is paused, so it does not look hung
+func describePaused(bar *progressbar.ProgressBar, paused bool) {
+	if paused {
+		bar.Describe("paused")
+	} else {
+		bar.Describe("")
+	}
+}
+
 // ZipDir zips the contents of srcDir into a temp zip file and returns the path to the zip file.
 // Preserves file permissions and timestamps. Caller is responsible for deleting the temp file after use.
 func ZipDir(srcDir string) (string, error) {
@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/schollz/progressbar/v3"
 	"github.com/shanki200801/qshare/internal/codegen"
+	"github.com/shanki200801/qshare/internal/config"
 	"github.com/shanki200801/qshare/internal/crypto"
+	"github.com/shanki200801/qshare/internal/direct"
+	"github.com/shanki200801/qshare/internal/logging"
+	"github.com/shanki200801/qshare/internal/relay"
 	"github.com/shanki200801/qshare/internal/transfer"
 	"github.com/shanki200801/qshare/internal/validate"
 	"github.com/spf13/cobra"
@@ -16,25 +31,89 @@ import (
 
 func main() {
 	godotenv.Load()
-	relayServer := os.Getenv("RELAY_SERVER")
-	if relayServer == "" {
-		relayServer = "localhost:4000"
-	}
+	// An ordered, comma separated list of relays, the first one that is up carries new codes
+	var relayList string
+	// Private relays only serve clients presenting a token their operator issued
+	var relayToken string
+	// The config file's settings for the chosen profile, flags and the environment override them
+	var prof config.Profile
 
+	var logLevel, logFormat, profileName string
 	var rootCmd = &cobra.Command{
 		Use:   "qshare",
 		Short: "qshare is a p2p file sharing CLI tool",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := logging.Setup(logFormat, logLevel); err != nil {
+				return err
+			}
+			// qshare config loads the file itself, so it can still be used to fix a broken one
+			for c := cmd; c != nil; c = c.Parent() {
+				if c.Name() == "config" {
+					return nil
+				}
+			}
+			var err error
+			if _, prof, err = loadProfile(profileName); err != nil {
+				return err
+			}
+			if relayList == "" {
+				relayList = os.Getenv("RELAY_SERVER")
+			}
+			if relayList == "" {
+				relayList = prof.Relay
+			}
+			if relayList == "" {
+				relayList = defaultRelay
+			}
+			if relayToken = os.Getenv("RELAY_TOKEN"); relayToken == "" {
+				relayToken = prof.Token
+			}
+			return useTLSSettings(prof)
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "warn", "Least severe diagnostics to print to stderr: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", logging.FormatText, "Diagnostics format: text or json")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Config file profile to use (default $"+profileEnv+" or the file's profile setting)")
+	rootCmd.PersistentFlags().StringVar(&relayList, "relay", "", "Relay address, or a comma separated list to fail over between (default $RELAY_SERVER or the config file's relay)")
 
 	var filePath string
 	var ekey string
 	var outputPath string
 	var allowRetry bool
+	var useMailbox bool
+	var mailboxTTL time.Duration
+	var maxReceivers int
+	var overwrite bool
+	var noClobber bool
+	var compress string
+	var limit string
+	var connections int
+	var relayOnly bool
 
 	var sendCmd = &cobra.Command{
 		Use:   "send",
 		Short: "Send a file",
 		Run: func(comd *cobra.Command, args []string) {
+			if !comd.Flags().Changed("limit") {
+				limit = prof.Limit
+			}
+			if err := transfer.CheckCompression(compress); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			rate, err := transfer.ParseRate(limit)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			if connections > 1 && (useMailbox || maxReceivers > 1) {
+				fmt.Println("Error: --connections cannot be combined with --mailbox or --max-receivers")
+				os.Exit(1)
+			}
+			if connections > transfer.MaxConnections {
+				fmt.Printf("Error: --connections can be at most %d\n", transfer.MaxConnections)
+				os.Exit(1)
+			}
 			info, err := os.Stat(filePath)
 			if err != nil {
 				fmt.Println("Error:", err)
@@ -64,22 +143,33 @@ func main() {
 			if ekey != "" {
 				fmt.Println("Using encryption key:", ekey)
 			}
-			// Connect to the relay server
-			conn, err := net.Dial("tcp", relayServer)
+			if ekey, err = resolveEkey(ekey, prof.Ekey); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			// Handshake: identify as sender
+			hs := relay.Handshake{Role: "sender", Retry: allowRetry}
+			hs.Options = map[string]string{}
+			if useMailbox {
+				hs.Options[relay.OptMailbox] = strconv.Itoa(int(mailboxTTL.Seconds()))
+			}
+			if maxReceivers > 1 {
+				hs.Options[relay.OptReceivers] = strconv.Itoa(maxReceivers)
+			}
+			// Connect to the relay server and generate the one-time code
+			down, up := transfer.NewBandwidth(rate), transfer.NewBandwidth(rate)
+			conn, relayServer, limits, err := joinRelay(relayEndpoints(relayList), &hs, relayToken, down, up)
 			if err != nil {
-				fmt.Println("Error connecting to relay server:", err)
+				fmt.Println("Error:", err)
 				os.Exit(1)
 			}
 			defer conn.Close()
-			// Generate and print the one-time code
-			code := codegen.GenerateCode()
+			code := hs.Code
 			fmt.Println("Your code is:", code)
-			// Handshake: identify as sender
-			if allowRetry {
-				fmt.Fprintf(conn, "%s:sender:retry\n", code)
-			} else {
-				fmt.Fprintf(conn, "%s:sender\n", code)
+			if maxReceivers > 1 {
+				fmt.Printf("Waiting for %d receivers to join\n", maxReceivers)
 			}
+			slog.Debug("Joined relay room", "relay", relayServer, "code", code, "limits", limits)
 			// Derive encryption key from code and ekey
 			key := crypto.DeriveKey(code, ekey)
 			// Create a progress bar for file transfer
@@ -88,18 +178,114 @@ func main() {
 				fmt.Println("Error getting file info:", err)
 				os.Exit(1)
 			}
+			// Nobody answers a mailbox upload or a broadcast, so those streams are write-only
+			writeOnly := useMailbox || maxReceivers > 1
+			// Fail now rather than part way if the relay will not carry the whole file. A direct
+			// connection bypasses the relay's quotas, so then it is only worth a warning.
+			mayDirect := !relayOnly && !writeOnly && connections <= 1
+			if max := limits.Max(); max > 0 && fileInfo.Size() > max {
+				if !mayDirect {
+					fmt.Printf("Error: the relay carries at most %d bytes for this transfer, the file is %d bytes\n", max, fileInfo.Size())
+					os.Exit(1)
+				}
+				fmt.Printf("Warning: the relay carries at most %d bytes, the file can only get through over a direct connection\n", max)
+			}
 			bar := progressbar.Default(fileInfo.Size())
+			var statuses <-chan []relay.ReceiverStatus
+			if maxReceivers > 1 {
+				statuses = watchReceivers(conn, maxReceivers, fileInfo.Size(), bar)
+			}
 			// Send the file in encrypted chunks with progress bar
-			if err := transfer.SendEncryptedFile(conn, filePath, key, crypto.Encrypt, bar); err != nil {
+			mux := transfer.NewMux(conn, key, true, crypto.Encrypt, crypto.Decrypt, transfer.MuxConfig{WriteOnly: writeOnly})
+			// Ctrl-C cancels the transfer in-band so the receiver knows it was deliberate
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			pauser := &transfer.Pauser{}
+			restoreTerm := pauseControls(pauser, cancel)
+			sendOpts := transfer.SendOptions{
+				Compression: compress,
+				Pause:       pauser,
+				Connections: connections,
+				Dial:        parallelDialer(relayServer, relayToken, code, "sender", down, up),
+			}
+			// Nobody can answer a mailbox upload or broadcast directly, and parallel connections go through the relay
+			if mayDirect {
+				if d := directPath(relayServer, key, down, up); d != nil {
+					defer d.Close()
+					sendOpts.Direct = d
+				}
+			}
+			result, err := transfer.SendEncryptedFile(ctx, mux, filePath, sendOpts, bar)
+			restoreTerm()
+			if err != nil {
+				// The relay explains dropped connections with a notice, prefer that over the write error
+				var notice *relay.NoticeError
+				if writeOnly {
+					if notice := relay.CheckNotice(conn); notice != nil {
+						err = notice
+					}
+				} else if errors.As(mux.Err(), &notice) && !errors.As(err, &notice) {
+					err = notice
+				}
+				if errors.Is(err, transfer.ErrCancelled) {
+					fmt.Println("\nTransfer cancelled")
+					os.Exit(1)
+				}
 				fmt.Println("Error sending file:", err)
 				os.Exit(1)
 			}
+			if useMailbox {
+				// Half-close so the relay knows the upload is complete, then wait for it to be stored
+				closeWrite(conn)
+				expires, err := relay.ReadStoredReply(conn)
+				if err != nil {
+					fmt.Println("Error:", err)
+					os.Exit(1)
+				}
+				fmt.Printf("File stored on relay until %s\n", expires.Format(time.RFC1123))
+				fmt.Printf("The receiver can run: qshare receive %s\n", code)
+				return
+			}
+			if maxReceivers > 1 {
+				// Half-close so the relay sees the end of the stream, then wait for every receiver to finish
+				closeWrite(conn)
+				failed := 0
+				for _, st := range <-statuses {
+					if st.Err != "" {
+						failed++
+						fmt.Printf("Receiver %d: failed after %d bytes: %s\n", st.Receiver, st.Bytes, st.Err)
+					} else {
+						fmt.Printf("Receiver %d: completed (%d bytes)\n", st.Receiver, st.Bytes)
+					}
+				}
+				if failed > 0 {
+					fmt.Printf("File sent to %d of %d receivers\n", maxReceivers-failed, maxReceivers)
+					os.Exit(1)
+				}
+			}
 			fmt.Println("File sent successfully")
+			if result.Direct {
+				fmt.Println("Sent directly to the receiver, bypassing the relay")
+			}
+			// Receivers print the same hash, so both sides can compare it out-of-band
+			fmt.Println("SHA-256:", result.SHA256)
+			if result.Compression != transfer.CompressNone && result.Size > 0 {
+				fmt.Printf("Compressed with %s: %d -> %d bytes (%.1f%%)\n", result.Compression, result.Size, result.WireSize, 100*float64(result.WireSize)/float64(result.Size))
+			}
 		},
 	}
 	sendCmd.Flags().StringVarP(&filePath, "file", "f", "", "Path to the file to send")
 	sendCmd.Flags().StringVar(&ekey, "ekey", "", "Extra encryption key (must match on receive)")
 	sendCmd.Flags().BoolVarP(&allowRetry, "allowRetry", "r", false, "Allow sender to reconnect within 2 minutes if disconnected during transfer")
+	sendCmd.Flags().BoolVar(&useMailbox, "mailbox", false, "Upload the encrypted file to the relay so the receiver can fetch it later")
+	sendCmd.Flags().DurationVar(&mailboxTTL, "ttl", 24*time.Hour, "How long the relay keeps a --mailbox upload")
+	sendCmd.Flags().IntVar(&maxReceivers, "max-receivers", 1, "Number of receivers that will join with the same code (broadcast)")
+	sendCmd.Flags().StringVar(&compress, "compress", transfer.CompressAuto, "Compress before encrypting: auto, none, zstd or gzip (auto skips data that does not compress)")
+	sendCmd.Flags().StringVar(&limit, "limit", "", "Limit bandwidth, e.g. 5MB/s (default unlimited)")
+	sendCmd.Flags().IntVarP(&connections, "connections", "n", 1, "Number of parallel connections, helps on high-latency links")
+	sendCmd.Flags().BoolVar(&relayOnly, "relay-only", false, "Never connect directly to the receiver, send everything through the relay")
 	sendCmd.MarkFlagRequired("file")
 
 	var receiveCmd = &cobra.Command{
@@ -108,36 +294,423 @@ func main() {
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			code := args[0]
+			if overwrite && noClobber {
+				fmt.Println("Error: --overwrite and --no-clobber cannot be used together")
+				os.Exit(1)
+			}
+			if !cmd.Flags().Changed("limit") {
+				limit = prof.Limit
+			}
+			rate, err := transfer.ParseRate(limit)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			if !cmd.Flags().Changed("output") && prof.OutputDir != "" {
+				outputPath = filepath.Join(prof.OutputDir, outputPath)
+			}
+			// An existing output file gets a numbered name unless told otherwise
+			opts := transfer.ReceiveOptions{Exists: transfer.AutoSuffix}
+			if overwrite {
+				opts.Exists = transfer.Overwrite
+			} else if noClobber {
+				opts.Exists = transfer.NoClobber
+			}
 			if ekey != "" {
 				fmt.Println("Using encryption key:", ekey)
 			}
+			if ekey, err = resolveEkey(ekey, prof.Ekey); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
 			// Derive decryption key from code and ekey
 			key := crypto.DeriveKey(code, ekey)
-			// Connect to the relay server
-			conn, err := net.Dial("tcp", relayServer)
+			// Connect to the relay the code was issued on
+			relayServer, err := hintedRelay(relayEndpoints(relayList), code)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			conn, err := relay.Dial(relayServer)
 			if err != nil {
 				fmt.Println("Error connecting to relay server:", err)
 				os.Exit(1)
 			}
 			defer conn.Close()
+			down, up := transfer.NewBandwidth(rate), transfer.NewBandwidth(rate)
+			conn = transfer.LimitConn(conn, down, up)
 			// Handshake: identify as receiver (always send :retry for best UX)
-			fmt.Fprintf(conn, "%s:receiver:retry\n", code)
-			// Use an indeterminate progress bar (file size unknown)
+			limits, err := relay.ClientHandshake(conn, withToken(relay.Handshake{Code: code, Role: "receiver", Retry: true}, relayToken))
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			slog.Debug("Joined relay room", "relay", relayServer, "code", code, "limits", limits)
+			// The sender decides how many connections to use, more are dialed as it asks
+			opts.Dial = parallelDialer(relayServer, relayToken, code, "receiver", down, up)
+			// A stored upload is played back by the relay, nobody is there to answer or to meet directly
+			if !relayOnly && !limits.Mailbox {
+				if d := directPath(relayServer, key, down, up); d != nil {
+					defer d.Close()
+					opts.Direct = d
+				}
+			}
+			// Start indeterminate, the size arrives with the file header
 			bar := progressbar.Default(-1)
-			// Receive and decrypt the file in chunks with progress bar
-			if err := transfer.ReceiveAndDecryptFile(conn, outputPath, key, crypto.Decrypt, bar); err != nil {
+			mux := transfer.NewMux(conn, key, false, crypto.Encrypt, crypto.Decrypt, transfer.MuxConfig{ReadOnly: limits.Mailbox})
+			// Receive and decrypt the file stream with progress bar
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			savedPath, digest, err := transfer.ReceiveAndDecryptFile(ctx, mux, outputPath, opts, bar)
+			if err != nil {
+				if errors.Is(err, transfer.ErrCancelled) {
+					fmt.Println("\nTransfer cancelled")
+					os.Exit(1)
+				}
 				fmt.Printf("Error receiving file: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Printf("File received and decrypted successfully! Saved as: %s\n", outputPath)
+			// The relay keeps a stored upload until told it arrived intact
+			if limits.Mailbox {
+				if err := relay.AckDownload(conn); err != nil {
+					slog.Warn("Relay will keep the upload until it expires", "err", err)
+				}
+			}
+			fmt.Printf("File received and decrypted successfully! Saved as: %s\n", savedPath)
+			fmt.Println("Verified SHA-256:", digest.SHA256)
 		},
 	}
 	receiveCmd.Flags().StringVarP(&outputPath, "output", "o", "Received_file", "Output file path")
 	receiveCmd.Flags().StringVar(&ekey, "ekey", "", "Extra encryption key (must match sender)")
+	receiveCmd.Flags().StringVar(&limit, "limit", "", "Limit bandwidth, e.g. 5MB/s (default unlimited)")
+	receiveCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace the output file if it already exists")
+	receiveCmd.Flags().BoolVar(&noClobber, "no-clobber", false, "Fail instead of saving under a new name if the output file already exists")
+	receiveCmd.Flags().BoolVar(&relayOnly, "relay-only", false, "Never connect directly to the sender, receive everything through the relay")
+
+	var sessionDir string
+	var sessionCmd = &cobra.Command{
+		Use:   "session [code]",
+		Short: "Start or join an interactive session where both sides can send files",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if !cmd.Flags().Changed("dir") && prof.OutputDir != "" {
+				sessionDir = prof.OutputDir
+			}
+			if !cmd.Flags().Changed("limit") {
+				limit = prof.Limit
+			}
+			rate, err := transfer.ParseRate(limit)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			if ekey, err = resolveEkey(ekey, prof.Ekey); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			relays := relayEndpoints(relayList)
+			down, up := transfer.NewBandwidth(rate), transfer.NewBandwidth(rate)
+			// The side that starts the session generates the code and takes the sender slot in the room
+			initiator := len(args) == 0
+			var conn net.Conn
+			hs := relay.Handshake{Role: "sender"}
+			if initiator {
+				conn, _, _, err = joinRelay(relays, &hs, relayToken, down, up)
+			} else {
+				hs = relay.Handshake{Code: args[0], Role: "receiver"}
+				var relayServer string
+				if relayServer, err = hintedRelay(relays, hs.Code); err == nil {
+					if conn, err = relay.Dial(relayServer); err == nil {
+						conn = transfer.LimitConn(conn, down, up)
+						_, err = relay.ClientHandshake(conn, withToken(hs, relayToken))
+					}
+				}
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			defer conn.Close()
+			if initiator {
+				fmt.Println("Your code is:", hs.Code)
+				fmt.Println("Waiting for the other side to join...")
+			}
+			mux := transfer.NewMux(conn, crypto.DeriveKey(hs.Code, ekey), initiator, crypto.Encrypt, crypto.Decrypt, transfer.MuxConfig{})
+			if err := runSession(conn, transfer.NewPeer(mux, sessionDir), os.Stdin); err != nil {
+				fmt.Println("\nSession ended:", err)
+				os.Exit(1)
+			}
+		},
+	}
+	sessionCmd.Flags().StringVar(&ekey, "ekey", "", "Extra encryption key (must match on both sides)")
+	sessionCmd.Flags().StringVarP(&sessionDir, "dir", "d", ".", "Directory to save received files in")
+	sessionCmd.Flags().StringVar(&limit, "limit", "", "Limit bandwidth, e.g. 5MB/s (default unlimited)")
 
-	rootCmd.AddCommand(sendCmd, receiveCmd)
+	rootCmd.AddCommand(sendCmd, receiveCmd, sessionCmd, relayCommand(), configCommand())
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
+
+// watchReceivers reads broadcast status lines from the relay, showing per-receiver progress in the
+// bar description. The final status of every receiver is delivered once all have finished.
+func watchReceivers(conn net.Conn, n int, size int64, bar *progressbar.ProgressBar) <-chan []relay.ReceiverStatus {
+	result := make(chan []relay.ReceiverStatus, 1)
+	go func() {
+		statuses := make([]relay.ReceiverStatus, n)
+		for i := range statuses {
+			statuses[i] = relay.ReceiverStatus{Receiver: i + 1, Err: "no status from relay"}
+		}
+		finished := 0
+		for finished < n {
+			line, err := relay.ReadLine(conn)
+			if err != nil {
+				break
+			}
+			st, err := relay.ParseReceiverStatus(line)
+			if err != nil || st.Receiver < 1 || st.Receiver > n {
+				continue
+			}
+			if st.Finished() {
+				finished++
+			}
+			statuses[st.Receiver-1] = st
+			desc := ""
+			for _, s := range statuses {
+				pct := 0.0
+				if size > 0 {
+					pct = min(100, float64(s.Bytes)*100/float64(size))
+				}
+				desc += fmt.Sprintf("#%d %.0f%% ", s.Receiver, pct)
+			}
+			bar.Describe(desc)
+		}
+		result <- statuses
+	}()
+	return result
+}
+
+// runSession runs the interactive prompt of a session, reading commands from in, until the user
+// quits or the peer leaves. Returns why the session broke off if it did.
+func runSession(conn net.Conn, peer *transfer.Peer, in io.Reader) error {
+	peer.OnEvent = func(msg string) { fmt.Printf("\r%s\n> ", msg) }
+	// Directories are sent as zips made for the purpose, kept until the session ends since
+	// their transfers may still be reading them
+	var zips []string
+	defer func() {
+		for _, zip := range zips {
+			os.Remove(zip)
+		}
+	}()
+	ended := make(chan error, 1)
+	go func() { ended <- peer.Run() }()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	// Ctrl-C cancels whatever is in flight so the other side is told, then leaves
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	fmt.Println("Commands: send <path>, cancel <id>, ls, quit")
+	fmt.Print("> ")
+	for {
+		select {
+		case <-interrupted:
+			peer.CancelAll()
+			fmt.Println("\nSession cancelled")
+			conn.Close()
+			return nil
+		case err := <-ended:
+			if err != nil {
+				return err
+			}
+			fmt.Println("\nThe other side left the session")
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch cmd {
+			case "":
+			case "send":
+				if arg == "" {
+					fmt.Println("Usage: send <path>")
+					break
+				}
+				path := strings.TrimSpace(arg)
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					zipPath, err := transfer.ZipDir(path)
+					if err != nil {
+						fmt.Println("Error zipping directory:", err)
+						break
+					}
+					named := filepath.Join(filepath.Dir(zipPath), filepath.Base(path)+".zip")
+					if err := os.Rename(zipPath, named); err != nil {
+						os.Remove(zipPath)
+						fmt.Println("Error zipping directory:", err)
+						break
+					}
+					zips = append(zips, named)
+					path = named
+				}
+				id, err := peer.Send(path)
+				if err != nil {
+					fmt.Println("Error:", err)
+					break
+				}
+				fmt.Printf("#%d sending %s\n", id, filepath.Base(path))
+			case "cancel":
+				id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(arg), "#"), 10, 32)
+				if err != nil {
+					fmt.Println("Usage: cancel <id>")
+					break
+				}
+				if err := peer.Cancel(uint32(id)); err != nil {
+					fmt.Println("Error:", err)
+				}
+			case "ls":
+				for _, t := range peer.Transfers() {
+					dir := "->"
+					if t.Incoming {
+						dir = "<-"
+					}
+					fmt.Printf("#%d %s %s %d/%d bytes %s\n", t.ID, dir, t.Name, t.Bytes, t.Size, t.State)
+				}
+			case "quit", "exit":
+				conn.Close()
+				return nil
+			default:
+				fmt.Println("Unknown command. Commands: send <path>, cancel <id>, ls, quit")
+			}
+			fmt.Print("> ")
+		}
+	}
+}
+
+// relayEndpoints parses the relay list, exiting if it is invalid
+func relayEndpoints(list string) []relay.Endpoint {
+	relays, err := relay.ParseRelayList(list)
+	if err != nil {
+		fmt.Println("Error: invalid relay list:", err)
+		os.Exit(1)
+	}
+	return relays
+}
+
+// joinRelay connects to the first available relay of relays and joins hs there under a new code
+// carrying a hint to that relay. A relay that turns us away because it is shutting down hands
+// over to the next one. Returns the connection, limited by down and up, and the relay's URL.
+func joinRelay(relays []relay.Endpoint, hs *relay.Handshake, token string, down, up *transfer.Bandwidth) (net.Conn, string, relay.Limits, error) {
+	code := codegen.GenerateCode()
+	for from := 0; from < len(relays); {
+		conn, i, err := relay.DialFirst(relays[from:])
+		if err != nil {
+			return nil, "", relay.Limits{}, fmt.Errorf("error connecting to relay server: %w", err)
+		}
+		i += from
+		conn = transfer.LimitConn(conn, down, up)
+		hs.Code = relay.WithHint(code, i)
+		limits, err := relay.ClientHandshake(conn, withToken(*hs, token))
+		var notice *relay.NoticeError
+		if errors.As(err, &notice) && notice.Notice.Kind == relay.NoticeGoAway {
+			slog.Info("Relay is shutting down, trying the next", "relay", relays[i].URL)
+			conn.Close()
+			from = i + 1
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return nil, "", relay.Limits{}, err
+		}
+		return conn, relays[i].URL, limits, nil
+	}
+	return nil, "", relay.Limits{}, errors.New("every relay is shutting down, try again later")
+}
+
+// hintedRelay returns the URL of the relay code was issued on. Only that relay has its room, so
+// there is nothing to fail over to.
+func hintedRelay(relays []relay.Endpoint, code string) (string, error) {
+	i := relay.HintOf(code)
+	if i >= len(relays) {
+		return "", fmt.Errorf("the code was issued on relay %d but the relay list has %d", i+1, len(relays))
+	}
+	return relays[i].URL, nil
+}
+
+// closeWrite half-closes conn so the relay sees the end of the stream
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// parallelDialer opens the extra connections of a parallel transfer under code, sharing the
+// bandwidth limits of the first connection
+func parallelDialer(relayServer, token, code, role string, down, up *transfer.Bandwidth) transfer.DialFunc {
+	return func(i int) (io.ReadWriteCloser, error) {
+		conn, err := relay.Dial(relayServer)
+		if err != nil {
+			return nil, err
+		}
+		conn = transfer.LimitConn(conn, down, up)
+		hs := relay.Handshake{Code: code, Role: role, Options: map[string]string{relay.OptConn: strconv.Itoa(i)}}
+		if _, err := relay.ClientHandshake(conn, withToken(hs, token)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// withToken adds token to hs for relays that require one, unless it is empty
+func withToken(hs relay.Handshake, token string) relay.Handshake {
+	if token == "" {
+		return hs
+	}
+	opts := map[string]string{relay.OptToken: token}
+	for k, v := range hs.Options {
+		opts[k] = v
+	}
+	hs.Options = opts
+	return hs
+}
+
+// directLink is a direct connection to the other side, punched with the help of the relay's
+// rendezvous and held to the same bandwidth limits as the relay connection
+type directLink struct {
+	*direct.Endpoint
+	down, up *transfer.Bandwidth
+}
+
+// directPath prepares a direct connection to the other side. Returns nil if no UDP socket can
+// be opened or the relay's rendezvous does not tell us our public address, the transfer then
+// stays on the relay.
+func directPath(relayServer string, key []byte, down, up *transfer.Bandwidth) *directLink {
+	_, addr, err := relay.ParseRelayURL(relayServer)
+	if err != nil {
+		slog.Info("No direct path, staying on the relay", "err", err)
+		return nil
+	}
+	ep, err := direct.Discover(addr, key)
+	if err != nil {
+		slog.Info("No direct path, staying on the relay", "err", err)
+		return nil
+	}
+	slog.Debug("Direct path candidates", "candidates", ep.Candidates())
+	return &directLink{Endpoint: ep, down: down, up: up}
+}
+
+func (d *directLink) Connect(peer []string, initiator bool) (io.ReadWriteCloser, error) {
+	conn, err := d.Endpoint.Connect(peer, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return transfer.LimitConn(conn, d.down, d.up), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/shanki200801/qshare/internal/transfer"
+	"golang.org/x/term"
+)
+
+// pauseControls lets the user pause and resume a send by pressing p and r, or with SIGUSR1
+// and SIGUSR2 from another process. Keys need raw terminal mode, where Ctrl-C no longer
+// raises SIGINT, so it is handled here by calling cancel. The returned func restores the terminal.
+func pauseControls(p *transfer.Pauser, cancel context.CancelFunc) (restore func()) {
+	stopSignals := pauseSignals(p)
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return stopSignals
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return stopSignals
+	}
+	fmt.Print("Press p to pause, r to resume\r\n")
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				return
+			}
+			switch b[0] {
+			case 'p', 'P':
+				p.Pause()
+			case 'r', 'R':
+				p.Resume()
+			case 3: // Ctrl-C
+				cancel()
+			}
+		}
+	}()
+	return func() {
+		stopSignals()
+		term.Restore(fd, state)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "github.com/shanki200801/qshare/internal/transfer"
+
+// pauseSignals is a no-op on Windows, which has no SIGUSR1/SIGUSR2. Use the p and r keys instead.
+func pauseSignals(p *transfer.Pauser) (stop func()) {
+	return func() {}
+}
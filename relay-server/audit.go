@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+// reopenOnHangup reopens the audit log on SIGHUP, after logrotate has moved it away
+func reopenOnHangup(f *relay.RotatingFile) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := f.Reopen(); err != nil {
+				slog.Error("Error reopening audit log", "err", err)
+			}
+		}
+	}()
+}
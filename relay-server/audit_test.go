@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/relay"
+)
+
+func TestReopenOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := relay.OpenRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reopenOnHangup(f)
+	f.Write([]byte("before\n"))
+	// What logrotate does before signalling the relay
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("audit log not reopened after SIGHUP")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.Write([]byte("after\n"))
+	if b, _ := os.ReadFile(path); string(b) != "after\n" {
+		t.Fatalf("reopened log holds %q", b)
+	}
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "before\n" {
+		t.Fatalf("moved log holds %q", b)
+	}
+}
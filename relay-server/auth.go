@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/relay"
+	"github.com/shanki200801/qshare/internal/transfer"
+)
+
+// tokenCommand runs "relay-server token <keygen|issue>"
+func tokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: relay-server token keygen | relay-server token issue -key-file FILE [flags]")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "keygen":
+		key := make([]byte, 32)
+		rand.Read(key)
+		fmt.Println(hex.EncodeToString(key))
+	case "issue":
+		fs := flag.NewFlagSet("token issue", flag.ExitOnError)
+		keyFile := fs.String("key-file", "", "File holding the hex issuer key, as printed by token keygen")
+		id := fs.String("id", "", "Name of the token holder, shown in relay logs")
+		ttl := fs.Duration("ttl", time.Hour, "How long the token is valid")
+		maxBytes := fs.String("max-bytes", "", "Bytes the token may relay in total, e.g. 10GB (empty for no cap)")
+		maxRooms := fs.Int("max-rooms", 0, "Codes the token may be in at once (0 for no cap)")
+		fs.Parse(args[1:])
+		if *keyFile == "" {
+			fatal("token issue needs -key-file")
+		}
+		// The token travels in the handshake line, which the relay bounds
+		if len(*id) > 64 {
+			fatal("-id is longer than 64 characters")
+		}
+		key, err := relay.ReadKeyFile(*keyFile)
+		if err != nil {
+			fatal("Invalid -key-file", "err", err)
+		}
+		limit, err := transfer.ParseSize(*maxBytes)
+		if err != nil {
+			fatal("Invalid -max-bytes", "err", err)
+		}
+		t := relay.Token{ID: *id, Expires: time.Now().Add(*ttl).Unix(), MaxBytes: limit, MaxRooms: *maxRooms}
+		s, err := relay.IssueToken(key, t)
+		if err != nil {
+			fatal("Error issuing token", "err", err)
+		}
+		fmt.Println(s)
+	default:
+		fatal("Unknown token command", "command", args[0])
+	}
+}
@@ -1,216 +1,193 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/shanki200801/qshare/internal/logging"
 	"github.com/shanki200801/qshare/internal/relay"
+	"github.com/shanki200801/qshare/internal/transfer"
 )
 
-type room struct {
-	sender               net.Conn
-	receiver             net.Conn
-	createdAt            time.Time
-	retryable            bool
-	lastActivity         time.Time
-	senderDisconnected   bool
-	receiverDisconnected bool
+// fatal logs msg with args as an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-var (
-	rooms = make(map[string]*room)
-	mu    sync.Mutex
-)
-
 func main() {
-	// Minimal HTTP handler for Render health check
-	go func() {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		})
-		log.Println("Starting HTTP health check handler on :8080")
-		http.ListenAndServe(":8080", nil)
-	}()
-	ln, err := net.Listen("tcp", ":4000")
-	// if error, log and exit
-	if err != nil {
-		log.Fatalf("Error listening: %v", err)
-	}
-	log.Println("Server is running on port 4000")
-	relay.StartRateLimitCleanup()
-	go cleanupRooms()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		log.Printf("New connection from %s", conn.RemoteAddr())
-		// Rate limiting
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		code := peekHandshakeCode(conn)
-		allowed, reason := relay.CheckAndRecordRateLimit(ip, code)
-		if !allowed {
-			log.Printf("Connection from %s for code %s rejected: %s", ip, code, reason)
-			conn.Close()
-			continue
-		}
-		go handleConnection(conn)
-	}
-}
-
-func handleConnection(conn net.Conn) {
-	defer conn.Close() //Defer runs after function exits, i.e it's similar to finally in other language
-	code, role, retryable, err := handshakeWithRetry(conn)
-	if err != nil {
-		// Try to extract code from handshake for failed tracking
-		codeFromHandshake := peekHandshakeCode(conn)
-		if codeFromHandshake != "" {
-			allowed, triesLeft, blocked, blockMsg := relay.CheckAndRecordFailedHandshake(codeFromHandshake)
-			if !allowed {
-				if blocked {
-					conn.Write([]byte(blockMsg + "\n"))
-					log.Printf("Handshake failed from %s: %v (code %s blocked)", conn.RemoteAddr(), err, codeFromHandshake)
-				} else {
-					msg := fmt.Sprintf("Invalid code or key. You have %d tries remaining before this code is blocked.\n", triesLeft)
-					conn.Write([]byte(msg))
-					log.Printf("Handshake failed from %s: %v (code %s, %d tries left)", conn.RemoteAddr(), err, codeFromHandshake, triesLeft)
-				}
-			}
-		}
-		log.Printf("Handshake failed from %s: %v", conn.RemoteAddr(), err)
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		tokenCommand(os.Args[2:])
 		return
 	}
-	mu.Lock()
-	r, ok := rooms[code]
-	if !ok {
-		r = &room{createdAt: time.Now(), retryable: retryable, lastActivity: time.Now()}
-		rooms[code] = r
-		log.Printf("Room created for code %s at %v (retryable=%v)", code, r.createdAt, retryable)
-	}
-	if role == "sender" {
-		r.sender = conn
-		r.senderDisconnected = false
-		log.Printf("Sender joined room %s from %s", code, conn.RemoteAddr())
-	} else {
-		r.receiver = conn
-		r.receiverDisconnected = false
-		log.Printf("Receiver joined room %s from %s", code, conn.RemoteAddr())
-	}
-	r.lastActivity = time.Now()
-	// If both sender and receiver are set, start the piping
-	if r.sender != nil && r.receiver != nil {
-		go pipeWithNotify(r, "sender")
-		go pipeWithNotify(r, "receiver")
-		if !r.retryable {
-			delete(rooms, code)
-			log.Printf("Room %s completed and deleted (not retryable)", code)
-		}
+	listen := flag.String("listen", "tcp://:4000", "Comma-separated relay URLs to listen on, e.g. tcp://:4000,quic://:4433 (tls:// and quic:// need -tls-cert)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate chain for tls:// and quic:// listeners")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long active transfers may keep running after SIGTERM")
+	limitBackend := flag.String("ratelimit-backend", "memory", "Rate limit backend: memory, or redis to share limits between relays")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "Address of the Redis compatible server for -ratelimit-backend=redis and cluster mode")
+	clusterNode := flag.String("cluster-node", "", "Address other relays reach this one's -cluster-listen at, e.g. 10.0.0.5:4001; enables cluster mode, sharing rooms through -redis-addr (empty disables)")
+	clusterListen := flag.String("cluster-listen", ":4001", "TCP address to accept connections forwarded by other relays on; keep it private to the cluster")
+	clusterKeyFile := flag.String("cluster-key-file", "", "File holding the hex key that signs forwarded connections, the same on every relay of the cluster")
+	var cfg relay.Config
+	var flags relay.Flags
+	flags.Register(flag.CommandLine)
+	flag.IntVar(&cfg.MaxHandshakes, "max-handshakes", 64, "Maximum number of handshakes read concurrently")
+	mailboxDir := flag.String("mailbox-dir", "", "Directory for store-and-forward uploads (empty disables mailbox mode)")
+	mailboxMaxSize := flag.Int64("mailbox-max-size", 1<<30, "Largest single mailbox upload in bytes (0 for no limit)")
+	mailboxQuota := flag.Int64("mailbox-quota", 10<<30, "Total bytes the mailbox may hold (0 for no limit)")
+	mailboxMaxTTL := flag.Duration("mailbox-max-ttl", 7*24*time.Hour, "Longest time an upload is kept")
+	flag.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", 10*time.Second, "How long a client has to send its handshake")
+	rendezvous := flag.String("rendezvous", ":4000", "UDP address that tells clients their public endpoint for hole punching (empty disables)")
+	auditLog := flag.String("audit-log", "", "File to append a JSON line audit record of every session to (empty disables)")
+	auditMaxSize := flag.String("audit-max-size", "100MB", "Rotate the audit log once it reaches this size (0 leaves rotation to logrotate, reopening on SIGHUP)")
+	auditKeep := flag.Int("audit-keep", 10, "Number of rotated audit logs to keep")
+	auditKeyFile := flag.String("audit-key-file", "", "File holding the hex key that codes are hashed with in the audit log (default a new key each start)")
+	logLevel := flag.String("log-level", "info", "Least severe log messages to print: debug, info, warn or error")
+	logFormat := flag.String("log-format", logging.FormatText, "Log output format: text or json")
+	flag.Parse()
+
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	mu.Unlock()
-	//Block here until the connection is closed
-	select {}
-}
 
-func handshakeWithRetry(conn net.Conn) (code, role string, retryable bool, err error) {
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
+	err := flags.Apply(&cfg, transfer.RelayUnits)
 	if err != nil {
-		return "", "", false, err
+		fatal("Invalid relay flag", "err", err)
 	}
-	//Expect: code:role[:retry]\n (e.g 5-sku-transfer:sender:retry)
-	var retryStr string
-	n, _ := fmt.Sscanf(line, "%s[^:]:%s:%s\n", &code, &role, &retryStr)
-	if n == 3 && retryStr == "retry" {
-		log.Printf("Handshake: code=%s, role=%s, retryable=true, from=%s", code, role, conn.RemoteAddr())
-		return code, role, true, nil
+	if cfg.TokenKey != nil {
+		slog.Info("Clients need a token to use this relay")
 	}
-	n, _ = fmt.Sscanf(line, "%s[^:]:%s\n", &code, &role)
-	if n != 2 {
-		return "", "", false, fmt.Errorf("invalid handshake: %q", line)
-	}
-	log.Printf("Handshake: code=%s, role=%s, retryable=false, from=%s", code, role, conn.RemoteAddr())
-	return code, role, false, nil
-}
 
-func pipeWithNotify(r *room, who string) {
-	var src, dst net.Conn
-	if who == "sender" {
-		src = r.sender
-		dst = r.receiver
-	} else {
-		src = r.receiver
-		dst = r.sender
+	// store is the Redis connection, shared by rate limits, cluster mode and token quotas when
+	// they use it
+	var store *relay.RESPStore
+	switch *limitBackend {
+	case "memory":
+		// The server makes and cleans up in-memory limits itself
+	case "redis":
+		store = relay.NewRESPStore(*redisAddr)
+		cfg.RateLimit = relay.NewSharedRateLimit(store)
+		cfg.HandshakeGuard = &relay.HandshakeGuard{Store: store}
+		slog.Info("Using shared rate limits", "redis", *redisAddr)
+	default:
+		fatal("Unknown rate limit backend", "backend", *limitBackend)
 	}
-	if src == nil || dst == nil {
-		return
+
+	if *clusterNode != "" {
+		if *clusterKeyFile == "" {
+			fatal("Cluster mode needs -cluster-key-file")
+		}
+		if cfg.ClusterKey, err = relay.ReadKeyFile(*clusterKeyFile); err != nil {
+			fatal("Invalid -cluster-key-file", "err", err)
+		}
+		if store == nil {
+			store = relay.NewRESPStore(*redisAddr)
+		}
+		cfg.Coordinator, cfg.ClusterNode = store, *clusterNode
 	}
-	_, err := io.Copy(dst, src)
-	if err != nil {
-		log.Printf("Pipe error (%s): %v", who, err)
+	if store != nil {
+		// Token quotas then survive restarts and hold across the cluster
+		cfg.TokenUsage = store
 	}
-	// Notify the other side
-	if dst != nil {
-		dst.Write([]byte("DISCONNECT\n"))
+
+	if *auditLog != "" {
+		maxSize, err := transfer.ParseSize(*auditMaxSize)
+		if err != nil {
+			fatal("Invalid -audit-max-size", "err", err)
+		}
+		f, err := relay.OpenRotatingFile(*auditLog, maxSize, *auditKeep)
+		if err != nil {
+			fatal("Error opening audit log", "err", err)
+		}
+		defer f.Close()
+		cfg.Audit = relay.NewJSONLSink(f)
+		if *auditKeyFile != "" {
+			if cfg.AuditKey, err = relay.ReadKeyFile(*auditKeyFile); err != nil {
+				fatal("Invalid -audit-key-file", "err", err)
+			}
+		}
+		reopenOnHangup(f)
+		slog.Info("Writing audit log", "path", *auditLog)
 	}
-	mu.Lock()
-	if who == "sender" {
-		r.senderDisconnected = true
-	} else {
-		r.receiverDisconnected = true
+
+	if *mailboxDir != "" {
+		mb, err := relay.NewDiskMailbox(*mailboxDir)
+		if err != nil {
+			fatal("Error opening mailbox", "err", err)
+		}
+		mb.MaxItemBytes, mb.MaxTotalBytes, mb.MaxTTL = *mailboxMaxSize, *mailboxQuota, *mailboxMaxTTL
+		cfg.Mailbox = mb
+		slog.Info("Mailbox mode enabled", "dir", *mailboxDir)
 	}
-	r.lastActivity = time.Now()
-	mu.Unlock()
-}
 
-// cleanupRooms periodically removes abandoned or expired rooms
-func cleanupRooms() {
-	for {
-		time.Sleep(time.Minute)
-		mu.Lock()
-		now := time.Now()
-		for code, r := range rooms {
-			if r.sender == nil || r.receiver == nil {
-				if now.Sub(r.createdAt) > 10*time.Minute {
-					log.Printf("Cleaning up abandoned room %s (created at %v)", code, r.createdAt)
-					delete(rooms, code)
-				}
-			} else if r.retryable {
-				if r.senderDisconnected || r.receiverDisconnected {
-					if now.Sub(r.lastActivity) > 2*time.Minute {
-						log.Printf("Cleaning up retryable room %s after disconnect window", code)
-						delete(rooms, code)
-					}
-				}
-			}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal("Invalid -tls-cert or -tls-key", "err", err)
 		}
-		mu.Unlock()
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		relay.RegisterTransport("tls", relay.TLSTransport{Config: tlsConfig})
+		relay.RegisterTransport("quic", relay.QUICTransport{TLS: tlsConfig})
 	}
-}
 
-// peekHandshakeCode peeks at the handshake to extract the code for rate limiting
-func peekHandshakeCode(conn net.Conn) string {
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	reader := bufio.NewReader(conn)
-	line, err := reader.Peek(128)
-	conn.SetReadDeadline(time.Time{})
-	if err != nil {
-		return ""
+	srv := relay.NewServer(cfg)
+	// Minimal HTTP handler for Render health check
+	health := &http.Server{Addr: ":8080", Handler: srv.HealthHandler()}
+	go func() {
+		slog.Info("Starting HTTP health check handler", "addr", health.Addr)
+		health.ListenAndServe()
+	}()
+	var listeners []net.Listener
+	for _, url := range strings.Split(*listen, ",") {
+		url = strings.TrimSpace(url)
+		ln, err := relay.Listen(url)
+		// if error, log and exit
+		if err != nil {
+			fatal("Error listening", "url", url, "err", err)
+		}
+		slog.Info("Server is listening", "url", url)
+		listeners = append(listeners, ln)
+	}
+	var rendezvousConn net.PacketConn
+	if *rendezvous != "" {
+		if rendezvousConn, err = net.ListenPacket("udp", *rendezvous); err != nil {
+			fatal("Error listening for rendezvous probes", "err", err)
+		}
+		slog.Info("Rendezvous is answering UDP probes", "addr", *rendezvous)
+		go relay.ServeRendezvous(rendezvousConn)
 	}
-	var code, role, retry string
-	n, _ := fmt.Sscanf(string(line), "%s[^:]:%s:%s\n", &code, &role, &retry)
-	if n >= 1 {
-		return code
+	for _, ln := range listeners {
+		go srv.Serve(ln)
 	}
-	n, _ = fmt.Sscanf(string(line), "%s[^:]:%s\n", &code, &role)
-	if n >= 1 {
-		return code
+	if *clusterNode != "" {
+		ln, err := net.Listen("tcp", *clusterListen)
+		if err != nil {
+			fatal("Error listening for forwarded connections", "addr", *clusterListen, "err", err)
+		}
+		slog.Info("Cluster mode enabled", "node", *clusterNode, "redis", *redisAddr)
+		go srv.ServeCluster(ln)
 	}
-	return ""
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+	slog.Info("Draining", "signal", sig, "timeout", *drainTimeout)
+	if rendezvousConn != nil {
+		rendezvousConn.Close()
+	}
+	srv.Shutdown(*drainTimeout)
+	health.Shutdown(context.Background())
+	slog.Info("Relay stopped")
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/logging"
+	"github.com/shanki200801/qshare/internal/relay"
+	"github.com/shanki200801/qshare/internal/transfer"
+	"github.com/spf13/cobra"
+)
+
+// relayCommand returns "qshare relay", which runs the same relay as relay-server in this
+// process, so one machine on a LAN can host transfers without a separate binary
+func relayCommand() *cobra.Command {
+	var cfg relay.Config
+	var flags relay.Flags
+	var port int
+	var health string
+	var drainTimeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "relay",
+		Short: "Run a relay server other qshare clients can connect through",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Unlike a transfer, a relay is expected to say what it is doing
+			if !cmd.Flags().Changed("log-level") {
+				format, _ := cmd.Flags().GetString("log-format")
+				if err := logging.Setup(format, "info"); err != nil {
+					return err
+				}
+			}
+			if err := flags.Apply(&cfg, transfer.RelayUnits); err != nil {
+				return err
+			}
+
+			addr := ":" + strconv.Itoa(port)
+			ln, err := relay.Listen("tcp://" + addr)
+			if err != nil {
+				return fmt.Errorf("error listening on %s: %w", addr, err)
+			}
+			// Rendezvous shares the port number over UDP, which is what clients probe
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				ln.Close()
+				return fmt.Errorf("error listening for rendezvous probes on %s: %w", addr, err)
+			}
+			srv := relay.NewServer(cfg)
+			go relay.ServeRendezvous(pc)
+			go srv.Serve(ln)
+			var hs *http.Server
+			if health != "" {
+				hs = &http.Server{Addr: health, Handler: srv.HealthHandler()}
+				go hs.ListenAndServe()
+			}
+			fmt.Printf("Relay is listening on port %d\n", port)
+			for _, ip := range lanAddrs() {
+				fmt.Printf("Clients on this network can use: RELAY_SERVER=%s\n", net.JoinHostPort(ip, strconv.Itoa(port)))
+			}
+
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+			sig := <-sigs
+			slog.Info("Draining", "signal", sig, "timeout", drainTimeout)
+			pc.Close()
+			srv.Shutdown(drainTimeout)
+			if hs != nil {
+				hs.Shutdown(context.Background())
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVarP(&port, "port", "p", 4000, "TCP port clients connect to, and UDP port for direct connection rendezvous")
+	cmd.Flags().StringVar(&health, "health", ":8080", "Address to serve the HTTP health check clients probe on (empty disables)")
+	cmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long active transfers may keep running after Ctrl-C")
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	flags.Register(fs)
+	cmd.Flags().AddGoFlagSet(fs)
+	return cmd
+}
+
+// lanAddrs returns this machine's non-loopback IPv4 addresses, for telling the user how to reach the relay
+func lanAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	return ips
+}
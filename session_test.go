@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shanki200801/qshare/internal/crypto"
+	"github.com/shanki200801/qshare/internal/transfer"
+)
+
+func TestSessionSendsDirectory(t *testing.T) {
+	// Zips of sent directories are made here
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	src := filepath.Join(t.TempDir(), "photos")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("holiday"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := crypto.DeriveKey("8-kiwi-5-swan", "")
+	aconn, bconn := net.Pipe()
+	a := transfer.NewPeer(transfer.NewMux(aconn, key, true, crypto.Encrypt, crypto.Decrypt, transfer.MuxConfig{}), t.TempDir())
+	bdir := t.TempDir()
+	b := transfer.NewPeer(transfer.NewMux(bconn, key, false, crypto.Encrypt, crypto.Decrypt, transfer.MuxConfig{}), bdir)
+	go b.Run()
+
+	commands, in := io.Pipe()
+	ended := make(chan error, 1)
+	go func() { ended <- runSession(aconn, a, commands) }()
+	io.WriteString(in, "send "+src+"\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := b.Transfers()
+		if len(list) == 1 && list[0].State == "done" {
+			break
+		}
+		if len(list) == 1 && list[0].State != "active" {
+			t.Fatalf("transfer %s", list[0].State)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("directory not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	io.WriteString(in, "quit\n")
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end on quit")
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(bdir, "photos.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 || zr.File[0].Name != "a.txt" {
+		t.Fatalf("received zip holds %v", zr.File)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Fatalf("zip of the sent directory left behind: %v", left)
+	}
+}